@@ -38,6 +38,10 @@ type CallInfo struct {
 	cb      interface{}
 }
 
+func (ci *CallInfo) ID() interface{} {
+	return ci.fInfo.id
+}
+
 type RetInfo struct {
 	// nil
 	// interface{}
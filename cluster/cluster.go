@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/islovingness/leaf/log"
 	"github.com/islovingness/leaf/conf"
+	"github.com/islovingness/leaf/console"
 	"github.com/islovingness/leaf/network"
 	"github.com/islovingness/leaf/chanrpc"
 	lgob "github.com/islovingness/leaf/network/gob"
@@ -19,177 +20,399 @@ const (
 	NeedWaitRequestTimes = 5
 )
 
+// copied into Default by Init
 var (
+	AgentChanRPC *chanrpc.Server
+
+	// called on the heartbeat goroutine, must goroutine safe
+	// a link is degraded once a heartbeat is missed, which never happens
+	// with HeartBeatMissTimes 1 as the link is closed at the first miss
+	OnAgentDegraded  func(agent *Agent)
+	OnAgentRecovered func(agent *Agent)
+)
+
+// the cluster used by the package functions, configured from conf by Init
+var Default = New(console.Default)
+
+// Cluster links one server to the others, see conf for the meaning of the fields
+type Cluster struct {
+	ServerName          string
+	ListenAddr          string
+	ConnAddrs           map[string]string
+	PendingWriteNum     int
+	PendingWriteTimeout time.Duration
+	HeartBeatInterval   time.Duration
+	HeartBeatMissTimes  int
+	AgentChanRPC        *chanrpc.Server
+
+	// called on the heartbeat goroutine, must goroutine safe
+	// see the package variables for when a link is degraded
+	OnAgentDegraded  func(agent *Agent)
+	OnAgentRecovered func(agent *Agent)
+
+	// the "cluster" command is registered there, nil: none
+	Console *console.Console
+	// the highest level granted to the commands other servers run here,
+	// whatever level their users have, default console.LevelReadOnly
+	ConsoleLevel console.Level
+	// nil: the log package
+	Logger *log.Logger
+
 	closing      bool
-	closeSig     = make(chan bool, 1)
+	closeSig     chan bool
 	wg           sync.WaitGroup
 	server       *network.TCPServer
 	clientsMutex sync.Mutex
-	clients      = map[string]*network.TCPClient{}
+	clients      map[string]*network.TCPClient
 	agentsMutex  sync.RWMutex
-	agents       = map[string]*Agent{}
-	AgentChanRPC *chanrpc.Server
-)
+	agents       map[string]*Agent
+	routeMap     map[interface{}]*chanrpc.Client
+
+	codecs          map[string]Codec
+	migrateRouteMap map[string]*chanrpc.Client
+	entitiesMutex   sync.Mutex
+	entities        map[string]*entityInfo
+
+	consoleJobs     chan func()
+	consoleCloseSig chan bool
+
+	// set by SetHeartBeatInterval and SetHeartBeatMissTimes, 0: unchanged,
+	// applied by the heartbeat goroutine
+	heartBeatMutex        sync.Mutex
+	newHeartBeatInterval  time.Duration
+	newHeartBeatMissTimes int
+	heartBeatSig          chan bool
+}
 
-func Init() {
-	if conf.ListenAddr != "" {
-		server = new(network.TCPServer)
-		server.Addr = conf.ListenAddr
-		server.MaxConnNum = int(math.MaxInt32)
-		server.PendingWriteNum = conf.PendingWriteNum
-		server.LenMsgLen = 4
-		server.MaxMsgLen = math.MaxUint32
-		server.NewAgent = newAgent
+func New(console *console.Console) *Cluster {
+	c := new(Cluster)
+	c.Console = console
+	c.closeSig = make(chan bool, 1)
+	c.clients = make(map[string]*network.TCPClient)
+	c.agents = make(map[string]*Agent)
+	c.routeMap = make(map[interface{}]*chanrpc.Client)
+	c.codecs = make(map[string]Codec)
+	c.migrateRouteMap = make(map[string]*chanrpc.Client)
+	c.entities = make(map[string]*entityInfo)
+	c.consoleJobs = make(chan func(), consoleQueueLen)
+	c.heartBeatSig = make(chan bool, 1)
+	return c
+}
 
-		server.Start()
+func (c *Cluster) Init() {
+	c.closing = false
+	if c.ListenAddr != "" {
+		c.server = new(network.TCPServer)
+		c.server.Addr = c.ListenAddr
+		c.server.MaxConnNum = int(math.MaxInt32)
+		c.server.PendingWriteNum = c.PendingWriteNum
+		c.server.WriteTimeout = c.PendingWriteTimeout
+		c.server.LenMsgLen = 4
+		c.server.MaxMsgLen = math.MaxUint32
+		c.server.NewAgent = c.newAgent
+
+		c.server.Start()
 	}
 
-	for serverName, addr := range conf.ConnAddrs {
-		AddClient(serverName, addr)
+	for serverName, addr := range c.ConnAddrs {
+		c.AddClient(serverName, addr)
 	}
 
-	if conf.HeartBeatInterval <= 0 {
-		conf.HeartBeatInterval = 5
-		log.Release("invalid HeartBeatInterval, reset to %v", conf.HeartBeatInterval)
+	if c.HeartBeatInterval <= 0 {
+		c.HeartBeatInterval = 5 * time.Second
+		c.Logger.Release("invalid HeartBeatInterval, reset to %v", c.HeartBeatInterval)
+	}
+	if c.HeartBeatMissTimes <= 0 {
+		c.HeartBeatMissTimes = 1
+		c.Logger.Release("invalid HeartBeatMissTimes, reset to %v", c.HeartBeatMissTimes)
 	}
 
-	wg.Add(1)
-	go run()
+	if c.Console != nil {
+		c.Console.RegisterSessionFunc("cluster", "list servers of the cluster or run a command on them", c.commandCluster)
+		c.Console.SetLevel("cluster", console.LevelReadOnly)
+	}
+
+	c.consoleCloseSig = make(chan bool)
+	c.wg.Add(2)
+	go c.run()
+	go c.runConsole(c.consoleCloseSig)
 }
 
-func run() {
-	defer wg.Done()
+func (c *Cluster) run() {
+	defer c.wg.Done()
 
-	msg := &S2S_HeartBeat{}
-	timer := time.NewTicker(time.Duration(conf.HeartBeatInterval) * time.Second)
+	timer := time.NewTicker(c.HeartBeatInterval)
+	defer func() {
+		timer.Stop()
+	}()
 
 	for {
 		select {
-		case <-closeSig:
+		case <-c.closeSig:
 			return
+		case <-c.heartBeatSig:
+			if c.applyHeartBeat() {
+				timer.Stop()
+				timer = time.NewTicker(c.HeartBeatInterval)
+			}
 		case <-timer.C:
-			agentsMutex.RLock()
-			for _, agent := range agents {
-				if atomic.AddInt32(&agent.heartBeatWaitTimes, 1) >= 2 {
-					agent.conn.Destroy()
-				} else {
-					agent.WriteMsg(msg)
-				}
+			c.heartBeat()
+		}
+	}
+}
+
+// reports whether HeartBeatInterval changed
+func (c *Cluster) applyHeartBeat() bool {
+	c.heartBeatMutex.Lock()
+	defer c.heartBeatMutex.Unlock()
+
+	missTimes := c.newHeartBeatMissTimes
+	c.newHeartBeatMissTimes = 0
+	if missTimes > 0 && missTimes != c.HeartBeatMissTimes {
+		c.HeartBeatMissTimes = missTimes
+		c.Logger.Release("HeartBeatMissTimes set to %v", c.HeartBeatMissTimes)
+	}
+	interval := c.newHeartBeatInterval
+	c.newHeartBeatInterval = 0
+	if interval <= 0 || interval == c.HeartBeatInterval {
+		return false
+	}
+	c.HeartBeatInterval = interval
+	c.Logger.Release("HeartBeatInterval set to %v", c.HeartBeatInterval)
+	return true
+}
+
+// changes HeartBeatInterval of a running cluster, the next heartbeat is sent
+// an interval later, <= 0: 5s as with Init
+// goroutine safe
+func (c *Cluster) SetHeartBeatInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	c.heartBeatMutex.Lock()
+	c.newHeartBeatInterval = interval
+	c.heartBeatMutex.Unlock()
+	c.signalHeartBeat()
+}
+
+// changes HeartBeatMissTimes of a running cluster, <= 0: 1 as with Init
+// goroutine safe
+func (c *Cluster) SetHeartBeatMissTimes(missTimes int) {
+	if missTimes <= 0 {
+		missTimes = 1
+	}
+
+	c.heartBeatMutex.Lock()
+	c.newHeartBeatMissTimes = missTimes
+	c.heartBeatMutex.Unlock()
+	c.signalHeartBeat()
+}
+
+func (c *Cluster) signalHeartBeat() {
+	select {
+	case c.heartBeatSig <- true:
+	default:
+	}
+}
+
+func (c *Cluster) heartBeat() {
+	for _, agent := range c.getAgents() {
+		missTimes := int(atomic.AddInt32(&agent.heartBeatWaitTimes, 1)) - 1
+		if missTimes >= c.HeartBeatMissTimes {
+			c.Logger.Release("%v server heartbeat timeout", agent.ServerName)
+			agent.conn.Destroy()
+			continue
+		}
+		if missTimes > 0 && atomic.CompareAndSwapInt32(&agent.degraded, 0, 1) {
+			c.Logger.Release("%v server is degraded", agent.ServerName)
+			if c.OnAgentDegraded != nil {
+				c.OnAgentDegraded(agent)
 			}
-			agentsMutex.RUnlock()
 		}
+		// a full write queue blocks for PendingWriteTimeout, the other servers must not wait
+		go agent.WriteMsg(agent.heartBeatMsg())
 	}
 }
 
-func AddClient(serverName, addr string) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
+// a copy, so that the agents are written to without holding agentsMutex
+func (c *Cluster) getAgents() []*Agent {
+	c.agentsMutex.RLock()
+	defer c.agentsMutex.RUnlock()
 
-	_removeClient(serverName)
+	agents := make([]*Agent, 0, len(c.agents))
+	for _, agent := range c.agents {
+		agents = append(agents, agent)
+	}
+	return agents
+}
+
+func (c *Cluster) AddClient(serverName, addr string) {
+	c.clientsMutex.Lock()
+	defer c.clientsMutex.Unlock()
+
+	c._removeClient(serverName)
 
 	client := new(network.TCPClient)
 	client.Addr = addr
 	client.ConnNum = 1
 	client.ConnectInterval = 3 * time.Second
-	client.PendingWriteNum = conf.PendingWriteNum
+	client.PendingWriteNum = c.PendingWriteNum
+	client.WriteTimeout = c.PendingWriteTimeout
 	client.LenMsgLen = 4
 	client.MaxMsgLen = math.MaxUint32
-	client.NewAgent = newAgent
+	client.NewAgent = c.newAgent
 	client.AutoReconnect = true
 
 	client.Start()
-	clients[serverName] = client
+	c.clients[serverName] = client
 }
 
-func _removeClient(serverName string) {
-	client, ok := clients[serverName]
+func (c *Cluster) _removeClient(serverName string) {
+	client, ok := c.clients[serverName]
 	if ok {
 		client.Close()
-		delete(clients, serverName)
+		delete(c.clients, serverName)
 	}
 }
 
-func RemoveClient(serverName string) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
+func (c *Cluster) RemoveClient(serverName string) {
+	c.clientsMutex.Lock()
+	defer c.clientsMutex.Unlock()
 
-	_removeClient(serverName)
+	c._removeClient(serverName)
 }
 
-func addAgent(serverName string, agent *Agent) {
-	agentsMutex.Lock()
-	defer agentsMutex.Unlock()
+func (c *Cluster) addAgent(serverName string, agent *Agent) {
+	c.agentsMutex.Lock()
+	defer c.agentsMutex.Unlock()
 
-	_removeAgent(serverName)
+	c._removeAgent(serverName)
 
 	agent.ServerName = serverName
-	agents[agent.ServerName] = agent
-	log.Release("%v server is online", serverName)
+	c.agents[agent.ServerName] = agent
+	c.Logger.Release("%v server is online", serverName)
 
-	if AgentChanRPC != nil {
-		AgentChanRPC.Go("NewServerAgent", serverName, agent)
+	if c.AgentChanRPC != nil {
+		c.AgentChanRPC.Go("NewServerAgent", serverName, agent)
 	}
 }
 
-func _removeAgent(serverName string) {
-	agent, ok := agents[serverName]
+func (c *Cluster) _removeAgent(serverName string) {
+	agent, ok := c.agents[serverName]
 	if ok {
-		delete(agents, serverName)
+		delete(c.agents, serverName)
 		agent.Destroy()
-		log.Release("%v server is offline", serverName)
+		c.Logger.Release("%v server is offline", serverName)
 
-		if AgentChanRPC != nil {
-			AgentChanRPC.Go("CloseServerAgent", serverName, agent)
+		if c.AgentChanRPC != nil {
+			c.AgentChanRPC.Go("CloseServerAgent", serverName, agent)
 		}
 	}
 }
 
-func removeAgent(serverName string) {
-	agentsMutex.Lock()
-	defer agentsMutex.Unlock()
+func (c *Cluster) removeAgent(serverName string) {
+	c.agentsMutex.Lock()
+	defer c.agentsMutex.Unlock()
 
-	_removeAgent(serverName)
+	c._removeAgent(serverName)
 }
 
-func Destroy() {
-	closing = true
+func (c *Cluster) Destroy() {
+	c.closing = true
 	waitRequestTimes := 0
 	for {
 		time.Sleep(time.Second)
 
-		requestCount := GetRequestCount()
+		requestCount := c.GetRequestCount()
 		if requestCount == 0 {
 			waitRequestTimes += 1
 			if waitRequestTimes >= NeedWaitRequestTimes {
 				break
 			} else {
-				log.Release("wait request count down %v", NeedWaitRequestTimes-waitRequestTimes)
+				c.Logger.Release("wait request count down %v", NeedWaitRequestTimes-waitRequestTimes)
 			}
 		} else {
 			waitRequestTimes = 0
-			log.Release("has %v request", requestCount)
+			c.Logger.Release("has %v request", requestCount)
 		}
 	}
 
-	closeSig <- true
-	wg.Wait()
+	c.close()
+}
+
+func (c *Cluster) close() {
+	c.closeSig <- true
+	close(c.consoleCloseSig)
+	c.wg.Wait()
 
-	if server != nil {
-		server.Close()
+	if c.server != nil {
+		c.server.Close()
+		c.server = nil
 	}
 
-	clientsMutex.Lock()
-	for _, client := range clients {
+	c.clientsMutex.Lock()
+	for serverName, client := range c.clients {
 		client.Close()
+		delete(c.clients, serverName)
 	}
-	clientsMutex.Unlock()
+	c.clientsMutex.Unlock()
+
+	if c.Console != nil {
+		c.Console.Unregister("cluster")
+	}
+}
+
+// copies the cluster settings of conf
+func (c *Cluster) LoadConf() {
+	c.ServerName = conf.ServerName
+	c.ListenAddr = conf.ListenAddr
+	c.ConnAddrs = conf.ConnAddrs
+	c.PendingWriteNum = conf.PendingWriteNum
+	c.PendingWriteTimeout = time.Duration(conf.PendingWriteTimeout) * time.Millisecond
+	c.HeartBeatInterval = time.Duration(conf.HeartBeatInterval) * time.Second
+	c.HeartBeatMissTimes = conf.HeartBeatMissTimes
+	c.ConsoleLevel = console.LevelReadOnly
+	if conf.ClusterConsoleAdmin {
+		c.ConsoleLevel = console.LevelAdmin
+	}
+}
+
+// initializes the default cluster from conf
+func Init() {
+	Default.LoadConf()
+	Default.AgentChanRPC = AgentChanRPC
+	Default.OnAgentDegraded = OnAgentDegraded
+	Default.OnAgentRecovered = OnAgentRecovered
+	Default.Init()
+}
+
+func AddClient(serverName, addr string) {
+	Default.AddClient(serverName, addr)
+}
+
+func RemoveClient(serverName string) {
+	Default.RemoveClient(serverName)
+}
+
+func Destroy() {
+	Default.Destroy()
 }
 
 type Agent struct {
 	ServerName         string
+	cluster            *Cluster
 	conn               *network.TCPConn
 	userData           interface{}
 	heartBeatWaitTimes int32
+	connectedSince     time.Time
+	degraded           int32
+	rtt                int64
+	clockSkew          int64
+	// the last heartbeat received, echoed in the heartbeats sent
+	heartBeatMutex  sync.Mutex
+	peerHeartBeat   int64
+	peerHeartBeatAt int64
 
 	encMutex sync.Mutex
 	encoder  *lgob.Encoder
@@ -198,17 +421,22 @@ type Agent struct {
 	sync.Mutex
 	requestID  uint32
 	requestMap map[uint32]*RequestInfo
+	// streams opened by the remote server, keyed by its request id
+	peerStreams map[uint32]*Stream
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
+func (c *Cluster) newAgent(conn *network.TCPConn) network.Agent {
 	a := new(Agent)
+	a.cluster = c
 	a.conn = conn
+	a.connectedSince = time.Now()
 	a.requestMap = make(map[uint32]*RequestInfo)
+	a.peerStreams = make(map[uint32]*Stream)
 
 	a.encoder = lgob.NewEncoder()
 	a.decoder = lgob.NewDecoder()
 
-	msg := &S2S_NotifyServerName{ServerName: conf.ServerName}
+	msg := &S2S_NotifyServerName{ServerName: c.ServerName}
 	a.WriteMsg(msg)
 	return a
 }
@@ -219,6 +447,64 @@ func (a *Agent) GetRequestCount() int {
 	return len(a.requestMap)
 }
 
+func (a *Agent) ConnectedSince() time.Time {
+	return a.connectedSince
+}
+
+// round-trip time of the last heartbeat echoed by the remote server, 0 if none yet
+func (a *Agent) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.rtt))
+}
+
+// estimated offset of the remote clock relative to the local clock
+func (a *Agent) ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.clockSkew))
+}
+
+// a heartbeat has been missed but the link is not yet considered dead
+func (a *Agent) Degraded() bool {
+	return atomic.LoadInt32(&a.degraded) == 1
+}
+
+func (a *Agent) heartBeatMsg() *S2S_HeartBeat {
+	a.heartBeatMutex.Lock()
+	defer a.heartBeatMutex.Unlock()
+
+	msg := &S2S_HeartBeat{Time: time.Now().UnixNano()}
+	if a.peerHeartBeat != 0 {
+		msg.EchoTime = a.peerHeartBeat
+		msg.EchoDelay = msg.Time - a.peerHeartBeatAt
+	}
+	return msg
+}
+
+// now is the local time msg is received at
+func (a *Agent) receiveHeartBeat(msg *S2S_HeartBeat, now int64) {
+	a.heartBeatMutex.Lock()
+	a.peerHeartBeat = msg.Time
+	a.peerHeartBeatAt = now
+	a.heartBeatMutex.Unlock()
+
+	// sent by a server which does not echo or has received nothing yet
+	if msg.EchoTime == 0 {
+		return
+	}
+	rtt := now - msg.EchoTime - msg.EchoDelay
+	atomic.StoreInt64(&a.rtt, rtt)
+	// msg.Time is about half a round trip before now
+	atomic.StoreInt64(&a.clockSkew, msg.Time-(now-rtt/2))
+}
+
+func (a *Agent) resetHeartBeat() {
+	atomic.StoreInt32(&a.heartBeatWaitTimes, 0)
+	if atomic.CompareAndSwapInt32(&a.degraded, 1, 0) {
+		a.cluster.Logger.Release("%v server is recovered", a.ServerName)
+		if a.cluster.OnAgentRecovered != nil {
+			a.cluster.OnAgentRecovered(a)
+		}
+	}
+}
+
 func (a *Agent) registerRequest(request *RequestInfo) uint32 {
 	a.Lock()
 	defer a.Unlock()
@@ -249,27 +535,35 @@ func (a *Agent) clearRequest(err error) {
 	for _, request := range a.requestMap {
 		ret := &chanrpc.RetInfo{Err: err, Cb: request.cb}
 		request.chanRet <- ret
+		if request.stream != nil {
+			request.stream.terminate(err)
+		}
 	}
 	a.requestMap = make(map[uint32]*RequestInfo)
+
+	for _, stream := range a.peerStreams {
+		stream.terminate(err)
+	}
+	a.peerStreams = make(map[uint32]*Stream)
 }
 
 func (a *Agent) Run() {
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
-			log.Debug("read message: %v", err)
+			a.cluster.Logger.Debug("read message: %v", err)
 			break
 		}
 
 		if Processor != nil {
 			msg, err := Processor.Unmarshal(a.decoder, data)
 			if err != nil {
-				log.Debug("unmarshal message error: %v", err)
+				a.cluster.Logger.Debug("unmarshal message error: %v", err)
 				break
 			}
 			err = Processor.Route(msg, a)
 			if err != nil {
-				log.Debug("route message error: %v", err)
+				a.cluster.Logger.Debug("route message error: %v", err)
 				break
 			}
 		}
@@ -277,25 +571,46 @@ func (a *Agent) Run() {
 }
 
 func (a *Agent) OnClose() {
-	removeAgent(a.ServerName)
+	a.cluster.removeAgent(a.ServerName)
 	a.clearRequest(fmt.Errorf("%v server is offline", a.ServerName))
 }
 
 func (a *Agent) WriteMsg(msg interface{}) {
+	err := a.writeMsg(msg)
+	if err != nil {
+		a.cluster.Logger.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+	}
+}
+
+// the messages share a gob stream, the peer cannot decode the messages after
+// one carrying gob types it never got, so room is reserved before encoding and
+// the link is destroyed if an encoded message cannot be written
+func (a *Agent) writeMsg(msg interface{}) error {
 	if Processor != nil {
 		a.encMutex.Lock()
 		defer a.encMutex.Unlock()
 
+		err := a.conn.ReserveWrite()
+		if err != nil {
+			return err
+		}
 		data, err := Processor.Marshal(a.encoder, msg)
 		if err != nil {
-			log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
-			return
+			// nothing is encoded for an unregistered message
+			if data != nil {
+				a.conn.Destroy()
+			} else {
+				a.conn.CancelWrite()
+			}
+			return fmt.Errorf("marshal: %v", err)
 		}
-		err = a.conn.WriteMsg(data...)
+		err = a.conn.WriteReservedMsg(data...)
 		if err != nil {
-			log.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+			a.conn.Destroy()
 		}
+		return err
 	}
+	return nil
 }
 
 func (a *Agent) LocalAddr() net.Addr {
@@ -322,18 +637,36 @@ func (a *Agent) SetUserData(data interface{}) {
 	a.userData = data
 }
 
+// the error is returned only if the request has not been answered,
+// otherwise the answer is delivered to request.chanRet as usual
+func (a *Agent) request(request *RequestInfo, id interface{}, callType uint8, args []interface{}) error {
+	requestID := a.registerRequest(request)
+	msg := &S2S_RequestMsg{RequestID: requestID, MsgID: id, CallType: callType, Args: args}
+	err := a.writeMsg(msg)
+	if err != nil && a.popRequest(requestID) != nil {
+		a.cluster.Logger.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+		return err
+	}
+	return nil
+}
+
+// the message is dropped, and logged, if the write queue stays full for PendingWriteTimeout
 func (a *Agent) Go(id interface{}, args ...interface{}) {
 	msg := &S2S_RequestMsg{MsgID: id, CallType: callNotForResult, Args: args}
-	a.WriteMsg(msg)
+	err := a.writeMsg(msg)
+	if err != nil {
+		a.cluster.Logger.Error("%v server: %v dropped: %v", a.ServerName, id, err)
+	}
 }
 
 func (a *Agent) Call0(id interface{}, args ...interface{}) error {
 	chanSyncRet := make(chan *chanrpc.RetInfo, 1)
 
 	request := &RequestInfo{chanRet: chanSyncRet}
-	requestID := a.registerRequest(request)
-	msg := &S2S_RequestMsg{RequestID: requestID, MsgID: id, CallType: callForResult, Args: args}
-	a.WriteMsg(msg)
+	err := a.request(request, id, callForResult, args)
+	if err != nil {
+		return err
+	}
 
 	ri := <-chanSyncRet
 	return ri.Err
@@ -343,9 +676,10 @@ func (a *Agent) Call1(id interface{}, args ...interface{}) (interface{}, error)
 	chanSyncRet := make(chan *chanrpc.RetInfo, 1)
 
 	request := &RequestInfo{chanRet: chanSyncRet}
-	requestID := a.registerRequest(request)
-	msg := &S2S_RequestMsg{RequestID: requestID, MsgID: id, CallType: callForResult, Args: args}
-	a.WriteMsg(msg)
+	err := a.request(request, id, callForResult, args)
+	if err != nil {
+		return nil, err
+	}
 
 	ri := <-chanSyncRet
 	return ri.Ret, ri.Err
@@ -355,9 +689,10 @@ func (a *Agent) CallN(id interface{}, args ...interface{}) ([]interface{}, error
 	chanSyncRet := make(chan *chanrpc.RetInfo, 1)
 
 	request := &RequestInfo{chanRet: chanSyncRet}
-	requestID := a.registerRequest(request)
-	msg := &S2S_RequestMsg{RequestID: requestID, MsgID: id, CallType: callForResult, Args: args}
-	a.WriteMsg(msg)
+	err := a.request(request, id, callForResult, args)
+	if err != nil {
+		return nil, err
+	}
 
 	ri := <-chanSyncRet
 	return chanrpc.Assert(ri.Ret), ri.Err
@@ -385,7 +720,20 @@ func (a *Agent) AsynCall(chanAsynRet chan *chanrpc.RetInfo, id interface{}, args
 	}
 
 	request := &RequestInfo{cb: cb, chanRet: chanAsynRet}
-	requestID := a.registerRequest(request)
-	msg := &S2S_RequestMsg{RequestID: requestID, MsgID: id, CallType: callType, Args: args}
-	a.WriteMsg(msg)
+	err := a.request(request, id, callType, args)
+	if err != nil {
+		asynRet(chanAsynRet, &chanrpc.RetInfo{Err: err, Cb: cb})
+	}
+}
+
+// the caller drains chanAsynRet on its own goroutine, a full chanAsynRet
+// must not block it
+func asynRet(chanAsynRet chan *chanrpc.RetInfo, ri *chanrpc.RetInfo) {
+	select {
+	case chanAsynRet <- ri:
+	default:
+		go func() {
+			chanAsynRet <- ri
+		}()
+	}
 }
@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/network"
+	lgob "github.com/islovingness/leaf/network/gob"
+)
+
+// clusters being closed in the background, a client takes its
+// ConnectInterval to stop
+var closing sync.WaitGroup
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	closing.Wait()
+	os.Exit(code)
+}
+
+// a cluster not yet initialized, listening on a free port
+func newTestCluster(t *testing.T, serverName string, connectTo ...*Cluster) *Cluster {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := New(nil)
+	c.ServerName = serverName
+	c.ListenAddr = addr
+	c.ConnAddrs = make(map[string]string)
+	for _, other := range connectTo {
+		c.ConnAddrs[other.ServerName] = other.ListenAddr
+	}
+	c.PendingWriteNum = 1000
+	c.HeartBeatInterval = time.Minute
+	c.HeartBeatMissTimes = 1
+	return c
+}
+
+// game1 and game2 which connects to it
+func newTestClusters(t *testing.T) (*Cluster, *Cluster) {
+	c1 := newTestCluster(t, "game1")
+	c2 := newTestCluster(t, "game2", c1)
+	return c1, c2
+}
+
+// initializes the clusters in order and waits until they are linked,
+// a cluster must connect to the ones before it only
+func startTestClusters(t *testing.T, cs ...*Cluster) {
+	for _, c := range cs {
+		c.Init()
+	}
+	t.Cleanup(func() {
+		closing.Add(1)
+		go func() {
+			defer closing.Done()
+			// a client stops once it has reconnected
+			for i := len(cs) - 1; i >= 0; i-- {
+				cs[i].close()
+			}
+		}()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, c := range cs {
+		for _, other := range cs {
+			if _, ok := c.ConnAddrs[other.ServerName]; !ok {
+				continue
+			}
+			for c.GetAgent(other.ServerName) == nil || other.GetAgent(c.ServerName) == nil {
+				if time.Now().After(deadline) {
+					t.Fatalf("%v not linked to %v", c.ServerName, other.ServerName)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// runs the calls of server until the test ends, as a module would
+func serve(t *testing.T, server *chanrpc.Server) {
+	closeSig := make(chan bool)
+	done := make(chan bool)
+	t.Cleanup(func() {
+		close(closeSig)
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-closeSig:
+				return
+			case ci := <-server.ChanCall:
+				server.Exec(ci)
+			}
+		}
+	}()
+}
+
+// an agent linked to a peer which reads nothing until told to, the messages
+// the peer decodes are sent to the returned channel
+func newStalledAgent(t *testing.T, pendingWriteNum int, writeTimeout time.Duration) (*Agent, chan<- bool, <-chan interface{}) {
+	c := newTestCluster(t, "game1")
+	chanAgent := make(chan *Agent, 1)
+	server := new(network.TCPServer)
+	server.Addr = c.ListenAddr
+	server.MaxConnNum = 1
+	server.PendingWriteNum = pendingWriteNum
+	server.WriteTimeout = writeTimeout
+	server.LenMsgLen = 4
+	server.MaxMsgLen = math.MaxUint32
+	server.NewAgent = func(conn *network.TCPConn) network.Agent {
+		a := c.newAgent(conn).(*Agent)
+		chanAgent <- a
+		return a
+	}
+	server.Start()
+
+	peer, err := net.Dial("tcp", c.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		peer.Close()
+		server.Close()
+	})
+
+	read := make(chan bool)
+	msgs := make(chan interface{}, 1024)
+	go func() {
+		defer close(msgs)
+		<-read
+		dec := lgob.NewDecoder()
+		for {
+			var msgLen [4]byte
+			if _, err := io.ReadFull(peer, msgLen[:]); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint32(msgLen[:]))
+			if _, err := io.ReadFull(peer, data); err != nil {
+				return
+			}
+			msg, err := Processor.Unmarshal(dec, data)
+			if err != nil {
+				msgs <- err
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return <-chanAgent, read, msgs
+}
+
+func TestAgentWriteTimeout(t *testing.T) {
+	a, read, msgs := newStalledAgent(t, 1, 50*time.Millisecond)
+
+	// fills the socket buffers and the write queue
+	arg := strings.Repeat("x", 1<<20)
+	for i := 0; ; i++ {
+		if i == 1024 {
+			t.Fatal("write queue never full")
+		}
+		err := a.writeMsg(&S2S_RequestMsg{MsgID: "fill", CallType: callNotForResult, Args: []interface{}{arg}})
+		if err == network.ErrWriteTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first message of a type times out, the gob types it carries are not lost
+	if err := a.writeMsg(&S2S_ResponseMsg{RequestID: 1}); err != network.ErrWriteTimeout {
+		t.Fatalf("write while stalled: %v", err)
+	}
+
+	// a failed asynchronous call does not wait for room in chanAsynRet
+	chanAsynRet := make(chan *chanrpc.RetInfo, 1)
+	chanAsynRet <- &chanrpc.RetInfo{}
+	done := make(chan bool)
+	go func() {
+		a.AsynCall(chanAsynRet, "f", func(err error) {})
+		a.cluster.AsynCall("game3", chanAsynRet, "f", func(err error) {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("AsynCall blocked on a full chanAsynRet")
+	}
+	for i := 0; i < 3; i++ {
+		<-chanAsynRet
+	}
+
+	close(read)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := a.writeMsg(&S2S_ResponseMsg{RequestID: 2})
+		if err == nil {
+			break
+		}
+		if err != network.ErrWriteTimeout || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	for msg := range msgs {
+		if err, ok := msg.(error); ok {
+			t.Fatalf("peer decode: %v", err)
+		}
+		if res, ok := msg.(*S2S_ResponseMsg); ok {
+			if res.RequestID != 2 {
+				t.Fatalf("response %v sent", res.RequestID)
+			}
+			return
+		}
+	}
+	t.Fatal("link closed")
+}
@@ -0,0 +1,159 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/console"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long Exec waits for a server to answer
+var ExecTimeout = 2 * time.Minute
+
+// the commands of other servers run one at a time, this many wait
+// and the others are refused
+const consoleQueueLen = 16
+
+type ExecResult struct {
+	ServerName string
+	Output     string
+	Err        error
+}
+
+// runs a console command line on this server and the online servers whose
+// names match pattern (see path.Match), on behalf of session
+// each server checks the permission of session against its own console,
+// granting no more than its ConsoleLevel
+// the results are sorted by server name
+// goroutine safe
+func (c *Cluster) Exec(pattern string, session *console.Session, args []string) ([]*ExecResult, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid server pattern %v", pattern)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no command")
+	}
+
+	var results []*ExecResult
+	var wg sync.WaitGroup
+	if ok, _ := path.Match(pattern, c.ServerName); ok {
+		r := &ExecResult{ServerName: c.ServerName}
+		results = append(results, r)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Output, r.Err = c.execLocal(session, args)
+		}()
+	}
+
+	c.agentsMutex.RLock()
+	for serverName, agent := range c.agents {
+		if ok, _ := path.Match(pattern, serverName); !ok {
+			continue
+		}
+		r := &ExecResult{ServerName: serverName}
+		results = append(results, r)
+		wg.Add(1)
+		go func(agent *Agent) {
+			defer wg.Done()
+			r.Output, r.Err = execRemote(agent, session, args)
+		}(agent)
+	}
+	c.agentsMutex.RUnlock()
+
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ServerName < results[j].ServerName
+	})
+	return results, nil
+}
+
+func (c *Cluster) execLocal(session *console.Session, args []string) (string, error) {
+	if c.Console == nil {
+		return "", fmt.Errorf("%v server has no console", c.ServerName)
+	}
+	// one hop only, or the command would fan out again
+	if len(args) > 1 && args[0] == "cluster" && args[1] == "exec" {
+		return "", errors.New("cluster exec cannot be forwarded")
+	}
+	return c.Console.Exec(session, args)
+}
+
+// runs the commands of other servers
+func (c *Cluster) runConsole(closeSig chan bool) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-closeSig:
+			return
+		case job := <-c.consoleJobs:
+			job()
+		}
+	}
+}
+
+func execRemote(agent *Agent, session *console.Session, args []string) (string, error) {
+	chanSyncRet := make(chan *chanrpc.RetInfo, 1)
+	request := &RequestInfo{chanRet: chanSyncRet}
+	requestID := agent.registerRequest(request)
+	msg := &S2S_ConsoleMsg{
+		RequestID: requestID,
+		Level:     session.Level,
+		Source:    session.Source,
+		Args:      args,
+	}
+	err := agent.writeMsg(msg)
+	if err != nil && agent.popRequest(requestID) != nil {
+		return "", err
+	}
+
+	t := time.NewTimer(ExecTimeout)
+	defer t.Stop()
+
+	var ri *chanrpc.RetInfo
+	select {
+	case ri = <-chanSyncRet:
+	case <-t.C:
+		if agent.popRequest(requestID) != nil {
+			return "", fmt.Errorf("%v server did not answer in %v", agent.ServerName, ExecTimeout)
+		}
+		// answered meanwhile
+		ri = <-chanSyncRet
+	}
+	if ri.Err != nil {
+		return "", ri.Err
+	}
+	output, _ := ri.Ret.(string)
+	return output, nil
+}
+
+func (c *Cluster) commandExec(session *console.Session, pattern string, args []string) string {
+	results, err := c.Exec(pattern, session, args)
+	if err != nil {
+		return err.Error()
+	}
+	if len(results) == 0 {
+		return "no server matches " + pattern
+	}
+
+	outputs := make([]string, len(results))
+	for i, r := range results {
+		if r.Err != nil {
+			outputs[i] = fmt.Sprintf("== %v == error: %v", r.ServerName, r.Err)
+		} else {
+			outputs[i] = fmt.Sprintf("== %v ==\r\n%v", r.ServerName, r.Output)
+		}
+	}
+	return strings.Join(outputs, "\r\n")
+}
+
+// goroutine safe
+func Exec(pattern string, session *console.Session, args []string) ([]*ExecResult, error) {
+	return Default.Exec(pattern, session, args)
+}
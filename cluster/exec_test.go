@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/islovingness/leaf/console"
+)
+
+// a console with a read-only "level" command answering the level of the
+// session and an admin "secret" command
+func newTestConsole(c *Cluster) {
+	c.Console = console.New()
+	c.Console.RegisterSessionFunc("level", "the level of the session", func(session *console.Session, args []string) string {
+		return session.Level.String()
+	})
+	c.Console.SetLevel("level", console.LevelReadOnly)
+	c.Console.RegisterFunc("secret", "admin only", func(args []string) string {
+		return "secret"
+	})
+}
+
+func execOne(t *testing.T, c *Cluster, serverName string, level console.Level, args ...string) (string, error) {
+	t.Helper()
+	results, err := c.Exec(serverName, &console.Session{Level: level, Source: "test"}, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ServerName != serverName {
+		t.Fatalf("results: %v", results)
+	}
+	return results[0].Output, results[0].Err
+}
+
+func TestExecLevel(t *testing.T) {
+	c1, c2 := newTestClusters(t)
+	newTestConsole(c1)
+	startTestClusters(t, c1, c2)
+
+	// read-only by default whatever the level of the sender
+	if output, err := execOne(t, c2, "game1", console.LevelAdmin, "level"); output != "read-only" || err != nil {
+		t.Fatalf("level: %v, %v", output, err)
+	}
+	if _, err := execOne(t, c2, "game1", console.LevelAdmin, "secret"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("secret: %v", err)
+	}
+}
+
+func TestExecAdmin(t *testing.T) {
+	c1, c2 := newTestClusters(t)
+	newTestConsole(c1)
+	c1.ConsoleLevel = console.LevelAdmin
+	startTestClusters(t, c1, c2)
+
+	if output, err := execOne(t, c2, "game1", console.LevelAdmin, "secret"); output != "secret" || err != nil {
+		t.Fatalf("secret as admin: %v, %v", output, err)
+	}
+	if output, err := execOne(t, c2, "game1", console.LevelReadOnly, "level"); output != "read-only" || err != nil {
+		t.Fatalf("level as read-only: %v, %v", output, err)
+	}
+}
+
+func TestExecUnnamed(t *testing.T) {
+	c1 := newTestCluster(t, "game1")
+	newTestConsole(c1)
+	c2 := newTestCluster(t, "", c1)
+	startTestClusters(t, c1, c2)
+
+	if _, err := execOne(t, c2, "game1", console.LevelReadOnly, "level"); err == nil || !strings.Contains(err.Error(), "does not know") {
+		t.Fatalf("exec from an unnamed server: %v", err)
+	}
+}
+
+func TestExecBusy(t *testing.T) {
+	c1, c2 := newTestClusters(t)
+	newTestConsole(c1)
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	c1.Console.RegisterFunc("wait", "blocks until released", func(args []string) string {
+		select {
+		case started <- true:
+		default:
+		}
+		<-release
+		return "done"
+	})
+	c1.Console.SetLevel("wait", console.LevelReadOnly)
+	startTestClusters(t, c1, c2)
+
+	n := consoleQueueLen + 4
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := execOne(t, c2, "game1", console.LevelReadOnly, "wait")
+		errs <- err
+	}()
+	<-started
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := execOne(t, c2, "game1", console.LevelReadOnly, "wait")
+			errs <- err
+		}()
+	}
+
+	// the commands beyond the queue are refused at once
+	for i := 0; i < n-1-consoleQueueLen; i++ {
+		if err := <-errs; err == nil || !strings.Contains(err.Error(), "busy") {
+			t.Fatalf("exec beyond the queue: %v", err)
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("queued exec: %v", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartBeatRTT(t *testing.T) {
+	a := &Agent{cluster: New(nil)}
+
+	// nothing echoed yet, by a server which does not echo either
+	a.receiveHeartBeat(&S2S_HeartBeat{Time: 1000}, 2000)
+	if a.RTT() != 0 || a.ClockSkew() != 0 {
+		t.Fatalf("rtt %v, skew %v without an echo", a.RTT(), a.ClockSkew())
+	}
+
+	// the peer clock is 500 ahead, sent at local 3000, received by the peer
+	// at local 3040, echoed 100 later and received back at local 3180
+	a.receiveHeartBeat(&S2S_HeartBeat{Time: 3640, EchoTime: 3000, EchoDelay: 100}, 3180)
+	if a.RTT() != 80 {
+		t.Fatalf("rtt %v", int64(a.RTT()))
+	}
+	if a.ClockSkew() != 500 {
+		t.Fatalf("skew %v", int64(a.ClockSkew()))
+	}
+
+	// the heartbeat received last is echoed
+	msg := a.heartBeatMsg()
+	if msg.EchoTime != 3640 || msg.EchoDelay != msg.Time-3180 {
+		t.Fatalf("echo %+v", msg)
+	}
+}
+
+func TestHeartBeatMiss(t *testing.T) {
+	c1, c2 := newTestClusters(t)
+	c2.HeartBeatMissTimes = 3
+	degraded := make(chan *Agent, 10)
+	recovered := make(chan *Agent, 10)
+	c2.OnAgentDegraded = func(agent *Agent) { degraded <- agent }
+	c2.OnAgentRecovered = func(agent *Agent) { recovered <- agent }
+	startTestClusters(t, c1, c2)
+	agent := c2.GetAgent("game1")
+
+	// the heartbeats are sent by hand, game1 answers only when told to
+	c2.heartBeat()
+	if agent.Degraded() || len(degraded) != 0 {
+		t.Fatal("degraded before a heartbeat is missed")
+	}
+	c2.heartBeat()
+	if !agent.Degraded() || len(degraded) != 1 || <-degraded != agent {
+		t.Fatal("not degraded once a heartbeat is missed")
+	}
+	c2.heartBeat()
+	if len(degraded) != 0 {
+		t.Fatal("degraded twice")
+	}
+
+	// a heartbeat from game1 echoing the ones of game2
+	deadline := time.Now().Add(5 * time.Second)
+	for c1.GetAgent("game2").heartBeatMsg().EchoTime == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no heartbeat received by game1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c1.heartBeat()
+	select {
+	case a := <-recovered:
+		if a != agent || agent.Degraded() {
+			t.Fatal("not recovered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not recovered")
+	}
+	if rtt := agent.RTT(); rtt <= 0 || rtt > time.Second {
+		t.Fatalf("rtt %v", rtt)
+	}
+	if skew := agent.ClockSkew(); skew < -time.Second || skew > time.Second {
+		t.Fatalf("skew %v", skew)
+	}
+
+	// closed at the third heartbeat missed in a row
+	for i := 0; i < 3; i++ {
+		c2.heartBeat()
+		if c2.GetAgent("game1") != agent {
+			t.Fatalf("closed after %v heartbeats", i+1)
+		}
+	}
+	c2.heartBeat()
+	deadline = time.Now().Add(5 * time.Second)
+	for c2.GetAgent("game1") == agent {
+		if time.Now().After(deadline) {
+			t.Fatal("not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetHeartBeat(t *testing.T) {
+	c1, c2 := newTestClusters(t)
+	c2.HeartBeatMissTimes = 100
+	degraded := make(chan *Agent, 100)
+	c2.OnAgentDegraded = func(agent *Agent) { degraded <- agent }
+	startTestClusters(t, c1, c2)
+	agent := c2.GetAgent("game1")
+
+	// game1 sends a heartbeat a minute, the ones of game2 go unanswered
+	c2.SetHeartBeatInterval(20 * time.Millisecond)
+	select {
+	case <-degraded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HeartBeatInterval not applied")
+	}
+
+	c2.SetHeartBeatMissTimes(3)
+	deadline := time.Now().Add(5 * time.Second)
+	for c2.GetAgent("game1") == agent {
+		if time.Now().After(deadline) {
+			t.Fatal("HeartBeatMissTimes not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,110 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/islovingness/leaf/console"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Member struct {
+	ServerName     string
+	RemoteAddr     string
+	ConnectedSince time.Time
+	RTT            time.Duration
+	ClockSkew      time.Duration
+	Degraded       bool
+	RequestCount   int
+}
+
+// goroutine safe
+func (c *Cluster) Members() []*Member {
+	c.agentsMutex.RLock()
+	defer c.agentsMutex.RUnlock()
+
+	members := make([]*Member, 0, len(c.agents))
+	for serverName, agent := range c.agents {
+		members = append(members, &Member{
+			ServerName:     serverName,
+			RemoteAddr:     agent.RemoteAddr().String(),
+			ConnectedSince: agent.ConnectedSince(),
+			RTT:            agent.RTT(),
+			ClockSkew:      agent.ClockSkew(),
+			Degraded:       agent.Degraded(),
+			RequestCount:   agent.GetRequestCount(),
+		})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ServerName < members[j].ServerName
+	})
+	return members
+}
+
+// goroutine safe
+func Members() []*Member {
+	return Default.Members()
+}
+
+// nil once every server of ConnAddrs is online
+// goroutine safe
+func (c *Cluster) Ready() error {
+	if c.closing {
+		return fmt.Errorf("%v server is closing", c.ServerName)
+	}
+
+	c.agentsMutex.RLock()
+	defer c.agentsMutex.RUnlock()
+
+	var offline []string
+	for serverName := range c.ConnAddrs {
+		if _, ok := c.agents[serverName]; !ok {
+			offline = append(offline, serverName)
+		}
+	}
+	if len(offline) > 0 {
+		sort.Strings(offline)
+		return fmt.Errorf("%v server is offline", strings.Join(offline, ", "))
+	}
+	return nil
+}
+
+func (c *Cluster) commandCluster(session *console.Session, args []string) string {
+	usage := "Usage: cluster [list]|exec <serverPattern> <command> [args...]"
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+		case "exec":
+			if len(args) < 3 {
+				return usage
+			}
+			return c.commandExec(session, args[1], args[2:])
+		default:
+			return usage
+		}
+	}
+
+	members := c.Members()
+	if len(members) == 0 {
+		return "no server online"
+	}
+
+	output := fmt.Sprintf("%-16v %-22v %-20v %-12v %-12v %-9v %v",
+		"NAME", "ADDR", "SINCE", "RTT", "SKEW", "STATUS", "REQUESTS")
+	for _, m := range members {
+		status := "ok"
+		if m.Degraded {
+			status = "degraded"
+		}
+		output += fmt.Sprintf("\r\n%-16v %-22v %-20v %-12v %-12v %-9v %v",
+			m.ServerName,
+			m.RemoteAddr,
+			m.ConnectedSince.Format("2006-01-02 15:04:05"),
+			m.RTT,
+			m.ClockSkew,
+			status,
+			m.RequestCount)
+	}
+	return output
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/console"
+)
+
+// waits until f is true
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: timeout", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	c1 := newTestCluster(t, "game1")
+	c1.Console = console.New()
+	c1.HeartBeatMissTimes = 3
+	c2 := newTestCluster(t, "game2", c1)
+	c2.Console = console.New()
+	release := make(chan bool)
+	c2.Console.RegisterFunc("wait", "blocks until released", func(args []string) string {
+		<-release
+		return "done"
+	})
+	c2.Console.SetLevel("wait", console.LevelReadOnly)
+	c3 := newTestCluster(t, "game3", c1, c2)
+
+	session := &console.Session{Level: console.LevelReadOnly, Source: "test"}
+	cluster := func(args ...string) string {
+		t.Helper()
+		output, err := c1.Console.Exec(session, append([]string{"cluster"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	started := time.Now()
+	startTestClusters(t, c1, c2, c3)
+	linked := time.Now()
+
+	// game2 echoes a heartbeat of game1, game3 misses one
+	c1.heartBeat()
+	waitFor(t, "heartbeat of game1", func() bool {
+		return c2.GetAgent("game1").heartBeatMsg().EchoTime != 0
+	})
+	c2.heartBeat()
+	waitFor(t, "rtt of game2", func() bool {
+		return c1.GetAgent("game2").RTT() > 0
+	})
+	c1.heartBeat()
+
+	// a request of game1 waiting for game2
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		results, err := c1.Exec("game2", session, []string{"wait"})
+		if err != nil || len(results) != 1 || results[0].Err != nil {
+			t.Errorf("wait: %v, %v", results, err)
+		}
+	}()
+	defer func() {
+		close(release)
+		<-done
+	}()
+	waitFor(t, "request of game1", func() bool {
+		return c1.GetAgent("game2").GetRequestCount() == 1
+	})
+
+	members := c1.Members()
+	if len(members) != 2 || members[0].ServerName != "game2" || members[1].ServerName != "game3" {
+		t.Fatalf("members: %+v", members)
+	}
+	for i, other := range []*Cluster{c2, c3} {
+		m := members[i]
+		if m.RemoteAddr != other.GetAgent("game1").LocalAddr().String() {
+			t.Fatalf("%v addr: %v", m.ServerName, m.RemoteAddr)
+		}
+		if m.ConnectedSince.Before(started) || m.ConnectedSince.After(linked) {
+			t.Fatalf("%v connected since %v", m.ServerName, m.ConnectedSince)
+		}
+		if m.ClockSkew < -time.Second || m.ClockSkew > time.Second {
+			t.Fatalf("%v skew: %v", m.ServerName, m.ClockSkew)
+		}
+	}
+	if m := members[0]; m.RTT <= 0 || m.RTT > time.Second || m.Degraded || m.RequestCount != 1 {
+		t.Fatalf("game2: %+v", m)
+	}
+	if m := members[1]; m.RTT != 0 || !m.Degraded || m.RequestCount != 0 {
+		t.Fatalf("game3: %+v", m)
+	}
+
+	// one line per member
+	output := cluster()
+	if list := cluster("list"); list != output {
+		t.Fatalf("cluster list: %q, cluster: %q", list, output)
+	}
+	lines := strings.Split(output, "\r\n")
+	if len(lines) != 3 || strings.Join(strings.Fields(lines[0]), " ") != "NAME ADDR SINCE RTT SKEW STATUS REQUESTS" {
+		t.Fatalf("cluster: %q", output)
+	}
+	for i, status := range []string{"ok", "degraded"} {
+		m := members[i]
+		want := []string{
+			m.ServerName,
+			m.RemoteAddr,
+			m.ConnectedSince.Format("2006-01-02 15:04:05"),
+			m.RTT.String(),
+			m.ClockSkew.String(),
+			status,
+		}
+		if line := strings.Join(strings.Fields(lines[i+1]), " "); !strings.HasPrefix(line, strings.Join(want, " ")+" ") {
+			t.Fatalf("cluster: %q, want %q", lines[i+1], want)
+		}
+	}
+	if fields := strings.Fields(lines[1]); fields[len(fields)-1] != "1" {
+		t.Fatalf("cluster: %q", lines[1])
+	}
+
+	usage := "Usage: cluster [list]|exec <serverPattern> <command> [args...]"
+	for _, args := range [][]string{{"members"}, {"exec"}, {"exec", "game2"}} {
+		if output := cluster(args...); output != usage {
+			t.Fatalf("cluster %v: %q", args, output)
+		}
+	}
+}
+
+func TestMembersOffline(t *testing.T) {
+	c := newTestCluster(t, "game1")
+	if members := c.Members(); len(members) != 0 {
+		t.Fatalf("members: %+v", members)
+	}
+	if output := c.commandCluster(&console.Session{Level: console.LevelReadOnly}, nil); output != "no server online" {
+		t.Fatalf("cluster: %q", output)
+	}
+}
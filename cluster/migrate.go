@@ -0,0 +1,265 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/islovingness/leaf/chanrpc"
+)
+
+// Codec serializes the state of one kind of entity for migration
+type Codec interface {
+	Marshal(entity interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+const maxEntityHops = 4
+
+type entityInfo struct {
+	serverName string
+	migrating  bool
+	pending    []*S2S_EntityMsg
+}
+
+// you must call the function before calling Init
+// goroutine not safe
+func (c *Cluster) RegisterCodec(kind string, codec Codec) {
+	if _, ok := c.codecs[kind]; ok {
+		panic(fmt.Sprintf("codec %v: already registered", kind))
+	}
+
+	c.codecs[kind] = codec
+}
+
+// migrated entities of the kind are handed to server by calling
+// function id kind: func(args []interface{}) error
+// args: entityID string, entity interface{}, gateServer string
+// gateServer is the server holding the client connection, to write to the client
+//
+// you must call the function before calling Init
+// goroutine not safe
+func (c *Cluster) SetMigrateRoute(kind string, server *chanrpc.Server) {
+	if _, ok := c.migrateRouteMap[kind]; ok {
+		panic(fmt.Sprintf("migrate kind %v: already set route", kind))
+	}
+
+	c.migrateRouteMap[kind] = server.Open(0)
+}
+
+// binds an entity to the server which owns it
+// goroutine safe
+func (c *Cluster) SetEntityServer(entityID string, serverName string) {
+	c.entitiesMutex.Lock()
+	defer c.entitiesMutex.Unlock()
+
+	e, ok := c.entities[entityID]
+	if !ok {
+		e = new(entityInfo)
+		c.entities[entityID] = e
+	}
+	e.serverName = serverName
+}
+
+// goroutine safe
+func (c *Cluster) GetEntityServer(entityID string) string {
+	c.entitiesMutex.Lock()
+	defer c.entitiesMutex.Unlock()
+
+	e, ok := c.entities[entityID]
+	if ok {
+		return e.serverName
+	} else {
+		return ""
+	}
+}
+
+// goroutine safe
+func (c *Cluster) RemoveEntity(entityID string) {
+	c.entitiesMutex.Lock()
+	defer c.entitiesMutex.Unlock()
+
+	delete(c.entities, entityID)
+}
+
+// delivers the message to the server owning the entity, the handler set by
+// SetRoute(id, ...) is called with args: entityID, args...
+// messages sent while the entity is migrating are delivered once it is done
+// goroutine safe
+func (c *Cluster) SendToEntity(entityID string, id interface{}, args ...interface{}) {
+	c.dispatchEntityMsg(&S2S_EntityMsg{EntityID: entityID, MsgID: id, Args: args})
+}
+
+func (c *Cluster) dispatchEntityMsg(msg *S2S_EntityMsg) {
+	c.entitiesMutex.Lock()
+	e, ok := c.entities[msg.EntityID]
+	if !ok {
+		c.entitiesMutex.Unlock()
+		c.Logger.Error("entity %v is not exist", msg.EntityID)
+		return
+	}
+	if e.migrating {
+		e.pending = append(e.pending, msg)
+		c.entitiesMutex.Unlock()
+		return
+	}
+	serverName := e.serverName
+	c.entitiesMutex.Unlock()
+
+	c.sendEntityMsg(serverName, msg)
+}
+
+func (c *Cluster) sendEntityMsg(serverName string, msg *S2S_EntityMsg) {
+	if serverName == c.ServerName {
+		c.deliverEntityMsg(msg)
+		return
+	}
+
+	agent := c.GetAgent(serverName)
+	if agent != nil {
+		agent.WriteMsg(msg)
+	} else {
+		c.Logger.Error("%v server is offline", serverName)
+	}
+}
+
+func (c *Cluster) deliverEntityMsg(msg *S2S_EntityMsg) {
+	client, ok := c.routeMap[msg.MsgID]
+	if !ok {
+		c.Logger.Error("%v msg is not set route", msg.MsgID)
+		return
+	}
+
+	args := append([]interface{}{msg.EntityID}, msg.Args...)
+	args = append(args, nil)
+	client.RpcCall(msg.MsgID, args...)
+}
+
+// moves a local entity to serverName, which gets it from its migrate route
+// along with gateServer, the server holding the client connection
+//
+// afterwards the servers knowing the entity route it to serverName, so does
+// gateServer even if it did not know the entity: the client messages it
+// sends with SendToEntity reach the new owner, the client connection
+// itself stays where it is
+//
+// it blocks until serverName accepts or rejects the entity, messages for
+// the entity are buffered meanwhile and redelivered to whichever server
+// owns it afterwards
+// goroutine safe
+func (c *Cluster) Migrate(kind string, entityID string, entity interface{}, gateServer string, serverName string) error {
+	codec, ok := c.codecs[kind]
+	if !ok {
+		return fmt.Errorf("codec %v: not registered", kind)
+	}
+	if serverName == c.ServerName {
+		return fmt.Errorf("entity %v: already on %v server", entityID, serverName)
+	}
+	agent := c.GetAgent(serverName)
+	if agent == nil {
+		return fmt.Errorf("%v server is offline", serverName)
+	}
+
+	c.entitiesMutex.Lock()
+	e, ok := c.entities[entityID]
+	if !ok || e.serverName != c.ServerName {
+		c.entitiesMutex.Unlock()
+		return fmt.Errorf("entity %v: not owned by %v server", entityID, c.ServerName)
+	}
+	if e.migrating {
+		c.entitiesMutex.Unlock()
+		return fmt.Errorf("entity %v: already migrating", entityID)
+	}
+	e.migrating = true
+	c.entitiesMutex.Unlock()
+
+	err := migrate(agent, codec, kind, entityID, entity, gateServer)
+	if err != nil {
+		serverName = c.ServerName
+	} else {
+		c.Logger.Release("entity %v migrated to %v server", entityID, serverName)
+		c.SetEntityServer(entityID, serverName)
+
+		msg := &S2S_EntityRoute{EntityID: entityID, ServerName: serverName, GateServer: gateServer}
+		for _, agent := range c.getAgents() {
+			agent.WriteMsg(msg)
+		}
+	}
+
+	// keep buffering until the backlog is flushed so that order is preserved
+	c.entitiesMutex.Lock()
+	for len(e.pending) > 0 {
+		pending := e.pending
+		e.pending = nil
+		c.entitiesMutex.Unlock()
+
+		for _, msg := range pending {
+			c.sendEntityMsg(serverName, msg)
+		}
+
+		c.entitiesMutex.Lock()
+	}
+	e.migrating = false
+	c.entitiesMutex.Unlock()
+
+	return err
+}
+
+func migrate(agent *Agent, codec Codec, kind string, entityID string, entity interface{}, gateServer string) error {
+	data, err := codec.Marshal(entity)
+	if err != nil {
+		return err
+	}
+
+	chanSyncRet := make(chan *chanrpc.RetInfo, 1)
+	request := &RequestInfo{chanRet: chanSyncRet}
+	requestID := agent.registerRequest(request)
+	msg := &S2S_MigrateMsg{
+		RequestID:  requestID,
+		Kind:       kind,
+		EntityID:   entityID,
+		Data:       data,
+		GateServer: gateServer,
+	}
+	err = agent.writeMsg(msg)
+	if err != nil && agent.popRequest(requestID) != nil {
+		return err
+	}
+
+	ri := <-chanSyncRet
+	return ri.Err
+}
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func RegisterCodec(kind string, codec Codec) {
+	Default.RegisterCodec(kind, codec)
+}
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func SetMigrateRoute(kind string, server *chanrpc.Server) {
+	Default.SetMigrateRoute(kind, server)
+}
+
+// goroutine safe
+func SetEntityServer(entityID string, serverName string) {
+	Default.SetEntityServer(entityID, serverName)
+}
+
+// goroutine safe
+func GetEntityServer(entityID string) string {
+	return Default.GetEntityServer(entityID)
+}
+
+// goroutine safe
+func RemoveEntity(entityID string) {
+	Default.RemoveEntity(entityID)
+}
+
+// goroutine safe
+func SendToEntity(entityID string, id interface{}, args ...interface{}) {
+	Default.SendToEntity(entityID, id, args...)
+}
+
+// goroutine safe
+func Migrate(kind string, entityID string, entity interface{}, gateServer string, serverName string) error {
+	return Default.Migrate(kind, entityID, entity, gateServer, serverName)
+}
@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+)
+
+type testPlayer struct {
+	Name  string
+	Level int
+}
+
+type testPlayerCodec struct{}
+
+func (testPlayerCodec) Marshal(entity interface{}) ([]byte, error) {
+	return json.Marshal(entity)
+}
+
+func (testPlayerCodec) Unmarshal(data []byte) (interface{}, error) {
+	p := new(testPlayer)
+	err := json.Unmarshal(data, p)
+	return p, err
+}
+
+type testHit struct {
+	serverName string
+	n          int
+}
+
+type testGame struct {
+	*Cluster
+	server   *chanrpc.Server
+	players  chan *testPlayer
+	gates    chan string
+	accepted chan bool
+}
+
+func newTestGame(t *testing.T, c *Cluster, hits chan *testHit) *testGame {
+	g := &testGame{
+		Cluster:  c,
+		server:   chanrpc.NewServer(10),
+		players:  make(chan *testPlayer, 10),
+		gates:    make(chan string, 10),
+		accepted: make(chan bool, 10),
+	}
+	g.server.Register("hit", func(args []interface{}) {
+		hits <- &testHit{serverName: c.ServerName, n: args[1].(int)}
+	})
+	g.server.Register("player", func(args []interface{}) error {
+		g.players <- args[1].(*testPlayer)
+		g.gates <- args[2].(string)
+		<-g.accepted
+		return nil
+	})
+	c.SetRoute("hit", g.server)
+	c.RegisterCodec("player", testPlayerCodec{})
+	c.SetMigrateRoute("player", g.server)
+	serve(t, g.server)
+	return g
+}
+
+func expectHit(t *testing.T, hits chan *testHit, serverName string, n int) {
+	t.Helper()
+	select {
+	case hit := <-hits:
+		if hit.serverName != serverName || hit.n != n {
+			t.Fatalf("hit %v on %v, want %v on %v", hit.n, hit.serverName, n, serverName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hit %v not delivered", n)
+	}
+}
+
+func expectRoute(t *testing.T, c *Cluster, entityID string, serverName string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.GetEntityServer(entityID) != serverName {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v routes %v to %q, want %v", c.ServerName, entityID, c.GetEntityServer(entityID), serverName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMigrateRoundTrip(t *testing.T) {
+	hits := make(chan *testHit, 10)
+	gate := newTestCluster(t, "gate1")
+	game1 := newTestGame(t, newTestCluster(t, "game1", gate), hits)
+	game2 := newTestGame(t, newTestCluster(t, "game2", gate, game1.Cluster), hits)
+	startTestClusters(t, gate, game1.Cluster, game2.Cluster)
+
+	gate.SetEntityServer("p1", "game1")
+	game1.SetEntityServer("p1", "game1")
+	gate.SendToEntity("p1", "hit", 1)
+	expectHit(t, hits, "game1", 1)
+
+	// the messages sent meanwhile wait for the end of the migration
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- game1.Migrate("player", "p1", &testPlayer{Name: "alice", Level: 7}, "gate1", "game2")
+	}()
+	if p := <-game2.players; p.Name != "alice" || p.Level != 7 {
+		t.Fatalf("migrated player: %+v", p)
+	}
+	if gateServer := <-game2.gates; gateServer != "gate1" {
+		t.Fatalf("gate server: %v", gateServer)
+	}
+	game1.SendToEntity("p1", "hit", 2)
+	game2.accepted <- true
+	if err := <-chanErr; err != nil {
+		t.Fatal(err)
+	}
+	expectHit(t, hits, "game2", 2)
+
+	expectRoute(t, gate, "p1", "game2")
+	gate.SendToEntity("p1", "hit", 3)
+	expectHit(t, hits, "game2", 3)
+	game1.SendToEntity("p1", "hit", 4)
+	expectHit(t, hits, "game2", 4)
+
+	// the gate server is bound again even if it has forgotten the entity
+	gate.RemoveEntity("p1")
+	go func() {
+		chanErr <- game2.Migrate("player", "p1", &testPlayer{Name: "alice", Level: 8}, "gate1", "game1")
+	}()
+	if p := <-game1.players; p.Level != 8 {
+		t.Fatalf("migrated player: %+v", p)
+	}
+	<-game1.gates
+	game1.accepted <- true
+	if err := <-chanErr; err != nil {
+		t.Fatal(err)
+	}
+
+	expectRoute(t, gate, "p1", "game1")
+	expectRoute(t, game2.Cluster, "p1", "game1")
+	gate.SendToEntity("p1", "hit", 5)
+	expectHit(t, hits, "game1", 5)
+}
+
+func TestMigrateErrors(t *testing.T) {
+	hits := make(chan *testHit, 10)
+	game1 := newTestGame(t, newTestCluster(t, "game1"), hits)
+	game2 := newTestGame(t, newTestCluster(t, "game2", game1.Cluster), hits)
+	startTestClusters(t, game1.Cluster, game2.Cluster)
+
+	if err := game1.Migrate("player", "p1", &testPlayer{}, "", "game2"); err == nil {
+		t.Fatal("migrated an entity not owned")
+	}
+	game1.SetEntityServer("p1", "game1")
+	if err := game1.Migrate("npc", "p1", &testPlayer{}, "", "game2"); err == nil {
+		t.Fatal("migrated without a codec")
+	}
+	if err := game1.Migrate("player", "p1", &testPlayer{}, "", "game3"); err == nil {
+		t.Fatal("migrated to an offline server")
+	}
+	if server := game1.GetEntityServer("p1"); server != "game1" {
+		t.Fatalf("p1 moved to %v", server)
+	}
+}
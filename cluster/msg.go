@@ -5,10 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/islovingness/leaf/chanrpc"
-	"github.com/islovingness/leaf/log"
-	"sync/atomic"
+	"github.com/islovingness/leaf/console"
 	"encoding/gob"
-	"github.com/islovingness/leaf/conf"
+	"time"
 )
 
 var (
@@ -18,6 +17,8 @@ var (
 const (
 	callNotForResult = iota
 	callForResult
+	callServerStream
+	callClientStream
 )
 
 func init() {
@@ -28,7 +29,14 @@ type S2S_NotifyServerName struct {
 	ServerName string
 }
 
+// the round trip is measured from the heartbeats each server sends anyway,
+// gob ignores the fields a server without them does not know
 type S2S_HeartBeat struct {
+	Time int64
+	// the Time of the last heartbeat received, 0: none
+	EchoTime int64
+	// nanoseconds from receiving that heartbeat to sending this one
+	EchoDelay int64
 }
 
 type S2S_RequestMsg struct {
@@ -44,35 +52,82 @@ type S2S_ResponseMsg struct {
 	Err       string
 }
 
+type S2S_StreamMsg struct {
+	RequestID  uint32
+	FromCaller bool
+	Data       interface{}
+	End        bool
+	Err        string
+}
+
+type S2S_StreamCtrl struct {
+	RequestID  uint32
+	FromCaller bool
+	Credit     int32
+	Cancel     bool
+}
+
+type S2S_EntityMsg struct {
+	EntityID string
+	MsgID    interface{}
+	Args     []interface{}
+	Hops     uint8
+}
+
+type S2S_EntityRoute struct {
+	EntityID   string
+	ServerName string
+	// binds the entity there even if it is not known yet
+	GateServer string
+}
+
+type S2S_MigrateMsg struct {
+	RequestID  uint32
+	Kind       string
+	EntityID   string
+	Data       []byte
+	GateServer string
+}
+
+type S2S_ConsoleMsg struct {
+	RequestID uint32
+	Level     console.Level
+	Source    string
+	Args      []string
+}
+
 func handleNotifyServerName(args []interface{}) {
 	msg := args[0].(*S2S_NotifyServerName)
 	agent := args[1].(*Agent)
-	addAgent(msg.ServerName, agent)
+	agent.cluster.addAgent(msg.ServerName, agent)
 }
 
 func handleHeartBeat(args []interface{}) {
+	msg := args[0].(*S2S_HeartBeat)
 	agent := args[1].(*Agent)
-	atomic.StoreInt32(&agent.heartBeatWaitTimes, 0)
+	agent.receiveHeartBeat(msg, time.Now().UnixNano())
+	agent.resetHeartBeat()
 }
 
 func handleRequestMsg(args []interface{}) {
 	recvMsg := args[0].(*S2S_RequestMsg)
 	agent := args[1].(*Agent)
+	c := agent.cluster
 
 	sendMsg := &S2S_ResponseMsg{RequestID: recvMsg.RequestID}
-	if closing && recvMsg.CallType == callForResult {
-		sendMsg.Err = fmt.Sprintf("%v server is closing", conf.ServerName)
+	if c.closing && recvMsg.CallType != callNotForResult {
+		sendMsg.Err = fmt.Sprintf("%v server is closing", c.ServerName)
 		agent.WriteMsg(sendMsg)
 		return
 	}
 
 	msgID := recvMsg.MsgID
-	client, ok := routeMap[msgID]
+	client, ok := c.routeMap[msgID]
 	if !ok {
 		err := fmt.Sprintf("%v msg is not set route", msgID)
-		log.Error(err)
+		c.Logger.Error(err)
 
-		if recvMsg.CallType == callForResult {
+		if recvMsg.CallType != callNotForResult {
 			sendMsg.Err = err
 			agent.WriteMsg(sendMsg)
 		}
@@ -83,6 +138,25 @@ func handleRequestMsg(args []interface{}) {
 	if recvMsg.CallType == callNotForResult {
 		args = append(args, nil)
 		client.RpcCall(msgID, args...)
+	} else if recvMsg.CallType == callServerStream || recvMsg.CallType == callClientStream {
+		stream := newStream(agent, recvMsg.CallType, false)
+		stream.requestID = recvMsg.RequestID
+		agent.addPeerStream(stream)
+
+		// the handler finishes the stream by itself unless it fails
+		closeStreamFunc := func(ret *chanrpc.RetInfo) {
+			if ret.Err == nil {
+				return
+			}
+			if stream.callType == callServerStream {
+				stream.CloseSend(ret.Err)
+			} else {
+				stream.SendAndClose(nil, ret.Err)
+			}
+		}
+
+		args = append(args, stream, closeStreamFunc)
+		client.RpcCall(msgID, args...)
 	} else {
 		sendMsgFunc := func(ret *chanrpc.RetInfo) {
 			sendMsg.Ret = ret.Ret
@@ -103,7 +177,7 @@ func handleResponseMsg(args []interface{}) {
 
 	request := agent.popRequest(msg.RequestID)
 	if request == nil {
-		log.Error("%v: request id %v is not exist", agent.ServerName, msg.RequestID)
+		agent.cluster.Logger.Error("%v: request id %v is not exist", agent.ServerName, msg.RequestID)
 		return
 	}
 
@@ -112,6 +186,162 @@ func handleResponseMsg(args []interface{}) {
 		ret.Err = errors.New(msg.Err)
 	}
 	request.chanRet <- ret
+	if request.stream != nil {
+		// a client stream may be answered before the caller is done sending
+		if ret.Err != nil {
+			request.stream.terminate(ret.Err)
+		} else {
+			request.stream.terminate(errStreamClosed)
+		}
+	}
+}
+
+func handleStreamMsg(args []interface{}) {
+	msg := args[0].(*S2S_StreamMsg)
+	agent := args[1].(*Agent)
+
+	stream := agent.getStream(msg.RequestID, msg.FromCaller)
+	if stream == nil {
+		agent.cluster.Logger.Debug("%v: stream %v is not exist", agent.ServerName, msg.RequestID)
+		return
+	}
+	stream.push(msg)
+}
+
+func handleStreamCtrl(args []interface{}) {
+	msg := args[0].(*S2S_StreamCtrl)
+	agent := args[1].(*Agent)
+
+	// credits may arrive after the stream is finished
+	stream := agent.getStream(msg.RequestID, msg.FromCaller)
+	if stream == nil {
+		return
+	}
+	if msg.Cancel {
+		stream.terminate(errors.New("stream canceled by peer"))
+		agent.removeStream(stream)
+		return
+	}
+	stream.grant(msg.Credit)
+}
+
+func handleEntityMsg(args []interface{}) {
+	msg := args[0].(*S2S_EntityMsg)
+	agent := args[1].(*Agent)
+
+	// routes may be stale while an entity moves, never forward forever
+	msg.Hops++
+	if msg.Hops > maxEntityHops {
+		agent.cluster.Logger.Error("entity %v: too many hops", msg.EntityID)
+		return
+	}
+	agent.cluster.dispatchEntityMsg(msg)
+}
+
+func handleEntityRoute(args []interface{}) {
+	msg := args[0].(*S2S_EntityRoute)
+	c := args[1].(*Agent).cluster
+
+	c.entitiesMutex.Lock()
+	defer c.entitiesMutex.Unlock()
+
+	e, ok := c.entities[msg.EntityID]
+	if !ok {
+		// the gate server must reach the entity wherever it goes
+		if msg.GateServer != c.ServerName {
+			return
+		}
+		e = new(entityInfo)
+		c.entities[msg.EntityID] = e
+	}
+	e.serverName = msg.ServerName
+}
+
+func handleMigrateMsg(args []interface{}) {
+	recvMsg := args[0].(*S2S_MigrateMsg)
+	agent := args[1].(*Agent)
+	c := agent.cluster
+
+	sendMsg := &S2S_ResponseMsg{RequestID: recvMsg.RequestID}
+	if c.closing {
+		sendMsg.Err = fmt.Sprintf("%v server is closing", c.ServerName)
+		agent.WriteMsg(sendMsg)
+		return
+	}
+
+	codec, ok := c.codecs[recvMsg.Kind]
+	client, ok2 := c.migrateRouteMap[recvMsg.Kind]
+	if !ok || !ok2 {
+		sendMsg.Err = fmt.Sprintf("migrate kind %v is not supported", recvMsg.Kind)
+		c.Logger.Error(sendMsg.Err)
+		agent.WriteMsg(sendMsg)
+		return
+	}
+
+	entity, err := codec.Unmarshal(recvMsg.Data)
+	if err != nil {
+		sendMsg.Err = err.Error()
+		agent.WriteMsg(sendMsg)
+		return
+	}
+
+	acceptFunc := func(ret *chanrpc.RetInfo) {
+		if ret.Err != nil {
+			sendMsg.Err = ret.Err.Error()
+		} else {
+			c.SetEntityServer(recvMsg.EntityID, c.ServerName)
+			// the gate server may not be linked to the previous owner
+			if gate := c.GetAgent(recvMsg.GateServer); gate != nil && gate != agent {
+				gate.WriteMsg(&S2S_EntityRoute{
+					EntityID:   recvMsg.EntityID,
+					ServerName: c.ServerName,
+					GateServer: recvMsg.GateServer,
+				})
+			}
+		}
+		agent.WriteMsg(sendMsg)
+	}
+	client.RpcCall(recvMsg.Kind, recvMsg.EntityID, entity, recvMsg.GateServer, acceptFunc)
+}
+
+func handleConsoleMsg(args []interface{}) {
+	recvMsg := args[0].(*S2S_ConsoleMsg)
+	agent := args[1].(*Agent)
+	c := agent.cluster
+
+	sendMsg := &S2S_ResponseMsg{RequestID: recvMsg.RequestID}
+	if agent.ServerName == "" {
+		sendMsg.Err = fmt.Sprintf("%v server does not know the sender", c.ServerName)
+		agent.WriteMsg(sendMsg)
+		return
+	}
+
+	// the level of the sender is not trusted
+	level := recvMsg.Level
+	if level > c.ConsoleLevel {
+		level = c.ConsoleLevel
+	}
+	session := &console.Session{
+		Level:  level,
+		Source: fmt.Sprintf("cluster %v (%v)", agent.ServerName, recvMsg.Source),
+	}
+
+	// a command may take a while, e.g. cpuprof 30s
+	job := func() {
+		output, err := c.execLocal(session, recvMsg.Args)
+		if err != nil {
+			sendMsg.Err = err.Error()
+		} else {
+			sendMsg.Ret = output
+		}
+		agent.WriteMsg(sendMsg)
+	}
+	select {
+	case c.consoleJobs <- job:
+	default:
+		sendMsg.Err = fmt.Sprintf("%v server console is busy", c.ServerName)
+		agent.WriteMsg(sendMsg)
+	}
 }
 
 func init() {
@@ -119,9 +349,21 @@ func init() {
 	Processor.Register(&S2S_HeartBeat{})
 	Processor.Register(&S2S_RequestMsg{})
 	Processor.Register(&S2S_ResponseMsg{})
+	Processor.Register(&S2S_StreamMsg{})
+	Processor.Register(&S2S_StreamCtrl{})
+	Processor.Register(&S2S_EntityMsg{})
+	Processor.Register(&S2S_EntityRoute{})
+	Processor.Register(&S2S_MigrateMsg{})
+	Processor.Register(&S2S_ConsoleMsg{})
 
 	Processor.SetHandler(&S2S_NotifyServerName{}, handleNotifyServerName)
 	Processor.SetHandler(&S2S_HeartBeat{}, handleHeartBeat)
 	Processor.SetHandler(&S2S_RequestMsg{}, handleRequestMsg)
 	Processor.SetHandler(&S2S_ResponseMsg{}, handleResponseMsg)
+	Processor.SetHandler(&S2S_StreamMsg{}, handleStreamMsg)
+	Processor.SetHandler(&S2S_StreamCtrl{}, handleStreamCtrl)
+	Processor.SetHandler(&S2S_EntityMsg{}, handleEntityMsg)
+	Processor.SetHandler(&S2S_EntityRoute{}, handleEntityRoute)
+	Processor.SetHandler(&S2S_MigrateMsg{}, handleMigrateMsg)
+	Processor.SetHandler(&S2S_ConsoleMsg{}, handleConsoleMsg)
 }
@@ -3,44 +3,40 @@ package cluster
 import (
 	"fmt"
 	"github.com/islovingness/leaf/chanrpc"
-	"github.com/islovingness/leaf/log"
 	"regexp"
 )
 
-var (
-	routeMap = map[interface{}]*chanrpc.Client{}
-)
-
 type RequestInfo struct {
 	cb      interface{}
 	chanRet chan *chanrpc.RetInfo
+	stream  *Stream
 }
 
-func GetRequestCount() int {
-	agentsMutex.RLock()
-	defer agentsMutex.RUnlock()
+func (c *Cluster) GetRequestCount() int {
+	c.agentsMutex.RLock()
+	defer c.agentsMutex.RUnlock()
 
 	var count int = 0
-	for _, agent := range agents {
+	for _, agent := range c.agents {
 		count += agent.GetRequestCount()
 	}
 	return count
 }
 
-func SetRoute(id interface{}, server *chanrpc.Server) {
-	_, ok := routeMap[id]
+func (c *Cluster) SetRoute(id interface{}, server *chanrpc.Server) {
+	_, ok := c.routeMap[id]
 	if ok {
 		panic(fmt.Sprintf("function id %v: already set route", id))
 	}
 
-	routeMap[id] = server.Open(0)
+	c.routeMap[id] = server.Open(0)
 }
 
-func GetAgent(serverName string) *Agent {
-	agentsMutex.RLock()
-	defer agentsMutex.RUnlock()
+func (c *Cluster) GetAgent(serverName string) *Agent {
+	c.agentsMutex.RLock()
+	defer c.agentsMutex.RUnlock()
 
-	agent, ok := agents[serverName]
+	agent, ok := c.agents[serverName]
 	if ok {
 		return agent
 	} else {
@@ -48,29 +44,26 @@ func GetAgent(serverName string) *Agent {
 	}
 }
 
-func Broadcast(serverType string, id interface{}, args ...interface{}) {
-	agentsMutex.RLock()
-	defer agentsMutex.RUnlock()
-
+func (c *Cluster) Broadcast(serverType string, id interface{}, args ...interface{}) {
 	r, _ := regexp.Compile(fmt.Sprintf("%s[0-9]+$", serverType))
-	for agentName, agent := range agents {
-		if r.MatchString(agentName) {
+	for _, agent := range c.getAgents() {
+		if r.MatchString(agent.ServerName) {
 			agent.Go(id, args...)
 		}
 	}
 }
 
-func Go(serverName string, id interface{}, args ...interface{}) {
-	agent := GetAgent(serverName)
+func (c *Cluster) Go(serverName string, id interface{}, args ...interface{}) {
+	agent := c.GetAgent(serverName)
 	if agent != nil {
 		agent.Go(id, args...)
 	}else {
-		log.Error("%v server is offline", serverName)
+		c.Logger.Error("%v server is offline", serverName)
 	}
 }
 
-func Call0(serverName string, id interface{}, args ...interface{}) error {
-	agent := GetAgent(serverName)
+func (c *Cluster) Call0(serverName string, id interface{}, args ...interface{}) error {
+	agent := c.GetAgent(serverName)
 	if agent != nil {
 		return agent.Call0(id, args...)
 	} else {
@@ -78,8 +71,8 @@ func Call0(serverName string, id interface{}, args ...interface{}) error {
 	}
 }
 
-func Call1(serverName string, id interface{}, args ...interface{}) (interface{}, error) {
-	agent := GetAgent(serverName)
+func (c *Cluster) Call1(serverName string, id interface{}, args ...interface{}) (interface{}, error) {
+	agent := c.GetAgent(serverName)
 	if agent != nil {
 		return agent.Call1(id, args...)
 	} else {
@@ -87,8 +80,8 @@ func Call1(serverName string, id interface{}, args ...interface{}) (interface{},
 	}
 }
 
-func CallN(serverName string, id interface{}, args ...interface{}) ([]interface{}, error) {
-	agent := GetAgent(serverName)
+func (c *Cluster) CallN(serverName string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	agent := c.GetAgent(serverName)
 	if agent != nil {
 		return agent.CallN(id, args...)
 	} else {
@@ -96,14 +89,76 @@ func CallN(serverName string, id interface{}, args ...interface{}) ([]interface{
 	}
 }
 
-func AsynCall(serverName string, chanAsynRet chan *chanrpc.RetInfo, id interface{}, args ...interface{}) {
-	agent := GetAgent(serverName)
+func (c *Cluster) AsynCall(serverName string, chanAsynRet chan *chanrpc.RetInfo, id interface{}, args ...interface{}) {
+	agent := c.GetAgent(serverName)
 	if agent != nil {
 		agent.AsynCall(chanAsynRet, id, args...)
 	} else {
-		chanAsynRet <- &chanrpc.RetInfo{
+		asynRet(chanAsynRet, &chanrpc.RetInfo{
 			Err: fmt.Errorf("%v server is offline", serverName),
 			Cb:  args[len(args)-1],
-		}
+		})
+	}
+}
+
+func (c *Cluster) ServerStream(serverName string, id interface{}, args ...interface{}) (*Stream, error) {
+	agent := c.GetAgent(serverName)
+	if agent != nil {
+		return agent.ServerStream(id, args...)
+	} else {
+		return nil, fmt.Errorf("%v server is offline", serverName)
+	}
+}
+
+func (c *Cluster) ClientStream(serverName string, id interface{}, args ...interface{}) (*Stream, error) {
+	agent := c.GetAgent(serverName)
+	if agent != nil {
+		return agent.ClientStream(id, args...)
+	} else {
+		return nil, fmt.Errorf("%v server is offline", serverName)
 	}
 }
+
+func GetRequestCount() int {
+	return Default.GetRequestCount()
+}
+
+func SetRoute(id interface{}, server *chanrpc.Server) {
+	Default.SetRoute(id, server)
+}
+
+func GetAgent(serverName string) *Agent {
+	return Default.GetAgent(serverName)
+}
+
+func Broadcast(serverType string, id interface{}, args ...interface{}) {
+	Default.Broadcast(serverType, id, args...)
+}
+
+func Go(serverName string, id interface{}, args ...interface{}) {
+	Default.Go(serverName, id, args...)
+}
+
+func Call0(serverName string, id interface{}, args ...interface{}) error {
+	return Default.Call0(serverName, id, args...)
+}
+
+func Call1(serverName string, id interface{}, args ...interface{}) (interface{}, error) {
+	return Default.Call1(serverName, id, args...)
+}
+
+func CallN(serverName string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return Default.CallN(serverName, id, args...)
+}
+
+func AsynCall(serverName string, chanAsynRet chan *chanrpc.RetInfo, id interface{}, args ...interface{}) {
+	Default.AsynCall(serverName, chanAsynRet, id, args...)
+}
+
+func ServerStream(serverName string, id interface{}, args ...interface{}) (*Stream, error) {
+	return Default.ServerStream(serverName, id, args...)
+}
+
+func ClientStream(serverName string, id interface{}, args ...interface{}) (*Stream, error) {
+	return Default.ClientStream(serverName, id, args...)
+}
@@ -0,0 +1,359 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/islovingness/leaf/chanrpc"
+	"io"
+	"sync"
+)
+
+// number of messages a sender may have in flight before the receiver grants more
+const streamWindow = 64
+
+var (
+	errStreamCanceled   = errors.New("stream canceled")
+	errStreamSendClosed = errors.New("stream send closed")
+	errStreamClosed     = errors.New("stream closed by peer")
+	errStreamNoCredit   = errors.New("stream window full")
+)
+
+// one Stream is a flow-controlled sequence of messages bound to one request
+//
+// server streaming: the caller Recv()s, the handler Send()s and CloseSend()s
+// client streaming: the caller Send()s and CloseAndRecv()s, the handler Recv()s and SendAndClose()s
+//
+// Send, Recv and CloseAndRecv block until the peer catches up, they must not
+// be called on a module goroutine: the handler gets the stream on its module
+// goroutine and starts a goroutine of its own to run it, or uses TrySend
+// a failed write aborts the stream on both sides
+type Stream struct {
+	agent     *Agent
+	requestID uint32
+	callType  uint8
+	caller    bool
+
+	chanData   chan interface{}
+	chanRet    chan *chanrpc.RetInfo
+	recvErr    error
+	recvClosed bool
+
+	sync.Mutex
+	cond       *sync.Cond
+	credit     int
+	consumed   int
+	sendClosed bool
+	err        error
+	done       chan struct{}
+}
+
+func newStream(agent *Agent, callType uint8, caller bool) *Stream {
+	s := new(Stream)
+	s.agent = agent
+	s.callType = callType
+	s.caller = caller
+	s.chanData = make(chan interface{}, streamWindow)
+	s.chanRet = make(chan *chanrpc.RetInfo, 1)
+	s.cond = sync.NewCond(&s.Mutex)
+	s.credit = streamWindow
+	s.done = make(chan struct{})
+	return s
+}
+
+func (a *Agent) openStream(callType uint8, id interface{}, args []interface{}) (*Stream, error) {
+	s := newStream(a, callType, true)
+
+	request := &RequestInfo{chanRet: s.chanRet, stream: s}
+	s.requestID = a.registerRequest(request)
+	msg := &S2S_RequestMsg{RequestID: s.requestID, MsgID: id, CallType: callType, Args: args}
+	err := a.writeMsg(msg)
+	if err != nil && a.popRequest(s.requestID) != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// goroutine safe
+func (a *Agent) ServerStream(id interface{}, args ...interface{}) (*Stream, error) {
+	return a.openStream(callServerStream, id, args)
+}
+
+// goroutine safe
+func (a *Agent) ClientStream(id interface{}, args ...interface{}) (*Stream, error) {
+	return a.openStream(callClientStream, id, args)
+}
+
+func (a *Agent) addPeerStream(s *Stream) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.peerStreams[s.requestID] = s
+}
+
+func (a *Agent) getStream(requestID uint32, fromCaller bool) *Stream {
+	a.Lock()
+	defer a.Unlock()
+
+	if fromCaller {
+		return a.peerStreams[requestID]
+	}
+	request, ok := a.requestMap[requestID]
+	if !ok {
+		return nil
+	}
+	return request.stream
+}
+
+func (a *Agent) removeStream(s *Stream) {
+	if s.caller {
+		a.popRequest(s.requestID)
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	delete(a.peerStreams, s.requestID)
+}
+
+// blocks while the receiver has not granted credit
+// goroutine safe
+func (s *Stream) Send(data interface{}) error {
+	return s.send(data, true)
+}
+
+// like Send but fails at once while the receiver has not granted credit,
+// for the module goroutine, Writable tells when to try again
+// goroutine safe
+func (s *Stream) TrySend(data interface{}) error {
+	return s.send(data, false)
+}
+
+// the number of messages TrySend may send without failing
+// goroutine safe
+func (s *Stream) Writable() int {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil || s.sendClosed {
+		return 0
+	}
+	return s.credit
+}
+
+func (s *Stream) send(data interface{}, block bool) error {
+	s.Lock()
+	for block && s.credit == 0 && s.err == nil && !s.sendClosed {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		s.Unlock()
+		return s.err
+	}
+	if s.sendClosed {
+		s.Unlock()
+		return errStreamSendClosed
+	}
+	if s.credit == 0 {
+		s.Unlock()
+		return errStreamNoCredit
+	}
+	s.credit--
+	s.Unlock()
+
+	err := s.agent.writeMsg(&S2S_StreamMsg{RequestID: s.requestID, FromCaller: s.caller, Data: data})
+	if err != nil {
+		// the receiver would miss a message
+		s.abort(err)
+	}
+	return err
+}
+
+// ends the sending side, err is delivered to the receiver instead of io.EOF
+// goroutine safe
+func (s *Stream) CloseSend(err error) error {
+	s.Lock()
+	if s.err != nil {
+		s.Unlock()
+		return s.err
+	}
+	if s.sendClosed {
+		s.Unlock()
+		return errStreamSendClosed
+	}
+	s.sendClosed = true
+	s.cond.Broadcast()
+	s.Unlock()
+
+	msg := &S2S_StreamMsg{RequestID: s.requestID, FromCaller: s.caller, End: true}
+	if err != nil {
+		msg.Err = err.Error()
+	}
+	if !s.caller && s.callType == callServerStream {
+		// nothing is left to do for the handler
+		s.agent.removeStream(s)
+		s.terminate(errStreamSendClosed)
+	}
+	werr := s.agent.writeMsg(msg)
+	if werr != nil {
+		s.abort(werr)
+	}
+	return werr
+}
+
+// returns io.EOF once the sender has closed the stream without error
+// goroutine safe
+func (s *Stream) Recv() (interface{}, error) {
+	select {
+	case <-s.done:
+		return nil, s.err
+	default:
+	}
+
+	select {
+	case data, ok := <-s.chanData:
+		if !ok {
+			return nil, s.recvErr
+		}
+		s.consume()
+		return data, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// client streaming only, called by the caller after the last Send
+// goroutine safe
+func (s *Stream) CloseAndRecv() (interface{}, error) {
+	if !s.caller || s.callType != callClientStream {
+		return nil, errors.New("not a client stream")
+	}
+
+	// a failure ends the stream, the answer tells
+	s.CloseSend(nil)
+
+	select {
+	case ri := <-s.chanRet:
+		return ri.Ret, ri.Err
+	case <-s.done:
+	}
+
+	// the handler may have answered before the end of the stream
+	select {
+	case ri := <-s.chanRet:
+		return ri.Ret, ri.Err
+	default:
+		return nil, s.err
+	}
+}
+
+// client streaming only, called by the handler to answer the caller
+// goroutine safe
+func (s *Stream) SendAndClose(ret interface{}, err error) error {
+	if s.caller || s.callType != callClientStream {
+		return errors.New("not a client stream handler")
+	}
+
+	s.Lock()
+	if s.err != nil {
+		s.Unlock()
+		return s.err
+	}
+	s.sendClosed = true
+	s.Unlock()
+
+	s.agent.removeStream(s)
+	s.terminate(errStreamSendClosed)
+
+	msg := &S2S_ResponseMsg{RequestID: s.requestID, Ret: ret}
+	if err != nil {
+		msg.Err = err.Error()
+	}
+	werr := s.agent.writeMsg(msg)
+	if werr != nil {
+		// or the caller would wait for the answer forever
+		s.agent.WriteMsg(&S2S_StreamCtrl{RequestID: s.requestID, FromCaller: s.caller, Cancel: true})
+	}
+	return werr
+}
+
+// aborts the stream on both sides
+// goroutine safe
+func (s *Stream) Cancel() {
+	s.abort(errStreamCanceled)
+}
+
+func (s *Stream) abort(err error) {
+	if !s.terminate(err) {
+		return
+	}
+
+	s.agent.removeStream(s)
+	s.agent.WriteMsg(&S2S_StreamCtrl{RequestID: s.requestID, FromCaller: s.caller, Cancel: true})
+}
+
+func (s *Stream) terminate(err error) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return false
+	}
+	s.err = err
+	close(s.done)
+	s.cond.Broadcast()
+	return true
+}
+
+func (s *Stream) consume() {
+	s.Lock()
+	s.consumed++
+	if s.consumed < streamWindow/2 {
+		s.Unlock()
+		return
+	}
+	credit := s.consumed
+	s.consumed = 0
+	s.Unlock()
+
+	err := s.agent.writeMsg(&S2S_StreamCtrl{RequestID: s.requestID, FromCaller: s.caller, Credit: int32(credit)})
+	if err != nil {
+		// or the sender would wait for credit forever
+		s.abort(err)
+	}
+}
+
+// called on the agent goroutine only
+func (s *Stream) push(msg *S2S_StreamMsg) {
+	if s.recvClosed {
+		return
+	}
+
+	if msg.End {
+		s.recvClosed = true
+		if msg.Err != "" {
+			s.recvErr = errors.New(msg.Err)
+		} else {
+			s.recvErr = io.EOF
+		}
+		close(s.chanData)
+
+		if s.caller {
+			s.agent.removeStream(s)
+		}
+		return
+	}
+
+	select {
+	case s.chanData <- msg.Data:
+	default:
+		s.abort(fmt.Errorf("stream %v: window exceeded", s.requestID))
+	}
+}
+
+func (s *Stream) grant(credit int32) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.credit += int(credit)
+	s.cond.Broadcast()
+}
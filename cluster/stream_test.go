@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+)
+
+func TestStreamCreditExhausted(t *testing.T) {
+	n := 3 * streamWindow
+	chanSent := make(chan int, 1)
+	server := chanrpc.NewServer(10)
+	server.Register("feed", func(args []interface{}) error {
+		s := args[1].(*Stream)
+
+		// on the module goroutine TrySend fails once the window is full
+		sent := 0
+		for s.TrySend(sent) == nil {
+			sent++
+		}
+		chanSent <- sent
+
+		go func() {
+			for i := sent; i < args[0].(int); i++ {
+				if err := s.Send(i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			s.CloseSend(nil)
+		}()
+		return nil
+	})
+	server.Register("ping", func(args []interface{}) (interface{}, error) {
+		return "pong", nil
+	})
+
+	c1, c2 := newTestClusters(t)
+	c1.SetRoute("feed", server)
+	c1.SetRoute("ping", server)
+	serve(t, server)
+	startTestClusters(t, c1, c2)
+
+	s, err := c2.ServerStream("game1", "feed", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := <-chanSent; sent != streamWindow {
+		t.Fatalf("sent %v before the first credit, want %v", sent, streamWindow)
+	}
+
+	// the module keeps serving while its stream waits for credit
+	ret, err := c2.Call1("game1", "ping")
+	if ret != "pong" || err != nil {
+		t.Fatalf("ping: %v, %v", ret, err)
+	}
+
+	for i := 0; i < n; i++ {
+		data, err := s.Recv()
+		if err != nil {
+			t.Fatalf("recv %v: %v", i, err)
+		}
+		if data != i {
+			t.Fatalf("recv %v: got %v", i, data)
+		}
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Fatalf("recv after the end: %v", err)
+	}
+}
+
+func TestStreamEarlyAnswer(t *testing.T) {
+	server := chanrpc.NewServer(10)
+	server.Register("first", func(args []interface{}) error {
+		s := args[0].(*Stream)
+		return s.SendAndClose("early", nil)
+	})
+
+	c1, c2 := newTestClusters(t)
+	c1.SetRoute("first", server)
+	serve(t, server)
+	startTestClusters(t, c1, c2)
+
+	s, err := c2.ClientStream("game1", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is read by the handler, the sender must not wait forever
+	chanErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := s.Send(i); err != nil {
+				chanErr <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-chanErr:
+		if err != errStreamClosed {
+			t.Fatalf("send: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked after the answer")
+	}
+
+	ret, err := s.CloseAndRecv()
+	if ret != "early" || err != nil {
+		t.Fatalf("answer: %v, %v", ret, err)
+	}
+	if count := c2.GetRequestCount(); count != 0 {
+		t.Fatalf("%v requests left", count)
+	}
+}
+
+func TestStreamHandlerError(t *testing.T) {
+	server := chanrpc.NewServer(10)
+	server.Register("fail", func(args []interface{}) error {
+		return errors.New("boom")
+	})
+
+	c1, c2 := newTestClusters(t)
+	c1.SetRoute("fail", server)
+	serve(t, server)
+	startTestClusters(t, c1, c2)
+
+	s, err := c2.ServerStream("game1", "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err == nil || err.Error() != "boom" {
+		t.Fatalf("server stream: %v", err)
+	}
+
+	s, err = c2.ClientStream("game1", "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CloseAndRecv(); err == nil || err.Error() != "boom" {
+		t.Fatalf("client stream: %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	chanErr := make(chan error, 1)
+	server := chanrpc.NewServer(10)
+	server.Register("endless", func(args []interface{}) error {
+		s := args[0].(*Stream)
+		go func() {
+			for {
+				if err := s.Send(0); err != nil {
+					chanErr <- err
+					return
+				}
+			}
+		}()
+		return nil
+	})
+
+	c1, c2 := newTestClusters(t)
+	c1.SetRoute("endless", server)
+	serve(t, server)
+	startTestClusters(t, c1, c2)
+
+	s, err := c2.ServerStream("game1", "endless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	s.Cancel()
+	if _, err := s.Recv(); err != errStreamCanceled {
+		t.Fatalf("recv after Cancel: %v", err)
+	}
+
+	select {
+	case err := <-chanErr:
+		if err == nil {
+			t.Fatal("send succeeded after Cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
@@ -3,6 +3,14 @@ package conf
 var (
 	LenStackBuf = 4096
 
+	// second, leaf exits anyway if closing down takes longer, 0 waits forever
+	ShutdownTimeout int
+
+	// health, "" disables the /readyz and /livez endpoints
+	HealthAddr string
+	// second, a module busy with one event longer is not alive, default 60
+	StallTimeout int
+
 	// log
 	LogLevel string
 	LogPath  string
@@ -12,11 +20,20 @@ var (
 	ConsolePort   int
 	ConsolePrompt string = "Leaf# "
 	ProfilePath   string
+	// HTTP admin API, "" disables, a loopback address unless a password is set
+	ConsoleHTTPAddr string
+	// console login, both "": no login
+	ConsoleAdminPassword    string
+	ConsoleReadOnlyPassword string
 
 	// cluster
-	ServerName        string
-	ListenAddr        string
-	ConnAddrs         map[string]string
-	PendingWriteNum   int
-	HeartBeatInterval int
+	ServerName          string
+	ListenAddr          string
+	ConnAddrs           map[string]string
+	PendingWriteNum     int
+	PendingWriteTimeout int // millisecond, 0 destroys the link when the write queue is full
+	HeartBeatInterval   int
+	HeartBeatMissTimes  int // default 1, closes the link at the first miss, 2 or more reports it degraded first
+	// cluster exec from other servers may run admin commands, default read-only ones only
+	ClusterConsoleAdmin bool
 )
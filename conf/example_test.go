@@ -0,0 +1,63 @@
+package conf_test
+
+import (
+	"fmt"
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/conf"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+func ExampleLoader() {
+	var game struct {
+		MaxOnline int
+		Maps      []int
+		Motd      string `conf:"required"`
+	}
+
+	loader := conf.NewLoader("test.toml")
+	loader.Bind("game", &game)
+	err := loader.Load()
+	fmt.Println(err)
+
+	fmt.Println(conf.ServerName, conf.ConnAddrs["login1"])
+	fmt.Println(game.MaxOnline, game.Maps)
+
+	// Output:
+	// <nil>
+	// game1 127.0.0.1:3001
+	// 5000 [1 2 3]
+}
+
+func ExampleLoader_Reload() {
+	var game struct {
+		MaxOnline int
+	}
+
+	filename := path.Join(os.TempDir(), "leaf_reload.json")
+	ioutil.WriteFile(filename, []byte(`{"game": {"MaxOnline": 100}}`), 0644)
+	defer os.Remove(filename)
+
+	loader := conf.NewLoader(filename)
+	loader.Bind("game", &game)
+	loader.Load()
+
+	// the module applies the new values on its own goroutine
+	s := chanrpc.NewServer(10)
+	s.Register("ConfReload", func(args []interface{}) {
+		game = *args[1].(*struct{ MaxOnline int })
+		fmt.Println(args[0], args[2])
+	})
+	loader.Subscribe("game", s)
+
+	ioutil.WriteFile(filename, []byte(`{"game": {"MaxOnline": 200}}`), 0644)
+	fmt.Println(loader.Reload())
+	s.Exec(<-s.ChanCall)
+	fmt.Println(game.MaxOnline)
+
+	// Output:
+	// <nil>
+	// game [MaxOnline]
+	// 200
+}
@@ -0,0 +1,645 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/log"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	loadersMutex sync.Mutex
+	loaders      []*Loader
+	reloadFuncs  = make(map[int]func(changed map[string]interface{}))
+	reloadFuncID int
+)
+
+// the leaf variables the running apps apply when they are reloaded,
+// a change of another one takes effect on the next start
+var hotFields = map[string]bool{
+	"LogLevel":           true,
+	"HeartBeatInterval":  true,
+	"HeartBeatMissTimes": true,
+}
+
+// all the errors found by one Load
+type Errors []error
+
+func (errs Errors) Error() string {
+	s := make([]string, len(errs))
+	for i, err := range errs {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// optional, called on bound structs after loading
+type Validator interface {
+	Validate() error
+}
+
+type field struct {
+	name     string
+	ptr      interface{}
+	required bool
+}
+
+type binding struct {
+	section string
+	v       interface{}
+	// a copy of the last value loaded, v belongs to the module
+	loaded interface{}
+}
+
+type subscriber struct {
+	section string
+	server  *chanrpc.Server
+}
+
+// Loader fills the leaf conf variables from the top level keys of the files
+// and bound structs from their sections, later files override earlier ones
+// and environment variables override files:
+// EnvPrefix + NAME for leaf variables, EnvPrefix + SECTION_NAME for bound structs,
+// a map is given as a JSON object or as key=value pairs separated by commas
+type Loader struct {
+	Files       []string
+	EnvPrefix   string
+	mutex       sync.Mutex
+	bindings    []*binding
+	subscribers []*subscriber
+	// the leaf variables as last loaded, they are only assigned by Load
+	leaf     []*field
+	modTimes map[string]time.Time
+	closeSig chan bool
+}
+
+// the loader is also reloaded by conf.Reload until it is closed
+func NewLoader(files ...string) *Loader {
+	l := new(Loader)
+	l.Files = files
+	l.EnvPrefix = "LEAF_"
+
+	loadersMutex.Lock()
+	loaders = append(loaders, l)
+	loadersMutex.Unlock()
+	return l
+}
+
+// v must be a pointer to struct, fields are matched case-insensitively by name
+// (or json tag) and a `conf:"required"` tag makes a zero value an error
+// section "" binds the top level keys
+// goroutine not safe
+func (l *Loader) Bind(section string, v interface{}) {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("conf: pointer to struct required")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.bindings = append(l.bindings, &binding{section: section, v: v})
+}
+
+// on every Reload which changes the section, server gets a call of
+// function id "ConfReload": func(args []interface{})
+// args: section string, value interface{}, changed []string
+// value is a new copy of the bound struct for the handler to apply on its
+// own goroutine, the struct passed to Bind is never written by Reload
+// goroutine safe
+func (l *Loader) Subscribe(section string, server *chanrpc.Server) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.subscribers = append(l.subscribers, &subscriber{section: section, server: server})
+}
+
+// reports every error at once, nothing is assigned if there is any
+func (l *Loader) Load() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	values, err := l.load()
+	if err != nil {
+		return err
+	}
+
+	l.leaf = values[0].([]*field)
+	applyFields(leafFields(), l.leaf)
+	for i, b := range l.bindings {
+		reflect.ValueOf(b.v).Elem().Set(reflect.ValueOf(values[i+1]).Elem())
+		b.loaded = values[i+1]
+	}
+	return nil
+}
+
+// loads the files again and notifies the subscribers of the sections which
+// changed, nothing is applied if the new configuration is invalid
+// the leaf variables are read by running goroutines and keep their values,
+// the changes of LogLevel, HeartBeatInterval and HeartBeatMissTimes go to
+// the functions of OnLeafReload, a change of another one is logged and
+// takes effect on the next start
+// goroutine safe
+func (l *Loader) Reload() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	values, err := l.load()
+	if err != nil {
+		return err
+	}
+
+	leaf := values[0].([]*field)
+	if l.leaf != nil {
+		changed := make(map[string]interface{})
+		for _, name := range diffFields(l.leaf, leaf) {
+			if !hotFields[name] {
+				log.Release("conf %v changed, restart to apply it", name)
+				continue
+			}
+			changed[name] = fieldValue(leaf, name)
+			log.Release("conf reloaded: %v", name)
+		}
+		notifyLeaf(changed)
+	}
+	l.leaf = leaf
+
+	for i, b := range l.bindings {
+		v := values[i+1]
+		loaded := b.loaded
+		if loaded == nil {
+			loaded = b.v
+		}
+		l.notify(b.section, v, diffFields(structFields(loaded), structFields(v)))
+		b.loaded = v
+	}
+	return nil
+}
+
+// a copy of the struct bound to section as last loaded, nil if none
+// goroutine safe
+func (l *Loader) Get(section string) interface{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, b := range l.bindings {
+		if strings.EqualFold(b.section, section) && b.loaded != nil {
+			return copyValue(b.loaded)
+		}
+	}
+	return nil
+}
+
+// a new copy of the struct v points to
+func copyValue(v interface{}) interface{} {
+	c := reflect.New(reflect.TypeOf(v).Elem())
+	c.Elem().Set(reflect.ValueOf(v).Elem())
+	return c.Interface()
+}
+
+func (l *Loader) notify(section string, v interface{}, changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+
+	log.Release("conf reloaded: %v", strings.Join(changed, ", "))
+	for _, s := range l.subscribers {
+		if strings.EqualFold(s.section, section) {
+			s.server.Go("ConfReload", section, copyValue(v), changed)
+		}
+	}
+}
+
+// returns the leaf fields followed by a copy of every bound struct
+func (l *Loader) load() ([]interface{}, error) {
+	root, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs Errors
+	// based on what was loaded before rather than the variables in use
+	leaf := l.leaf
+	if leaf == nil {
+		leaf = leafFields()
+	}
+	leaf = cloneFields(leaf)
+	errs = l.assign(errs, root, leaf, "")
+	errs = append(errs, validate(leaf)...)
+
+	values := make([]interface{}, 0, len(l.bindings)+1)
+	values = append(values, leaf)
+	for _, b := range l.bindings {
+		m := root
+		if b.section != "" {
+			m, _ = lookup(root, b.section).(map[string]interface{})
+		}
+		base := b.loaded
+		if base == nil {
+			base = b.v
+		}
+		v := reflect.ValueOf(copyValue(base))
+		fields := structFields(v.Interface())
+		errs = l.assign(errs, m, fields, b.section)
+		errs = checkRequired(errs, fields, b.section)
+
+		if v, ok := v.Interface().(Validator); ok {
+			if err := v.Validate(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		values = append(values, v.Interface())
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return values, nil
+}
+
+func (l *Loader) read() (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	var errs Errors
+	for _, filename := range l.Files {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m, err := parse(filename, data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", filename, err))
+			continue
+		}
+		merge(root, m)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return root, nil
+}
+
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sub, ok := v.(map[string]interface{})
+		if ok {
+			if dstSub, ok := dst[k].(map[string]interface{}); ok {
+				merge(dstSub, sub)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func lookup(m map[string]interface{}, key string) interface{} {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (l *Loader) assign(errs Errors, m map[string]interface{}, fields []*field, section string) Errors {
+	envPrefix := l.EnvPrefix
+	if section != "" {
+		envPrefix += strings.ToUpper(section) + "_"
+	}
+
+	for _, f := range fields {
+		name := f.name
+		if section != "" {
+			name = section + "." + f.name
+		}
+
+		raw := lookup(m, f.name)
+		envName := envPrefix + strings.ToUpper(f.name)
+		if env, ok := os.LookupEnv(envName); ok {
+			switch reflect.TypeOf(f.ptr).Elem().Kind() {
+			case reflect.String:
+				raw = env
+			case reflect.Map:
+				var err error
+				raw, err = parseEnvMap(env, reflect.TypeOf(f.ptr).Elem().Elem().Kind() == reflect.String)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%v: %v", envName, err))
+					continue
+				}
+			default:
+				raw = parseScalar(env)
+			}
+		}
+		if raw == nil {
+			continue
+		}
+
+		data, err := json.Marshal(raw)
+		if err == nil {
+			err = json.Unmarshal(data, f.ptr)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", name, err))
+		}
+	}
+	return errs
+}
+
+// a JSON object or key=value pairs separated by commas,
+// e.g. game2=127.0.0.1:3564,game3=127.0.0.1:3565
+func parseEnvMap(env string, stringValues bool) (map[string]interface{}, error) {
+	env = strings.TrimSpace(env)
+	m := make(map[string]interface{})
+	if strings.HasPrefix(env, "{") {
+		if err := json.Unmarshal([]byte(env), &m); err != nil {
+			return nil, fmt.Errorf("invalid JSON object: %v", err)
+		}
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(env, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected key=value pairs separated by commas or a JSON object, got %q", pair)
+		}
+		if stringValues {
+			m[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		} else {
+			m[strings.TrimSpace(pair[:i])] = parseScalar(pair[i+1:])
+		}
+	}
+	return m, nil
+}
+
+func checkRequired(errs Errors, fields []*field, section string) Errors {
+	for _, f := range fields {
+		if f.required && reflect.ValueOf(f.ptr).Elem().IsZero() {
+			name := f.name
+			if section != "" {
+				name = section + "." + f.name
+			}
+			errs = append(errs, fmt.Errorf("%v is required", name))
+		}
+	}
+	return errs
+}
+
+func structFields(v interface{}) []*field {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+
+	var fields []*field
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		name := sf.Name
+		if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		fields = append(fields, &field{
+			name:     name,
+			ptr:      rv.Field(i).Addr().Interface(),
+			required: sf.Tag.Get("conf") == "required",
+		})
+	}
+	return fields
+}
+
+func leafFields() []*field {
+	return []*field{
+		{name: "LenStackBuf", ptr: &LenStackBuf},
+		{name: "ShutdownTimeout", ptr: &ShutdownTimeout},
+		{name: "HealthAddr", ptr: &HealthAddr},
+		{name: "StallTimeout", ptr: &StallTimeout},
+		{name: "LogLevel", ptr: &LogLevel},
+		{name: "LogPath", ptr: &LogPath},
+		{name: "LogFlag", ptr: &LogFlag},
+		{name: "ConsolePort", ptr: &ConsolePort},
+		{name: "ConsolePrompt", ptr: &ConsolePrompt},
+		{name: "ProfilePath", ptr: &ProfilePath},
+		{name: "ConsoleHTTPAddr", ptr: &ConsoleHTTPAddr},
+		{name: "ConsoleAdminPassword", ptr: &ConsoleAdminPassword},
+		{name: "ConsoleReadOnlyPassword", ptr: &ConsoleReadOnlyPassword},
+		{name: "ServerName", ptr: &ServerName},
+		{name: "ListenAddr", ptr: &ListenAddr},
+		{name: "ConnAddrs", ptr: &ConnAddrs},
+		{name: "PendingWriteNum", ptr: &PendingWriteNum},
+		{name: "PendingWriteTimeout", ptr: &PendingWriteTimeout},
+		{name: "HeartBeatInterval", ptr: &HeartBeatInterval},
+		{name: "HeartBeatMissTimes", ptr: &HeartBeatMissTimes},
+		{name: "ClusterConsoleAdmin", ptr: &ClusterConsoleAdmin},
+	}
+}
+
+// copies of the fields, to assign before anything is validated
+func cloneFields(fields []*field) []*field {
+	clones := make([]*field, len(fields))
+	for i, f := range fields {
+		v := reflect.New(reflect.TypeOf(f.ptr).Elem())
+		v.Elem().Set(reflect.ValueOf(f.ptr).Elem())
+		clones[i] = &field{name: f.name, ptr: v.Interface(), required: f.required}
+	}
+	return clones
+}
+
+// names of the fields whose values differ
+func diffFields(dst, src []*field) []string {
+	var changed []string
+	for i := range dst {
+		if !reflect.DeepEqual(reflect.ValueOf(dst[i].ptr).Elem().Interface(),
+			reflect.ValueOf(src[i].ptr).Elem().Interface()) {
+			changed = append(changed, dst[i].name)
+		}
+	}
+	return changed
+}
+
+// copies the values of src into dst
+func applyFields(dst, src []*field) {
+	for i := range dst {
+		reflect.ValueOf(dst[i].ptr).Elem().Set(reflect.ValueOf(src[i].ptr).Elem())
+	}
+}
+
+func fieldValue(fields []*field, name string) interface{} {
+	for _, f := range fields {
+		if f.name == name {
+			return reflect.ValueOf(f.ptr).Elem().Interface()
+		}
+	}
+	return nil
+}
+
+// polls the files every interval and reloads them when one is modified,
+// errors are logged and the previous configuration is kept
+func (l *Loader) Watch(interval time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closeSig != nil {
+		return
+	}
+	l.closeSig = make(chan bool)
+	l.modTimes = l.stat()
+
+	go func(closeSig chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closeSig:
+				return
+			case <-ticker.C:
+			}
+
+			modTimes := l.stat()
+			l.mutex.Lock()
+			modified := !reflect.DeepEqual(modTimes, l.modTimes)
+			l.modTimes = modTimes
+			l.mutex.Unlock()
+			if !modified {
+				continue
+			}
+
+			if err := l.Reload(); err != nil {
+				log.Error("conf reload failed:\n%v", err)
+			}
+		}
+	}(l.closeSig)
+}
+
+// stops watching the files, conf.Reload no longer reloads the loader
+func (l *Loader) Close() {
+	l.mutex.Lock()
+	if l.closeSig != nil {
+		close(l.closeSig)
+		l.closeSig = nil
+	}
+	l.mutex.Unlock()
+
+	loadersMutex.Lock()
+	defer loadersMutex.Unlock()
+	for i, loader := range loaders {
+		if loader == l {
+			loaders = append(loaders[:i], loaders[i+1:]...)
+			break
+		}
+	}
+}
+
+func (l *Loader) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, filename := range l.Files {
+		fi, err := os.Stat(filename)
+		if err == nil {
+			modTimes[filename] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// f is called, on the goroutine of Reload, whenever a loader reloads a change
+// of LogLevel, HeartBeatInterval or HeartBeatMissTimes, changed holds their
+// new values by name, f must not call the loader
+// call the returned function to stop
+// goroutine safe
+func OnLeafReload(f func(changed map[string]interface{})) func() {
+	loadersMutex.Lock()
+	defer loadersMutex.Unlock()
+
+	id := reloadFuncID
+	reloadFuncID++
+	reloadFuncs[id] = f
+	return func() {
+		loadersMutex.Lock()
+		defer loadersMutex.Unlock()
+		delete(reloadFuncs, id)
+	}
+}
+
+func notifyLeaf(changed map[string]interface{}) {
+	if len(changed) == 0 {
+		return
+	}
+
+	loadersMutex.Lock()
+	fs := make([]func(map[string]interface{}), 0, len(reloadFuncs))
+	for _, f := range reloadFuncs {
+		fs = append(fs, f)
+	}
+	loadersMutex.Unlock()
+
+	for _, f := range fs {
+		f(changed)
+	}
+}
+
+// reloads every loader created by NewLoader and not closed
+// goroutine safe
+func Reload() error {
+	loadersMutex.Lock()
+	ls := append([]*Loader(nil), loaders...)
+	loadersMutex.Unlock()
+
+	var errs Errors
+	for _, l := range ls {
+		if err := l.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checks the leaf conf variables
+func Validate() error {
+	errs := validate(leafFields())
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validate(fields []*field) Errors {
+	var errs Errors
+
+	logLevel := fieldValue(fields, "LogLevel").(string)
+	switch strings.ToLower(logLevel) {
+	case "", "debug", "release", "error", "fatal":
+	default:
+		errs = append(errs, fmt.Errorf("LogLevel: unknown level %v", logLevel))
+	}
+	if port := fieldValue(fields, "ConsolePort").(int); port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("ConsolePort: invalid port %v", port))
+	}
+	if fieldValue(fields, "ServerName").(string) == "" &&
+		(fieldValue(fields, "ListenAddr").(string) != "" || len(fieldValue(fields, "ConnAddrs").(map[string]string)) > 0) {
+		errs = append(errs, fmt.Errorf("ServerName is required by cluster"))
+	}
+	for _, name := range []string{"ShutdownTimeout", "StallTimeout", "PendingWriteTimeout", "HeartBeatInterval", "HeartBeatMissTimes"} {
+		if fieldValue(fields, name).(int) < 0 {
+			errs = append(errs, fmt.Errorf("%v: must not be negative", name))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,170 @@
+package conf
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/islovingness/leaf/chanrpc"
+)
+
+type testGame struct {
+	MaxOnline int
+}
+
+func writeConf(t *testing.T, filename string, data string) {
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	saved := cloneFields(leafFields())
+	defer applyFields(leafFields(), saved)
+
+	filename := path.Join(t.TempDir(), "leaf.json")
+	writeConf(t, filename, `{"HeartBeatInterval": 5, "game": {"MaxOnline": 100}}`)
+
+	var game testGame
+	l := &Loader{Files: []string{filename}}
+	l.Bind("game", &game)
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if HeartBeatInterval != 5 || game.MaxOnline != 100 {
+		t.Fatalf("loaded %v, %+v", HeartBeatInterval, game)
+	}
+
+	s := chanrpc.NewServer(10)
+	s.Register("ConfReload", func(args []interface{}) {
+		game = *args[1].(*testGame)
+		if changed := args[2].([]string); !reflect.DeepEqual(changed, []string{"MaxOnline"}) {
+			t.Errorf("changed: %v", changed)
+		}
+	})
+	l.Subscribe("game", s)
+
+	// the running goroutines keep reading the variables meanwhile
+	closeSig := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-closeSig:
+				return
+			case ci := <-s.ChanCall:
+				s.Exec(ci)
+			default:
+				_ = HeartBeatInterval + game.MaxOnline
+			}
+		}
+	}()
+
+	var leafChanged []map[string]interface{}
+	stop := OnLeafReload(func(changed map[string]interface{}) {
+		leafChanged = append(leafChanged, changed)
+	})
+	defer stop()
+
+	writeConf(t, filename, `{"HeartBeatInterval": 10, "ProfilePath": "prof", "game": {"MaxOnline": 200}}`)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// ProfilePath is not hot-reloadable
+	if !reflect.DeepEqual(leafChanged, []map[string]interface{}{{"HeartBeatInterval": 10}}) {
+		t.Fatalf("leaf changed: %v", leafChanged)
+	}
+	if v := l.Get("game").(*testGame); v.MaxOnline != 200 {
+		t.Fatalf("snapshot: %+v", v)
+	}
+
+	// an invalid configuration is not applied
+	writeConf(t, filename, `{"LogLevel": "loud", "game": {"MaxOnline": 300}}`)
+	if err := l.Reload(); err == nil {
+		t.Fatal("reloaded an unknown log level")
+	}
+	if v := l.Get("game").(*testGame); v.MaxOnline != 200 {
+		t.Fatalf("snapshot after an error: %+v", v)
+	}
+
+	close(closeSig)
+	<-done
+	for len(s.ChanCall) > 0 {
+		s.Exec(<-s.ChanCall)
+	}
+	if game.MaxOnline != 200 {
+		t.Fatalf("applied %+v", game)
+	}
+	// applied by the running apps, not to the variable
+	if HeartBeatInterval != 5 || ProfilePath != "" {
+		t.Fatalf("HeartBeatInterval changed to %v, ProfilePath to %v", HeartBeatInterval, ProfilePath)
+	}
+
+	// nothing changed since the last reload
+	writeConf(t, filename, `{"HeartBeatInterval": 10, "ProfilePath": "prof", "game": {"MaxOnline": 200}}`)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.ChanCall); n != 0 || len(leafChanged) != 1 {
+		t.Fatalf("%v notifications without a change, leaf changed: %v", n, leafChanged)
+	}
+
+	// no longer called once stopped
+	stop()
+	writeConf(t, filename, `{"HeartBeatInterval": 20, "game": {"MaxOnline": 200}}`)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(leafChanged) != 1 {
+		t.Fatalf("leaf changed after stop: %v", leafChanged)
+	}
+}
+
+func TestEnvMap(t *testing.T) {
+	saved := cloneFields(leafFields())
+	defer applyFields(leafFields(), saved)
+
+	filename := path.Join(t.TempDir(), "leaf.json")
+	writeConf(t, filename, `{"ServerName": "game1", "ConnAddrs": {"game9": "127.0.0.1:9"}}`)
+	load := func() error {
+		l := NewLoader(filename)
+		defer l.Close()
+		return l.Load()
+	}
+	want := map[string]string{"game2": "127.0.0.1:3564", "game3": "3565"}
+	for _, env := range []string{
+		`{"game2": "127.0.0.1:3564", "game3": "3565"}`,
+		`game2=127.0.0.1:3564, game3=3565`,
+	} {
+		t.Setenv("LEAF_CONNADDRS", env)
+		if err := load(); err != nil {
+			t.Fatalf("%v: %v", env, err)
+		}
+		if !reflect.DeepEqual(ConnAddrs, want) {
+			t.Fatalf("%v: %v", env, ConnAddrs)
+		}
+	}
+
+	for _, env := range []string{`game2`, `{"game2": `} {
+		t.Setenv("LEAF_CONNADDRS", env)
+		err := load()
+		if err == nil || !strings.Contains(err.Error(), "LEAF_CONNADDRS") {
+			t.Fatalf("%v: %v", env, err)
+		}
+	}
+}
+
+func TestLoaderClose(t *testing.T) {
+	l := NewLoader()
+	l.Close()
+	loadersMutex.Lock()
+	defer loadersMutex.Unlock()
+	for _, loader := range loaders {
+		if loader == l {
+			t.Fatal("closed loader still reloaded by Reload")
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parses a configuration file into nested maps, the format is chosen by extension:
+// .json, .toml (key = value, [section]) or .yaml/.yml (key: value, indented blocks, - items)
+func parse(filename string, data []byte) (map[string]interface{}, error) {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".json":
+		m := make(map[string]interface{})
+		err := json.Unmarshal(data, &m)
+		return m, err
+	case ".toml":
+		return parseTOML(data)
+	case ".yaml", ".yml":
+		return parseYAML(data)
+	default:
+		return nil, fmt.Errorf("unknown config format: %v", filename)
+	}
+}
+
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	section := root
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = root
+			for _, name := range strings.Split(line[1:len(line)-1], ".") {
+				section = subMap(section, strings.TrimSpace(name))
+			}
+			continue
+		}
+
+		j := strings.Index(line, "=")
+		if j < 0 {
+			return nil, fmt.Errorf("line %v: key = value expected", i+1)
+		}
+		key := strings.TrimSpace(line[:j])
+		if key == "" {
+			return nil, fmt.Errorf("line %v: empty key", i+1)
+		}
+		section[unquote(key)] = parseScalar(line[j+1:])
+	}
+
+	return root, nil
+}
+
+type yamlFrame struct {
+	indent int
+	m      map[string]interface{}
+	// the key owning m in its parent, to turn it into a list on "- "
+	parent map[string]interface{}
+	key    string
+}
+
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	stack := []*yamlFrame{{indent: -1, m: root}}
+
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimRight(stripComment(raw), " \t\r")
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		line = strings.TrimSpace(line)
+
+		for len(stack) > 1 && indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		top := stack[len(stack)-1]
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if top.parent == nil {
+				return nil, fmt.Errorf("line %v: list item without key", i+1)
+			}
+			list, _ := top.parent[top.key].([]interface{})
+			top.parent[top.key] = append(list, parseScalar(strings.TrimPrefix(line, "-")))
+			continue
+		}
+
+		j := strings.Index(line, ":")
+		if j < 0 {
+			return nil, fmt.Errorf("line %v: key: value expected", i+1)
+		}
+		key := unquote(strings.TrimSpace(line[:j]))
+		value := strings.TrimSpace(line[j+1:])
+		if value != "" {
+			top.m[key] = parseScalar(value)
+			continue
+		}
+
+		m := subMap(top.m, key)
+		stack = append(stack, &yamlFrame{indent: indent, m: m, parent: top.m, key: key})
+	}
+
+	return root, nil
+}
+
+func subMap(m map[string]interface{}, key string) map[string]interface{} {
+	sub, ok := m[key].(map[string]interface{})
+	if !ok {
+		sub = make(map[string]interface{})
+		m[key] = sub
+	}
+	return sub
+}
+
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// "quoted", true/false, numbers, [a, b] or {json}, anything else is a string
+func parseScalar(s string) interface{} {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return ""
+	case s == "true":
+		return true
+	case s == "false":
+		return false
+	case s[0] == '"' || s[0] == '\'':
+		return unquote(s)
+	case s[0] == '{':
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			return v
+		}
+		return s
+	case s[0] == '[' && s[len(s)-1] == ']':
+		list := []interface{}{}
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			if strings.TrimSpace(item) != "" {
+				list = append(list, parseScalar(item))
+			}
+		}
+		return list
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package console
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// what a console user may run
+type Level int
+
+const (
+	LevelReadOnly Level = iota
+	LevelAdmin
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelReadOnly:
+		return "read-only"
+	case LevelAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	errCommandNotFound  = errors.New("command not found, try `help` for help")
+	errPermissionDenied = fmt.Errorf("permission denied: %v required", LevelAdmin)
+)
+
+// commands are LevelAdmin unless set otherwise
+// goroutine safe
+func (c *Console) SetLevel(name string, level Level) {
+	c.commandsMutex.Lock()
+	defer c.commandsMutex.Unlock()
+
+	c.levels[name] = level
+}
+
+// goroutine safe
+func SetLevel(name string, level Level) {
+	Default.SetLevel(name, level)
+}
+
+func (c *Console) commandLevel(name string) Level {
+	c.commandsMutex.RLock()
+	defer c.commandsMutex.RUnlock()
+
+	level, ok := c.levels[name]
+	if !ok {
+		return LevelAdmin
+	}
+	return level
+}
+
+func (c *Console) authRequired() bool {
+	return c.AdminPassword != "" || c.ReadOnlyPassword != ""
+}
+
+func (c *Console) login(password string) (Level, bool) {
+	match := func(expected string) bool {
+		return expected != "" && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	}
+
+	switch {
+	case !c.authRequired():
+		return LevelAdmin, true
+	case match(c.AdminPassword):
+		return LevelAdmin, true
+	case match(c.ReadOnlyPassword):
+		return LevelReadOnly, true
+	default:
+		return 0, false
+	}
+}
+
+// who runs a command
+type Session struct {
+	Level Level
+	// where the user comes from, written to the audit log
+	Source string
+}
+
+// runs a command line on behalf of session, every attempt is written to the audit log
+// goroutine safe
+func (c *Console) Exec(session *Session, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errCommandNotFound
+	}
+	_c, err := c.authorize(session, args[0], strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+	return runCommand(_c, session, args[1:]), nil
+}
+
+func (c *Console) authorize(session *Session, name string, line string) (Command, error) {
+	_c := c.getCommand(name)
+	if _c == nil {
+		return nil, errCommandNotFound
+	}
+
+	if c.commandLevel(_c.name()) > session.Level {
+		c.Logger.Release("console audit: %v [%v] denied: %v", session.Source, session.Level, line)
+		return nil, errPermissionDenied
+	}
+
+	c.Logger.Release("console audit: %v [%v] exec: %v", session.Source, session.Level, line)
+	return _c, nil
+}
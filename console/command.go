@@ -1,25 +1,28 @@
 package console
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/islovingness/leaf/chanrpc"
 	"github.com/islovingness/leaf/conf"
-	"github.com/islovingness/leaf/log"
 	"os"
 	"path"
+	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
 	"time"
 	"strings"
+	"sync"
 )
 
-var commands = []Command{
-	new(CommandHelp),
-	new(CommandCPUProf),
-	new(CommandProf),
-}
+func (c *Console) getCommand(name string) Command {
+	c.commandsMutex.RLock()
+	defer c.commandsMutex.RUnlock()
 
-func getCommand(name string) Command {
-	for _, _c := range commands {
+	for _, _c := range c.commands {
 		if strings.EqualFold(_c.name(), name) {
 			return _c
 		}
@@ -50,13 +53,8 @@ func (c *ExternalCommand) help() string {
 	return c._help
 }
 
-func (c *ExternalCommand) run(_args []string) string {
-	args := make([]interface{}, len(_args))
-	for i, v := range _args {
-		args[i] = v
-	}
-
-	ret, err := c.server.Call1(c._name, args...)
+func (c *ExternalCommand) run(args []string) string {
+	ret, err := c.call(args)
 	if err != nil {
 		return err.Error()
 	}
@@ -68,26 +66,159 @@ func (c *ExternalCommand) run(_args []string) string {
 	return output
 }
 
-// you must call the function before calling console.Init
-// goroutine not safe
-func Register(name string, help string, f interface{}, server *chanrpc.Server) {
-	for _, c := range commands {
-		if c.name() == name {
-			log.Fatal("command %v is already registered", name)
+// the handler runs on the goroutine serving server, usually a module's,
+// and gets the words as strings
+func (c *ExternalCommand) call(_args []string) (interface{}, error) {
+	args := make([]interface{}, len(_args))
+	for i, v := range _args {
+		args[i] = v
+	}
+	return c.server.Call1(c._name, args...)
+}
+
+// goroutine safe
+func (c *Console) Register(name string, help string, f interface{}, server *chanrpc.Server) {
+	c.commandsMutex.Lock()
+	defer c.commandsMutex.Unlock()
+
+	for _, _c := range c.commands {
+		if _c.name() == name {
+			c.Logger.Fatal("command %v is already registered", name)
 		}
 	}
 
 	server.Register(name, f)
 
-	c := new(ExternalCommand)
-	c._name = name
-	c._help = help
-	c.server = server
-	commands = append(commands, c)
+	_c := new(ExternalCommand)
+	_c._name = name
+	_c._help = help
+	_c.server = server
+	c.commands = append(c.commands, _c)
+}
+
+type FuncCommand struct {
+	_name string
+	_help string
+	f     func(args []string) string
+}
+
+func (c *FuncCommand) name() string {
+	return c._name
+}
+
+func (c *FuncCommand) help() string {
+	return c._help
+}
+
+func (c *FuncCommand) run(args []string) string {
+	return c.f(args)
+}
+
+// f runs on the console goroutine, so it must be goroutine safe
+// goroutine safe
+func (c *Console) RegisterFunc(name string, help string, f func(args []string) string) {
+	c.commandsMutex.Lock()
+	defer c.commandsMutex.Unlock()
+
+	for _, _c := range c.commands {
+		if _c.name() == name {
+			c.Logger.Fatal("command %v is already registered", name)
+		}
+	}
+
+	_c := new(FuncCommand)
+	_c._name = name
+	_c._help = help
+	_c.f = f
+	c.commands = append(c.commands, _c)
+}
+
+type SessionFuncCommand struct {
+	_name string
+	_help string
+	f     func(session *Session, args []string) string
+}
+
+func (c *SessionFuncCommand) name() string {
+	return c._name
+}
+
+func (c *SessionFuncCommand) help() string {
+	return c._help
+}
+
+// no session is known, the least privileged one is assumed
+func (c *SessionFuncCommand) run(args []string) string {
+	return c.f(&Session{Level: LevelReadOnly}, args)
+}
+
+func (c *SessionFuncCommand) runSession(session *Session, args []string) string {
+	return c.f(session, args)
+}
+
+func runCommand(_c Command, session *Session, args []string) string {
+	if sc, ok := _c.(*SessionFuncCommand); ok {
+		return sc.runSession(session, args)
+	}
+	return _c.run(args)
+}
+
+// like RegisterFunc, f is told who runs the command
+// goroutine safe
+func (c *Console) RegisterSessionFunc(name string, help string, f func(session *Session, args []string) string) {
+	c.commandsMutex.Lock()
+	defer c.commandsMutex.Unlock()
+
+	for _, _c := range c.commands {
+		if _c.name() == name {
+			c.Logger.Fatal("command %v is already registered", name)
+		}
+	}
+
+	_c := new(SessionFuncCommand)
+	_c._name = name
+	_c._help = help
+	_c.f = f
+	c.commands = append(c.commands, _c)
+}
+
+// goroutine safe
+func (c *Console) Unregister(name string) {
+	c.commandsMutex.Lock()
+	defer c.commandsMutex.Unlock()
+
+	for i, _c := range c.commands {
+		if _c.name() == name {
+			c.commands = append(c.commands[:i], c.commands[i+1:]...)
+			return
+		}
+	}
+}
+
+// goroutine safe
+func Register(name string, help string, f interface{}, server *chanrpc.Server) {
+	Default.Register(name, help, f, server)
+}
+
+// goroutine safe
+func RegisterFunc(name string, help string, f func(args []string) string) {
+	Default.RegisterFunc(name, help, f)
+}
+
+// goroutine safe
+func RegisterSessionFunc(name string, help string, f func(session *Session, args []string) string) {
+	Default.RegisterSessionFunc(name, help, f)
+}
+
+// goroutine safe
+func Unregister(name string) {
+	Default.Unregister(name)
 }
 
 // help
-type CommandHelp struct{}
+type CommandHelp struct {
+	console *Console
+}
 
 func (c *CommandHelp) name() string {
 	return "help"
@@ -98,8 +229,11 @@ func (c *CommandHelp) help() string {
 }
 
 func (c *CommandHelp) run([]string) string {
+	c.console.commandsMutex.RLock()
+	defer c.console.commandsMutex.RUnlock()
+
 	output := "Commands:\r\n"
-	for _, c := range commands {
+	for _, c := range c.console.commands {
 		output += c.name() + " - " + c.help() + "\r\n"
 	}
 	output += "quit - exit console"
@@ -107,8 +241,31 @@ func (c *CommandHelp) run([]string) string {
 	return output
 }
 
+// reload
+type CommandReload struct{}
+
+func (c *CommandReload) name() string {
+	return "reload"
+}
+
+func (c *CommandReload) help() string {
+	return "reloads the configuration files"
+}
+
+func (c *CommandReload) run([]string) string {
+	err := conf.Reload()
+	if err != nil {
+		return strings.Replace(err.Error(), "\n", "\r\n", -1)
+	}
+	return "configuration reloaded"
+}
+
 // cpuprof
-type CommandCPUProf struct{}
+type CommandCPUProf struct {
+	mutex sync.Mutex
+	// closed by stop to end a timed capture early
+	stopSig chan bool
+}
 
 func (c *CommandCPUProf) name() string {
 	return "cpuprof"
@@ -121,9 +278,17 @@ func (c *CommandCPUProf) help() string {
 func (c *CommandCPUProf) usage() string {
 	return "cpuprof writes runtime profiling data in the format expected by \r\n" +
 		"the pprof visualization tool\r\n\r\n" +
-		"Usage: cpuprof start|stop\r\n" +
-		"  start - enables CPU profiling\r\n" +
-		"  stop  - stops the current CPU profile"
+		"Usage: cpuprof start|stop|<duration>\r\n" +
+		"  start      - enables CPU profiling\r\n" +
+		"  stop       - stops the current CPU profile\r\n" +
+		"  <duration> - profiles for the duration, e.g. 30s, then stops"
+}
+
+func (c *CommandCPUProf) complete(words []string) []string {
+	if len(words) > 1 {
+		return nil
+	}
+	return filterPrefix([]string{"start", "stop"}, words[0])
 }
 
 func (c *CommandCPUProf) run(args []string) string {
@@ -133,22 +298,82 @@ func (c *CommandCPUProf) run(args []string) string {
 
 	switch args[0] {
 	case "start":
-		fn := profileName() + ".cpuprof"
-		f, err := os.Create(fn)
+		f, err := createProfile(".cpuprof")
 		if err != nil {
 			return err.Error()
 		}
 		err = pprof.StartCPUProfile(f)
 		if err != nil {
 			f.Close()
+			os.Remove(f.Name())
 			return err.Error()
 		}
-		return fn
+		return f.Name()
 	case "stop":
 		pprof.StopCPUProfile()
+		c.mutex.Lock()
+		if c.stopSig != nil {
+			close(c.stopSig)
+			c.stopSig = nil
+		}
+		c.mutex.Unlock()
 		return ""
 	default:
-		return c.usage()
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return c.usage()
+		}
+		return c.capture(d)
+	}
+}
+
+// blocks until the capture is done
+func (c *CommandCPUProf) capture(d time.Duration) string {
+	f, err := createProfile(".cpuprof")
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	err = pprof.StartCPUProfile(f)
+	if err != nil {
+		os.Remove(f.Name())
+		return err.Error()
+	}
+
+	stopSig := make(chan bool)
+	c.mutex.Lock()
+	c.stopSig = stopSig
+	c.mutex.Unlock()
+
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+		pprof.StopCPUProfile()
+	case <-stopSig:
+		t.Stop()
+	}
+
+	c.mutex.Lock()
+	if c.stopSig == stopSig {
+		c.stopSig = nil
+	}
+	c.mutex.Unlock()
+	return f.Name()
+}
+
+// a new file named after the current time, a profile started within the
+// same second gets another name rather than truncating the first one
+func createProfile(ext string) (*os.File, error) {
+	name := profileName()
+	for i := 0; ; i++ {
+		fn := name + ext
+		if i > 0 {
+			fn = fmt.Sprintf("%v_%v%v", name, i, ext)
+		}
+		f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
 	}
 }
 
@@ -164,8 +389,31 @@ func profileName() string {
 			now.Second()))
 }
 
+// the runtime has no getter for the block profile rate
+var (
+	blockProfileRateMutex sync.Mutex
+	blockProfileRate      int
+)
+
+// sets runtime.SetBlockProfileRate, the prof command restores the rate
+// set here once a block capture is done
+// goroutine safe
+func SetBlockProfileRate(rate int) {
+	blockProfileRateMutex.Lock()
+	defer blockProfileRateMutex.Unlock()
+
+	blockProfileRate = rate
+	runtime.SetBlockProfileRate(rate)
+}
+
 // prof
-type CommandProf struct{}
+type CommandProf struct {
+	// one block or mutex capture at a time
+	captureMutex sync.Mutex
+}
+
+// how long block and mutex events are recorded when no duration is given
+const defaultCaptureDuration = 10 * time.Second
 
 func (c *CommandProf) name() string {
 	return "prof"
@@ -178,11 +426,21 @@ func (c *CommandProf) help() string {
 func (c *CommandProf) usage() string {
 	return "prof writes runtime profiling data in the format expected by \r\n" +
 		"the pprof visualization tool\r\n\r\n" +
-		"Usage: prof goroutine|heap|thread|block\r\n" +
+		"Usage: prof goroutine|heap|allocs|thread|block [duration]|mutex [duration]\r\n" +
 		"  goroutine - stack traces of all current goroutines\r\n" +
 		"  heap      - a sampling of all heap allocations\r\n" +
+		"  allocs    - a sampling of all past memory allocations\r\n" +
 		"  thread    - stack traces that led to the creation of new OS threads\r\n" +
-		"  block     - stack traces that led to blocking on synchronization primitives"
+		"  block     - stack traces that led to blocking on synchronization primitives\r\n" +
+		"  mutex     - stack traces of holders of contended mutexes\r\n" +
+		"block and mutex events are recorded for the duration, default " + defaultCaptureDuration.String()
+}
+
+func (c *CommandProf) complete(words []string) []string {
+	if len(words) > 1 {
+		return nil
+	}
+	return filterPrefix([]string{"goroutine", "heap", "allocs", "thread", "block", "mutex"}, words[0])
 }
 
 func (c *CommandProf) run(args []string) string {
@@ -191,35 +449,304 @@ func (c *CommandProf) run(args []string) string {
 	}
 
 	var (
-		p  *pprof.Profile
-		fn string
+		p   *pprof.Profile
+		ext string
 	)
 	switch args[0] {
 	case "goroutine":
 		p = pprof.Lookup("goroutine")
-		fn = profileName() + ".gprof"
+		ext = ".gprof"
 	case "heap":
 		p = pprof.Lookup("heap")
-		fn = profileName() + ".hprof"
+		ext = ".hprof"
+	case "allocs":
+		p = pprof.Lookup("allocs")
+		ext = ".aprof"
 	case "thread":
 		p = pprof.Lookup("threadcreate")
-		fn = profileName() + ".tprof"
+		ext = ".tprof"
 	case "block":
 		p = pprof.Lookup("block")
-		fn = profileName() + ".bprof"
+		ext = ".bprof"
+	case "mutex":
+		p = pprof.Lookup("mutex")
+		ext = ".mprof"
 	default:
 		return c.usage()
 	}
 
-	f, err := os.Create(fn)
+	if args[0] == "block" || args[0] == "mutex" {
+		d := defaultCaptureDuration
+		if len(args) > 1 {
+			var err error
+			d, err = time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				return c.usage()
+			}
+		}
+		c.record(args[0], d)
+	} else if len(args) > 1 {
+		return c.usage()
+	}
+
+	f, err := createProfile(ext)
 	if err != nil {
 		return err.Error()
 	}
 	defer f.Close()
 	err = p.WriteTo(f, 0)
 	if err != nil {
+		os.Remove(f.Name())
 		return err.Error()
 	}
 
-	return fn
+	return f.Name()
+}
+
+// enables the block or mutex profiling for d, they are off by default
+// as they slow down the process, the previous rate is restored afterwards
+// (for block profiling the one set by SetBlockProfileRate)
+func (c *CommandProf) record(profile string, d time.Duration) {
+	c.captureMutex.Lock()
+	defer c.captureMutex.Unlock()
+
+	if profile == "block" {
+		runtime.SetBlockProfileRate(1)
+		time.Sleep(d)
+		blockProfileRateMutex.Lock()
+		runtime.SetBlockProfileRate(blockProfileRate)
+		blockProfileRateMutex.Unlock()
+	} else {
+		fraction := runtime.SetMutexProfileFraction(1)
+		time.Sleep(d)
+		runtime.SetMutexProfileFraction(fraction)
+	}
+}
+
+// goroutines
+type CommandGoroutines struct{}
+
+func (c *CommandGoroutines) name() string {
+	return "goroutines"
+}
+
+func (c *CommandGoroutines) help() string {
+	return "number of goroutines grouped by function"
+}
+
+func (c *CommandGoroutines) run(args []string) string {
+	top := 10
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return "Usage: goroutines [top]"
+		}
+		top = n
+	}
+
+	// debug=1 groups identical stacks: "<count> @ <pcs>" then "#\t<pc>\t<func>+<off>\t<file:line>"
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+
+	counts := make(map[string]int)
+	count := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(line, " @ "); i > 0 {
+			count, _ = strconv.Atoi(line[:i])
+			continue
+		}
+		if count > 0 && strings.HasPrefix(line, "#\t") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 {
+				fn := fields[2]
+				if i := strings.LastIndex(fn, "+"); i > 0 {
+					fn = fn[:i]
+				}
+				counts[fn] += count
+			}
+			count = 0
+		}
+	}
+
+	fns := make([]string, 0, len(counts))
+	for fn := range counts {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		if counts[fns[i]] != counts[fns[j]] {
+			return counts[fns[i]] > counts[fns[j]]
+		}
+		return fns[i] < fns[j]
+	})
+	if len(fns) > top {
+		fns = fns[:top]
+	}
+
+	output := fmt.Sprintf("goroutines: %v", runtime.NumGoroutine())
+	for _, fn := range fns {
+		output += fmt.Sprintf("\r\n%8v %v", counts[fn], fn)
+	}
+	return output
+}
+
+// gc
+type CommandGC struct{}
+
+func (c *CommandGC) name() string {
+	return "gc"
+}
+
+func (c *CommandGC) help() string {
+	return "garbage collection statistics, gc run forces a collection"
+}
+
+func (c *CommandGC) complete(words []string) []string {
+	if len(words) > 1 {
+		return nil
+	}
+	return filterPrefix([]string{"run"}, words[0])
+}
+
+func (c *CommandGC) run(args []string) string {
+	output := ""
+	if len(args) > 0 {
+		if args[0] != "run" {
+			return "Usage: gc [run]"
+		}
+		start := time.Now()
+		runtime.GC()
+		output = fmt.Sprintf("gc done in %v\r\n", time.Since(start))
+	}
+
+	stats := &debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(stats)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	lastGC := "never"
+	if stats.NumGC > 0 {
+		lastGC = stats.LastGC.Format("2006-01-02 15:04:05") +
+			fmt.Sprintf(" (%v ago)", time.Since(stats.LastGC).Truncate(time.Millisecond))
+	}
+	output += fmt.Sprintf("num gc:         %v\r\n", stats.NumGC) +
+		fmt.Sprintf("forced gc:      %v\r\n", ms.NumForcedGC) +
+		fmt.Sprintf("last gc:        %v\r\n", lastGC) +
+		fmt.Sprintf("pause total:    %v\r\n", stats.PauseTotal) +
+		fmt.Sprintf("pause:          %v\r\n", stats.PauseQuantiles) +
+		fmt.Sprintf("next gc:        %v\r\n", formatBytes(ms.NextGC)) +
+		fmt.Sprintf("cpu fraction:   %.4f", ms.GCCPUFraction)
+	return output
+}
+
+// mem
+type CommandMem struct{}
+
+func (c *CommandMem) name() string {
+	return "mem"
+}
+
+func (c *CommandMem) help() string {
+	return "runtime memory statistics"
+}
+
+func (c *CommandMem) run([]string) string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return fmt.Sprintf("alloc:         %v\r\n", formatBytes(ms.Alloc)) +
+		fmt.Sprintf("total alloc:   %v\r\n", formatBytes(ms.TotalAlloc)) +
+		fmt.Sprintf("sys:           %v\r\n", formatBytes(ms.Sys)) +
+		fmt.Sprintf("mallocs:       %v\r\n", ms.Mallocs) +
+		fmt.Sprintf("frees:         %v\r\n", ms.Frees) +
+		fmt.Sprintf("live objects:  %v\r\n", ms.Mallocs-ms.Frees) +
+		fmt.Sprintf("heap alloc:    %v\r\n", formatBytes(ms.HeapAlloc)) +
+		fmt.Sprintf("heap sys:      %v\r\n", formatBytes(ms.HeapSys)) +
+		fmt.Sprintf("heap idle:     %v\r\n", formatBytes(ms.HeapIdle)) +
+		fmt.Sprintf("heap inuse:    %v\r\n", formatBytes(ms.HeapInuse)) +
+		fmt.Sprintf("heap released: %v\r\n", formatBytes(ms.HeapReleased)) +
+		fmt.Sprintf("heap objects:  %v\r\n", ms.HeapObjects) +
+		fmt.Sprintf("stack inuse:   %v\r\n", formatBytes(ms.StackInuse)) +
+		fmt.Sprintf("stack sys:     %v\r\n", formatBytes(ms.StackSys)) +
+		fmt.Sprintf("num gc:        %v", ms.NumGC)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// trace
+type CommandTrace struct {
+	mutex sync.Mutex
+	f     *os.File
+}
+
+func (c *CommandTrace) name() string {
+	return "trace"
+}
+
+func (c *CommandTrace) help() string {
+	return "execution tracing for the current process"
+}
+
+func (c *CommandTrace) usage() string {
+	return "trace writes an execution trace in the format expected by \r\n" +
+		"go tool trace\r\n\r\n" +
+		"Usage: trace start|stop\r\n" +
+		"  start - enables tracing\r\n" +
+		"  stop  - stops the current trace"
+}
+
+func (c *CommandTrace) complete(words []string) []string {
+	if len(words) > 1 {
+		return nil
+	}
+	return filterPrefix([]string{"start", "stop"}, words[0])
+}
+
+func (c *CommandTrace) run(args []string) string {
+	if len(args) == 0 {
+		return c.usage()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch args[0] {
+	case "start":
+		if c.f != nil {
+			return "tracing already enabled: " + c.f.Name()
+		}
+		f, err := createProfile(".trace")
+		if err != nil {
+			return err.Error()
+		}
+		err = trace.Start(f)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err.Error()
+		}
+		c.f = f
+		return f.Name()
+	case "stop":
+		if c.f == nil {
+			return "tracing not enabled"
+		}
+		trace.Stop()
+		fn := c.f.Name()
+		c.f.Close()
+		c.f = nil
+		return fn
+	default:
+		return c.usage()
+	}
 }
@@ -0,0 +1,293 @@
+package console
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/conf"
+)
+
+// the profiles are written to a directory removed when the test ends
+func setProfilePath(t *testing.T) string {
+	dir := t.TempDir()
+	profilePath := conf.ProfilePath
+	conf.ProfilePath = dir
+	t.Cleanup(func() {
+		conf.ProfilePath = profilePath
+	})
+	return dir
+}
+
+// the number of blocking events recorded
+func blockEvents() int64 {
+	records := make([]runtime.BlockProfileRecord, 64)
+	for {
+		n, ok := runtime.BlockProfile(records)
+		if ok {
+			var count int64
+			for _, r := range records[:n] {
+				count += r.Count
+			}
+			return count
+		}
+		records = make([]runtime.BlockProfileRecord, n+64)
+	}
+}
+
+func block() {
+	c := make(chan bool)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c <- true
+	}()
+	<-c
+}
+
+func TestProfBlockRate(t *testing.T) {
+	setProfilePath(t)
+	SetBlockProfileRate(1)
+	defer SetBlockProfileRate(0)
+
+	c := New()
+	output, err := c.Exec(&Session{Level: LevelAdmin}, []string{"prof", "block", "10ms"})
+	if err != nil || !strings.HasSuffix(output, ".bprof") {
+		t.Fatalf("prof block: %v, %v", output, err)
+	}
+
+	// still recorded at the rate set before
+	n := blockEvents()
+	block()
+	if blockEvents() == n {
+		t.Fatal("block profiling disabled by the capture")
+	}
+}
+
+func TestCPUProfFailure(t *testing.T) {
+	dir := setProfilePath(t)
+	if err := pprof.StartCPUProfile(ioutil.Discard); err != nil {
+		t.Skip(err)
+	}
+	defer pprof.StopCPUProfile()
+
+	c := New()
+	for _, args := range [][]string{{"cpuprof", "start"}, {"cpuprof", "10ms"}} {
+		output, err := c.Exec(&Session{Level: LevelAdmin}, args)
+		if err != nil || strings.HasSuffix(output, ".cpuprof") {
+			t.Fatalf("%v while profiling: %v, %v", args, output, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("%v profiles left", len(files))
+	}
+}
+
+func TestCPUProfTwice(t *testing.T) {
+	dir := setProfilePath(t)
+	c := New()
+	session := &Session{Level: LevelAdmin}
+	fn, err := c.Exec(session, []string{"cpuprof", "start"})
+	if err != nil || !strings.HasSuffix(fn, ".cpuprof") {
+		t.Skipf("cpuprof start: %v, %v", fn, err)
+	}
+
+	// within the same second, the profile being written is kept
+	output, err := c.Exec(session, []string{"cpuprof", "start"})
+	if err != nil || strings.HasSuffix(output, ".cpuprof") {
+		t.Fatalf("cpuprof start again: %v, %v", output, err)
+	}
+	if _, err := c.Exec(session, []string{"cpuprof", "stop"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Size() == 0 {
+		t.Fatalf("profiles: %v", files)
+	}
+	if _, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTraceFailure(t *testing.T) {
+	dir := setProfilePath(t)
+	if err := trace.Start(ioutil.Discard); err != nil {
+		t.Skip(err)
+	}
+	defer trace.Stop()
+
+	c := New()
+	output, err := c.Exec(&Session{Level: LevelAdmin}, []string{"trace", "start"})
+	if err != nil || strings.HasSuffix(output, ".trace") {
+		t.Fatalf("trace start while tracing: %v, %v", output, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("%v traces left", len(files))
+	}
+}
+
+// waits for c, the goroutines command groups the goroutines by function
+func parked(c chan bool) {
+	<-c
+}
+
+func TestGoroutines(t *testing.T) {
+	c := New()
+	session := &Session{Level: LevelReadOnly}
+	for _, arg := range []string{"x", "0", "-1"} {
+		if output, err := c.Exec(session, []string{"goroutines", arg}); err != nil || output != "Usage: goroutines [top]" {
+			t.Fatalf("goroutines %v: %v, %v", arg, output, err)
+		}
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	for i := 0; i < 20; i++ {
+		go parked(stop)
+	}
+	// until they are all parked
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		output, err := c.Exec(session, []string{"goroutines", "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(output, "\r\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[0], "goroutines: ") {
+			t.Fatalf("goroutines 2: %q", output)
+		}
+		fields := strings.Fields(lines[1])
+		if len(fields) == 2 && fields[0] == "20" && fields[1] == "github.com/islovingness/leaf/console.parked" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines 2: %q", output)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGC(t *testing.T) {
+	c := New()
+	session := &Session{Level: LevelAdmin}
+	if output, err := c.Exec(session, []string{"gc", "now"}); err != nil || output != "Usage: gc [run]" {
+		t.Fatalf("gc now: %v, %v", output, err)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	output, err := c.Exec(session, []string{"gc", "run"})
+	if err != nil || !strings.HasPrefix(output, "gc done in ") {
+		t.Fatalf("gc run: %v, %v", output, err)
+	}
+	if !strings.Contains(output, fmt.Sprintf("forced gc:      %v\r\n", ms.NumForcedGC+1)) {
+		t.Fatalf("gc run: %q", output)
+	}
+	// read-only users see the statistics only
+	if _, err := c.Exec(&Session{Level: LevelReadOnly}, []string{"gc"}); err != errPermissionDenied {
+		t.Fatalf("gc as read-only: %v", err)
+	}
+	output, err = c.Exec(session, []string{"gc"})
+	if err != nil || strings.HasPrefix(output, "gc done") || len(strings.Split(output, "\r\n")) != 7 {
+		t.Fatalf("gc: %q, %v", output, err)
+	}
+}
+
+func TestMem(t *testing.T) {
+	output, err := New().Exec(&Session{Level: LevelReadOnly}, []string{"mem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(output, "\r\n")
+	if len(lines) != 15 || !strings.HasPrefix(lines[0], "alloc: ") || !strings.HasPrefix(lines[14], "num gc: ") {
+		t.Fatalf("mem: %q", output)
+	}
+	for _, test := range []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{5 << 30, "5.0 GiB"},
+	} {
+		if s := formatBytes(test.n); s != test.want {
+			t.Fatalf("formatBytes(%v): %v, want %v", test.n, s, test.want)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	dir := setProfilePath(t)
+	c := New()
+	session := &Session{Level: LevelAdmin}
+	exec := func(args ...string) string {
+		t.Helper()
+		output, err := c.Exec(session, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	usage := new(CommandTrace).usage()
+	if output := exec("trace"); output != usage {
+		t.Fatalf("trace: %v", output)
+	}
+	if output := exec("trace", "restart"); output != usage {
+		t.Fatalf("trace restart: %v", output)
+	}
+	if output := exec("trace", "stop"); output != "tracing not enabled" {
+		t.Fatalf("trace stop: %v", output)
+	}
+
+	fn := exec("trace", "start")
+	if !strings.HasSuffix(fn, ".trace") {
+		t.Skipf("trace start: %v", fn)
+	}
+	// the trace being written is kept
+	if output := exec("trace", "start"); output != "tracing already enabled: "+fn {
+		exec("trace", "stop")
+		t.Fatalf("trace start again: %v", output)
+	}
+	if output := exec("trace", "stop"); output != fn {
+		t.Fatalf("trace stop: %v", output)
+	}
+	if output := exec("trace", "stop"); output != "tracing not enabled" {
+		t.Fatalf("trace stop again: %v", output)
+	}
+
+	// a new trace in the same second gets a new name
+	fn2 := exec("trace", "start")
+	exec("trace", "stop")
+	if !strings.HasSuffix(fn2, ".trace") || fn2 == fn {
+		t.Fatalf("trace start after stop: %v", fn2)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Size() == 0 || files[1].Size() == 0 {
+		t.Fatalf("traces: %v", files)
+	}
+}
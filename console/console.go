@@ -4,87 +4,213 @@ import (
 	"bufio"
 	"github.com/islovingness/leaf/conf"
 	"github.com/islovingness/leaf/network"
+	"io"
 	"math"
+	"net/http"
 	"strconv"
 	"strings"
 	"github.com/islovingness/leaf/log"
 	"os"
+	"sync"
 )
 
-var server *network.TCPServer
+// the console used by the package functions
+var Default = New()
 
-func Init() {
-	go run()
-
-	if conf.ConsolePort != 0 {
-		server = new(network.TCPServer)
-		server.Addr = "localhost:" + strconv.Itoa(conf.ConsolePort)
-		server.MaxConnNum = int(math.MaxInt32)
-		server.PendingWriteNum = 100
-		server.NewAgent = newAgent
-		server.Start()
+// stdin is read by one goroutine for the life of the process
+var stdinRun sync.Once
+
+type Console struct {
+	// 0: no tcp console
+	Port   int
+	Prompt string
+	// commands are read from os.Stdin too, only by the first console initialized
+	Stdin bool
+	// "": no HTTP admin API, see http.go
+	// a loopback address unless a password is set
+	HTTPAddr string
+	// users log in with one of them, both "": no login, everyone is admin
+	AdminPassword    string
+	ReadOnlyPassword string
+	// nil: the log package
+	Logger *log.Logger
+
+	commandsMutex sync.RWMutex
+	commands      []Command
+	levels        map[string]Level
+	server        *network.TCPServer
+	httpServer    *http.Server
+
+	// HTTP logins which failed lately, by client address
+	loginFailuresMutex sync.Mutex
+	loginFailures      map[string]*loginFailure
+}
+
+// wrong passwords allowed before the connection is closed
+const maxLoginAttempts = 3
+
+func New() *Console {
+	c := new(Console)
+	c.Prompt = "Leaf# "
+	c.commands = []Command{
+		&CommandHelp{console: c},
+		new(CommandCPUProf),
+		new(CommandProf),
+		new(CommandReload),
+		new(CommandGoroutines),
+		new(CommandGC),
+		new(CommandMem),
+		new(CommandTrace),
 	}
+	c.levels = map[string]Level{
+		"help":       LevelReadOnly,
+		"goroutines": LevelReadOnly,
+		"mem":        LevelReadOnly,
+	}
+	return c
 }
 
-func run() {
+func (c *Console) Init() {
+	if c.Stdin {
+		stdinRun.Do(func() {
+			go c.run()
+		})
+	}
+
+	if c.Port != 0 {
+		c.server = new(network.TCPServer)
+		c.server.Addr = "localhost:" + strconv.Itoa(c.Port)
+		c.server.MaxConnNum = int(math.MaxInt32)
+		c.server.PendingWriteNum = 100
+		c.server.NewAgent = func(conn *network.TCPConn) network.Agent {
+			return newAgent(c, conn)
+		}
+		c.server.Start()
+	}
+
+	if c.HTTPAddr != "" {
+		err := c.startHTTP()
+		if err != nil {
+			c.Logger.Error("console http: %v", err)
+		}
+	}
+}
+
+func (c *Console) Destroy() {
+	if c.server != nil {
+		c.server.Close()
+		c.server = nil
+	}
+	if c.httpServer != nil {
+		c.httpServer.Close()
+		c.httpServer = nil
+	}
+}
+
+// copies the console settings of conf
+func (c *Console) LoadConf() {
+	c.Port = conf.ConsolePort
+	c.Prompt = conf.ConsolePrompt
+	c.HTTPAddr = conf.ConsoleHTTPAddr
+	c.AdminPassword = conf.ConsoleAdminPassword
+	c.ReadOnlyPassword = conf.ConsoleReadOnlyPassword
+}
+
+// initializes the default console from conf
+func Init() {
+	Default.LoadConf()
+	Default.Stdin = true
+	Default.Init()
+}
+
+func Destroy() {
+	Default.Destroy()
+}
+
+func (c *Console) run() {
 	for {
 		reader := bufio.NewReader(os.Stdin)
 		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
-			log.Error("console ReadString is error: %v", err)
+			c.Logger.Error("console ReadString is error: %v", err)
 			continue
 		}
 		line = strings.TrimSuffix(line[:len(line)-1], "\r")
 
-		args := strings.Fields(line)
+		args := splitLine(line)
 		if len(args) == 0 {
 			continue
 		}
 
+		// whoever owns stdin owns the process
 		name := args[0]
-		c := getCommand(name)
-		if c == nil {
-			log.Error("command not found, try `help` for help\r\n")
+		output, err := c.Exec(&Session{Level: LevelAdmin, Source: "stdin"}, args)
+		if err != nil {
+			c.Logger.Error("%v", err)
 			continue
 		}
-		output := c.run(args[1:])
 		if output != "" {
-			log.Release("%v cmd run result: %v", name, output)
+			c.Logger.Release("%v cmd run result: %v", name, output)
 		}
 	}
 }
 
-func Destroy() {
-	if server != nil {
-		server.Close()
-	}
-}
-
 type Agent struct {
-	conn   *network.TCPConn
-	reader *bufio.Reader
+	console *Console
+	conn    *network.TCPConn
+	editor  *lineEditor
+	level   Level
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
+func newAgent(console *Console, conn *network.TCPConn) network.Agent {
 	a := new(Agent)
+	a.console = console
 	a.conn = conn
-	a.reader = bufio.NewReader(conn)
+	a.editor = newLineEditor(conn.Write, bufio.NewReader(conn), console.complete)
 	return a
 }
 
+func (a *Agent) login() bool {
+	source := a.conn.RemoteAddr().String()
+	for i := 0; i < maxLoginAttempts; i++ {
+		password, err := a.editor.readLine("Password: ", true)
+		if err != nil {
+			return false
+		}
+
+		level, ok := a.console.login(password)
+		if ok {
+			a.console.Logger.Release("console audit: %v [%v] logged in", source, level)
+			a.level = level
+			return true
+		}
+		a.conn.Write([]byte("login incorrect\r\n"))
+	}
+
+	a.console.Logger.Release("console audit: %v login failed", source)
+	return false
+}
+
 func (a *Agent) Run() {
-	for {
-		if conf.ConsolePrompt != "" {
-			a.conn.Write([]byte(conf.ConsolePrompt))
+	a.editor.negotiate()
+	if a.console.authRequired() {
+		if !a.login() {
+			return
 		}
+	} else {
+		a.level = LevelAdmin
+	}
 
-		line, err := a.reader.ReadString('\n')
+	for {
+		line, err := a.editor.readLine(a.console.Prompt, false)
 		if err != nil {
 			break
 		}
-		line = strings.TrimSuffix(line[:len(line)-1], "\r")
 
-		args := strings.Fields(line)
+		args := splitLine(line)
 		if len(args) == 0 {
 			continue
 		}
@@ -92,12 +218,11 @@ func (a *Agent) Run() {
 			break
 		}
 
-		c := getCommand(args[0])
-		if c == nil {
-			a.conn.Write([]byte("command not found, try `help` for help\r\n"))
+		output, err := a.console.Exec(&Session{Level: a.level, Source: a.conn.RemoteAddr().String()}, args)
+		if err != nil {
+			a.conn.Write([]byte(err.Error() + "\r\n"))
 			continue
 		}
-		output := c.run(args[1:])
 		if output != "" {
 			a.conn.Write([]byte(output + "\r\n"))
 		}
@@ -0,0 +1,161 @@
+package console
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/log"
+)
+
+// a logger writing to a file in the returned directory, see readLog
+func newTestLogger(t *testing.T) (*log.Logger, string) {
+	logDir := t.TempDir()
+	logger, err := log.New("release", logDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(logger.Close)
+	return logger, logDir
+}
+
+func readLog(t *testing.T, logDir string) string {
+	t.Helper()
+	files, err := ioutil.ReadDir(logDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("log files: %v, %v", files, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(logDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// a tcp console user sending whole lines, as clients which do not negotiate
+type tcpUser struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialConsole(t *testing.T, c *Console) *tcpUser {
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(c.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return &tcpUser{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// reads up to text, returns what was read
+func (u *tcpUser) expect(text string) string {
+	u.t.Helper()
+	u.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var read []byte
+	for !strings.HasSuffix(string(read), text) {
+		b, err := u.r.ReadByte()
+		if err != nil {
+			u.t.Fatalf("want %q: %v, read %q", text, err, read)
+		}
+		read = append(read, b)
+	}
+	return string(read)
+}
+
+func (u *tcpUser) send(line string) {
+	u.t.Helper()
+	if _, err := u.conn.Write([]byte(line + "\r\n")); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+// the connection is closed by the console
+func (u *tcpUser) closed() bool {
+	u.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := ioutil.ReadAll(u.r)
+	return err == nil
+}
+
+func newTCPConsole(t *testing.T, logger *log.Logger) *Console {
+	port, err := strconv.Atoi(freeAddr(t)[len("127.0.0.1:"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	c.Logger = logger
+	c.Port = port
+	c.AdminPassword = "admin"
+	c.ReadOnlyPassword = "guest"
+	c.RegisterFunc("echo", "says its args", func(args []string) string {
+		return strings.Join(args, " ")
+	})
+	c.Init()
+	t.Cleanup(c.Destroy)
+	return c
+}
+
+func TestTCPLogin(t *testing.T) {
+	logger, logDir := newTestLogger(t)
+	c := newTCPConsole(t, logger)
+
+	// read-only users run read-only commands only
+	guest := dialConsole(t, c)
+	guest.expect("Password: ")
+	guest.send("wrong")
+	guest.expect("login incorrect\r\nPassword: ")
+	guest.send("guest")
+	guest.expect(c.Prompt)
+	guest.send("echo hi")
+	guest.expect(errPermissionDenied.Error() + "\r\n" + c.Prompt)
+	guest.send("help")
+	if output := guest.expect(c.Prompt); !strings.Contains(output, "echo") {
+		t.Fatalf("help: %q", output)
+	}
+	guest.send("quit")
+	if !guest.closed() {
+		t.Fatal("quit: still connected")
+	}
+
+	admin := dialConsole(t, c)
+	admin.expect("Password: ")
+	admin.send("admin")
+	admin.expect(c.Prompt)
+	admin.send("echo hi")
+	admin.expect("hi\r\n" + c.Prompt)
+
+	// the connection is closed after maxLoginAttempts wrong passwords
+	intruder := dialConsole(t, c)
+	for i := 0; i < maxLoginAttempts; i++ {
+		intruder.expect("Password: ")
+		intruder.send("wrong")
+	}
+	if !intruder.closed() {
+		t.Fatal("still connected after the wrong passwords")
+	}
+
+	output := readLog(t, logDir)
+	for _, line := range []string{
+		"console audit: " + guest.conn.LocalAddr().String() + " [read-only] logged in",
+		"console audit: " + guest.conn.LocalAddr().String() + " [read-only] denied: echo hi",
+		"console audit: " + guest.conn.LocalAddr().String() + " [read-only] exec: help",
+		"console audit: " + admin.conn.LocalAddr().String() + " [admin] logged in",
+		"console audit: " + admin.conn.LocalAddr().String() + " [admin] exec: echo hi",
+		"console audit: " + intruder.conn.LocalAddr().String() + " login failed",
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Fatalf("no %q in the log:\n%s", line, output)
+		}
+	}
+	// the wrong password of the guest is not a failed login
+	if strings.Count(output, "login failed") != 1 {
+		t.Fatalf("log:\n%s", output)
+	}
+}
@@ -0,0 +1,221 @@
+package console
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// an address failing maxLoginAttempts HTTP logins in a row is refused that long
+var httpLoginLockout = time.Minute
+
+type loginFailure struct {
+	count int
+	last  time.Time
+}
+
+type commandInfo struct {
+	Name  string `json:"name"`
+	Help  string `json:"help"`
+	Level string `json:"level"`
+}
+
+type execRequest struct {
+	Args []interface{} `json:"args"`
+}
+
+type execResponse struct {
+	Output string      `json:"output,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// the HTTP admin API, served on HTTPAddr:
+//
+//	GET  /commands        [{"name": ..., "help": ..., "level": ...}]
+//	POST /commands/<name> {"args": [...]} -> {"output": ...} or {"result": ...}
+//
+// the args are passed to the commands as words, JSON values other than
+// strings encoded, failures answer {"error": ...}, users authenticate with
+// "Authorization: Bearer <password>" when a password is set, an address
+// failing maxLoginAttempts times in a row is answered 429 for httpLoginLockout
+// without a password everyone is admin, so only a loopback address is served
+func (c *Console) startHTTP() error {
+	ln, err := net.Listen("tcp", c.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); !c.authRequired() && (!ok || !addr.IP.IsLoopback()) {
+		ln.Close()
+		return fmt.Errorf("%v is not a loopback address, a password is required", c.HTTPAddr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/commands", c.handleList)
+	mux.HandleFunc("/commands/", c.handleExec)
+
+	c.httpServer = &http.Server{Handler: mux}
+	go c.httpServer.Serve(ln)
+	return nil
+}
+
+func (c *Console) httpLogin(w http.ResponseWriter, r *http.Request) (Level, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if c.loginLocked(host) {
+		writeJSON(w, http.StatusTooManyRequests, &execResponse{Error: "too many failed logins, try again later"})
+		return 0, false
+	}
+
+	password := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	level, ok := c.login(password)
+	if !ok {
+		if c.loginFailed(host) {
+			c.Logger.Release("console audit: http %v login failed", host)
+		}
+		writeJSON(w, http.StatusUnauthorized, &execResponse{Error: "login incorrect"})
+		return 0, false
+	}
+	c.loginSucceeded(host)
+	return level, true
+}
+
+func (c *Console) loginLocked(host string) bool {
+	c.loginFailuresMutex.Lock()
+	defer c.loginFailuresMutex.Unlock()
+
+	f, ok := c.loginFailures[host]
+	return ok && f.count >= maxLoginAttempts && time.Since(f.last) < httpLoginLockout
+}
+
+// true once host has failed maxLoginAttempts times in a row
+func (c *Console) loginFailed(host string) bool {
+	c.loginFailuresMutex.Lock()
+	defer c.loginFailuresMutex.Unlock()
+
+	now := time.Now()
+	for h, f := range c.loginFailures {
+		if now.Sub(f.last) >= httpLoginLockout {
+			delete(c.loginFailures, h)
+		}
+	}
+	if c.loginFailures == nil {
+		c.loginFailures = make(map[string]*loginFailure)
+	}
+	f, ok := c.loginFailures[host]
+	if !ok {
+		f = new(loginFailure)
+		c.loginFailures[host] = f
+	}
+	f.count++
+	f.last = now
+	return f.count == maxLoginAttempts
+}
+
+func (c *Console) loginSucceeded(host string) {
+	c.loginFailuresMutex.Lock()
+	defer c.loginFailuresMutex.Unlock()
+
+	delete(c.loginFailures, host)
+}
+
+func (c *Console) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &execResponse{Error: "GET required"})
+		return
+	}
+	if _, ok := c.httpLogin(w, r); !ok {
+		return
+	}
+
+	c.commandsMutex.RLock()
+	infos := make([]*commandInfo, len(c.commands))
+	for i, _c := range c.commands {
+		level, ok := c.levels[_c.name()]
+		if !ok {
+			level = LevelAdmin
+		}
+		infos[i] = &commandInfo{Name: _c.name(), Help: _c.help(), Level: level.String()}
+	}
+	c.commandsMutex.RUnlock()
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (c *Console) handleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &execResponse{Error: "POST required"})
+		return
+	}
+	level, ok := c.httpLogin(w, r)
+	if !ok {
+		return
+	}
+
+	req := new(execRequest)
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJSON(w, http.StatusBadRequest, &execResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	// console commands take words
+	args := make([]string, len(req.Args))
+	for i, arg := range req.Args {
+		if s, ok := arg.(string); ok {
+			args[i] = s
+		} else {
+			data, _ := json.Marshal(arg)
+			args[i] = string(data)
+		}
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/commands/")
+	line := strings.Join(append([]string{name}, args...), " ")
+	session := &Session{Level: level, Source: "http " + r.RemoteAddr}
+	_c, err := c.authorize(session, name, line)
+	switch err {
+	case nil:
+	case errCommandNotFound:
+		writeJSON(w, http.StatusNotFound, &execResponse{Error: err.Error()})
+		return
+	default:
+		writeJSON(w, http.StatusForbidden, &execResponse{Error: err.Error()})
+		return
+	}
+
+	// module commands may return any value
+	if ec, ok := _c.(*ExternalCommand); ok {
+		ret, err := ec.call(args)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, &execResponse{Error: err.Error()})
+			return
+		}
+		if output, ok := ret.(string); ok {
+			writeJSON(w, http.StatusOK, &execResponse{Output: output})
+		} else {
+			writeJSON(w, http.StatusOK, &execResponse{Result: ret})
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &execResponse{Output: runCommand(_c, session, args)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data = []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,173 @@
+package console
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/log"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// a console serving HTTP with an "args" module command which describes its args
+// logger nil: the log package
+func newHTTPConsole(t *testing.T, logger *log.Logger, adminPassword string, readOnlyPassword string) *Console {
+	server := chanrpc.NewServer(10)
+	closeSig := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-closeSig:
+				return
+			case ci := <-server.ChanCall:
+				server.Exec(ci)
+			}
+		}
+	}()
+
+	c := New()
+	c.Logger = logger
+	c.HTTPAddr = freeAddr(t)
+	c.AdminPassword = adminPassword
+	c.ReadOnlyPassword = readOnlyPassword
+	c.Register("args", "describes its args", func(args []interface{}) (interface{}, error) {
+		words := make([]string, len(args))
+		for i, arg := range args {
+			words[i] = fmt.Sprintf("%T %v", arg, arg)
+		}
+		return strings.Join(words, ", "), nil
+	}, server)
+	if err := c.startHTTP(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Destroy()
+		close(closeSig)
+		<-done
+	})
+	return c
+}
+
+func post(t *testing.T, c *Console, name string, password string, body string) (int, *execResponse) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+c.HTTPAddr+"/commands/"+name, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "" {
+		req.Header.Set("Authorization", "Bearer "+password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ret := new(execResponse)
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ret
+}
+
+func TestHTTPArgs(t *testing.T) {
+	c := newHTTPConsole(t, nil, "", "")
+
+	// module commands get words from HTTP as from the TCP console
+	want := `string a, string 5, string true, string {"k":1}`
+	status, ret := post(t, c, "args", "", `{"args": ["a", 5, true, {"k": 1}]}`)
+	if status != http.StatusOK || ret.Output != want {
+		t.Fatalf("http: %v %+v", status, ret)
+	}
+	output, err := c.Exec(&Session{Level: LevelAdmin}, []string{"args", "a", "5", "true", `{"k":1}`})
+	if err != nil || output != want {
+		t.Fatalf("exec: %v, %v", output, err)
+	}
+
+	status, ret = post(t, c, "missing", "", `{}`)
+	if status != http.StatusNotFound {
+		t.Fatalf("missing command: %v %+v", status, ret)
+	}
+}
+
+func TestHTTPLogin(t *testing.T) {
+	c := newHTTPConsole(t, nil, "admin", "guest")
+
+	if status, _ := post(t, c, "args", "", `{}`); status != http.StatusUnauthorized {
+		t.Fatalf("no password: %v", status)
+	}
+	if status, _ := post(t, c, "args", "guest", `{}`); status != http.StatusForbidden {
+		t.Fatalf("read-only password: %v", status)
+	}
+	if status, ret := post(t, c, "args", "admin", `{"args": [1]}`); status != http.StatusOK || ret.Output != "string 1" {
+		t.Fatalf("admin password: %v %+v", status, ret)
+	}
+}
+
+func TestHTTPLoginAttempts(t *testing.T) {
+	lockout := httpLoginLockout
+	httpLoginLockout = 200 * time.Millisecond
+	defer func() {
+		httpLoginLockout = lockout
+	}()
+	logger, logDir := newTestLogger(t)
+	c := newHTTPConsole(t, logger, "admin", "guest")
+
+	// a successful login starts the count again
+	for _, password := range []string{"wrong", "wrong", "guest", "wrong", "wrong"} {
+		post(t, c, "help", password, `{}`)
+	}
+	if status, _ := post(t, c, "help", "admin", `{}`); status != http.StatusOK {
+		t.Fatalf("after two failures: %v", status)
+	}
+
+	// the third failure in a row locks the address out, even with the right password
+	for i := 0; i < maxLoginAttempts; i++ {
+		if status, _ := post(t, c, "help", "wrong", `{}`); status != http.StatusUnauthorized {
+			t.Fatalf("failure %v: %v", i, status)
+		}
+	}
+	for _, password := range []string{"wrong", "admin"} {
+		if status, ret := post(t, c, "help", password, `{}`); status != http.StatusTooManyRequests {
+			t.Fatalf("locked out, %v: %v %+v", password, status, ret)
+		}
+	}
+	if output := readLog(t, logDir); strings.Count(output, "console audit: http 127.0.0.1 login failed") != 1 {
+		t.Fatalf("log:\n%s", output)
+	}
+
+	time.Sleep(httpLoginLockout)
+	if status, _ := post(t, c, "help", "admin", `{}`); status != http.StatusOK {
+		t.Fatalf("after the lockout: %v", status)
+	}
+}
+
+func TestHTTPLoopbackOnly(t *testing.T) {
+	c := New()
+	c.HTTPAddr = "0.0.0.0:0"
+	if err := c.startHTTP(); err == nil {
+		c.Destroy()
+		t.Fatal("served every interface without a password")
+	}
+
+	c.AdminPassword = "admin"
+	if err := c.startHTTP(); err != nil {
+		t.Fatal(err)
+	}
+	c.Destroy()
+}
@@ -0,0 +1,357 @@
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// telnet
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetEcho = 1
+	telnetSGA  = 3
+)
+
+const maxHistory = 100
+
+// lineEditor reads lines from a tcp console user, a telnet client which
+// agrees to let the server echo gets line editing, history (up/down) and
+// tab completion, other clients send whole lines as before
+type lineEditor struct {
+	write    func(b []byte)
+	r        *bufio.Reader
+	editing  bool
+	history  []string
+	complete func(words []string) []string
+}
+
+func newLineEditor(write func(b []byte), r *bufio.Reader, complete func(words []string) []string) *lineEditor {
+	e := new(lineEditor)
+	e.write = write
+	e.r = r
+	e.complete = complete
+	return e
+}
+
+// asks telnet clients for character mode
+func (e *lineEditor) negotiate() {
+	e.write([]byte{telnetIAC, telnetWILL, telnetEcho, telnetIAC, telnetWILL, telnetSGA})
+}
+
+// telnet commands are handled and skipped
+func (e *lineEditor) readByte() (byte, error) {
+	for {
+		b, err := e.r.ReadByte()
+		if err != nil || b != telnetIAC {
+			return b, err
+		}
+
+		cmd, err := e.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch cmd {
+		case telnetIAC:
+			return cmd, nil
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			opt, err := e.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if opt == telnetEcho && cmd == telnetDO {
+				e.editing = true
+			} else if opt == telnetEcho && cmd == telnetDONT {
+				e.editing = false
+			}
+		case telnetSB:
+			for {
+				b, err := e.r.ReadByte()
+				if err != nil {
+					return 0, err
+				}
+				if b == telnetIAC {
+					if b, err = e.r.ReadByte(); err != nil || b == telnetSE {
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func (e *lineEditor) readRune() (rune, error) {
+	b, err := e.readByte()
+	if err != nil || b < utf8.RuneSelf {
+		return rune(b), err
+	}
+
+	p := []byte{b}
+	for !utf8.FullRune(p) && len(p) < utf8.UTFMax {
+		b, err := e.readByte()
+		if err != nil {
+			return 0, err
+		}
+		p = append(p, b)
+	}
+	r, _ := utf8.DecodeRune(p)
+	return r, nil
+}
+
+// mask: the input is not echoed and not kept in history
+func (e *lineEditor) readLine(prompt string, mask bool) (string, error) {
+	e.write([]byte(prompt))
+
+	var buf []rune
+	pos := 0
+	hist := len(e.history)
+	saved := ""
+
+	set := func(s string) {
+		buf = []rune(s)
+		pos = len(buf)
+	}
+
+	for {
+		r, err := e.readRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			if r == '\r' {
+				// telnet sends \r\n or \r\0
+				if next, err := e.r.Peek(1); err == nil && (next[0] == '\n' || next[0] == 0) {
+					e.r.ReadByte()
+				}
+			}
+			if e.editing {
+				e.write([]byte("\r\n"))
+			}
+			line := string(buf)
+			if !mask && strings.TrimSpace(line) != "" &&
+				(len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+				e.history = append(e.history, line)
+				if len(e.history) > maxHistory {
+					e.history = e.history[1:]
+				}
+			}
+			return line, nil
+		case 0x03: // ctrl-c
+			if e.editing {
+				e.write([]byte("^C\r\n" + prompt))
+			}
+			set("")
+			continue
+		case 0x04: // ctrl-d
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+		case 0x7f, 0x08: // backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 0x01: // ctrl-a
+			pos = 0
+		case 0x05: // ctrl-e
+			pos = len(buf)
+		case 0x0b: // ctrl-k
+			buf = buf[:pos]
+		case 0x15: // ctrl-u
+			buf = buf[pos:]
+			pos = 0
+		case '\t':
+			if !e.editing || mask {
+				buf = append(buf[:pos], append([]rune{' '}, buf[pos:]...)...)
+				pos++
+				break
+			}
+			e.tab(&buf, &pos, prompt)
+		case 0x1b:
+			key, err := e.readEscape()
+			if err != nil {
+				return "", err
+			}
+			switch key {
+			case 'A': // up
+				if hist > 0 {
+					if hist == len(e.history) {
+						saved = string(buf)
+					}
+					hist--
+					set(e.history[hist])
+				}
+			case 'B': // down
+				if hist < len(e.history) {
+					hist++
+					if hist == len(e.history) {
+						set(saved)
+					} else {
+						set(e.history[hist])
+					}
+				}
+			case 'C': // right
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D': // left
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '~': // delete
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+		}
+
+		if e.editing && !mask {
+			e.redraw(prompt, buf, pos)
+		}
+	}
+}
+
+// the final byte of ESC [ ... or ESC O ..., '~' for ESC [ 3 ~
+func (e *lineEditor) readEscape() (byte, error) {
+	b, err := e.readByte()
+	if err != nil || b != '[' && b != 'O' {
+		return 0, err
+	}
+	for {
+		b, err = e.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if b >= 0x40 && b <= 0x7e {
+			return b, nil
+		}
+	}
+}
+
+func (e *lineEditor) redraw(prompt string, buf []rune, pos int) {
+	s := "\r" + prompt + string(buf) + "\x1b[K"
+	if pos < len(buf) {
+		s += fmt.Sprintf("\x1b[%dD", len(buf)-pos)
+	}
+	e.write([]byte(s))
+}
+
+func (e *lineEditor) tab(buf *[]rune, pos *int, prompt string) {
+	if e.complete == nil {
+		return
+	}
+
+	line := string((*buf)[:*pos])
+	words := splitLine(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	partial := words[len(words)-1]
+
+	candidates := e.complete(words)
+	if len(candidates) == 0 {
+		e.write([]byte("\a"))
+		return
+	}
+
+	insert := commonPrefix(candidates)[len(partial):]
+	if len(candidates) == 1 {
+		insert += " "
+	} else if insert == "" {
+		e.write([]byte("\r\n" + strings.Join(candidates, "  ") + "\r\n"))
+	}
+
+	rs := []rune(insert)
+	*buf = append((*buf)[:*pos], append(rs, (*buf)[*pos:]...)...)
+	*pos += len(rs)
+}
+
+func commonPrefix(ss []string) string {
+	prefix := ss[0]
+	for _, s := range ss[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// splits a command line into words, "double" or 'single' quotes keep spaces
+func splitLine(line string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+type completer interface {
+	// words are the arguments, the last one is being completed
+	complete(words []string) []string
+}
+
+// candidates for the last word of a command line
+func (c *Console) complete(words []string) []string {
+	if len(words) == 1 {
+		c.commandsMutex.RLock()
+		names := make([]string, 0, len(c.commands)+1)
+		for _, _c := range c.commands {
+			names = append(names, _c.name())
+		}
+		c.commandsMutex.RUnlock()
+
+		return filterPrefix(append(names, "quit"), words[0])
+	}
+
+	if _c, ok := c.getCommand(words[0]).(completer); ok {
+		return _c.complete(words[1:])
+	}
+	return nil
+}
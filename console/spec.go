@@ -0,0 +1,426 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"github.com/islovingness/leaf/chanrpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errHelp = errors.New("help requested")
+
+type ArgType int
+
+const (
+	TypeString ArgType = iota
+	TypeInt
+	TypeFloat
+	TypeBool
+	TypeDuration
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt:
+		return "int"
+	case TypeFloat:
+		return "float"
+	case TypeBool:
+		return "bool"
+	case TypeDuration:
+		return "duration"
+	default:
+		return "unknown"
+	}
+}
+
+func (t ArgType) parse(s string) (interface{}, error) {
+	switch t {
+	case TypeInt:
+		return strconv.Atoi(s)
+	case TypeFloat:
+		return strconv.ParseFloat(s, 64)
+	case TypeBool:
+		return strconv.ParseBool(s)
+	case TypeDuration:
+		return time.ParseDuration(s)
+	default:
+		return s, nil
+	}
+}
+
+// --name value, --name=value or -s value, bool flags take no value
+type Flag struct {
+	Name    string
+	Short   string
+	Type    ArgType
+	Default interface{}
+	Usage   string
+}
+
+// positional argument, the last one may be Variadic
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	Variadic bool
+	Usage    string
+}
+
+// Spec declares a command, its usage is generated from the spec and
+// its input is parsed and checked before Run is called
+type Spec struct {
+	Name        string
+	Help        string
+	Flags       []*Flag
+	Args        []*Arg
+	Subcommands []*Spec
+	// a spec with subcommands may have no Run, its usage is shown instead
+	Run func(args *Args) string
+}
+
+// parsed input of a Spec
+type Args struct {
+	// the subcommand names after the command name
+	Path       []string
+	flags      map[string]interface{}
+	positional map[string]interface{}
+	rest       []interface{}
+}
+
+func (a *Args) value(name string) interface{} {
+	if v, ok := a.flags[name]; ok {
+		return v
+	}
+	return a.positional[name]
+}
+
+// whether the flag or the argument has a value, given or default
+func (a *Args) Has(name string) bool {
+	if _, ok := a.flags[name]; ok {
+		return true
+	}
+	_, ok := a.positional[name]
+	return ok
+}
+
+func (a *Args) String(name string) string {
+	v, _ := a.value(name).(string)
+	return v
+}
+
+func (a *Args) Int(name string) int {
+	v, _ := a.value(name).(int)
+	return v
+}
+
+func (a *Args) Float(name string) float64 {
+	v, _ := a.value(name).(float64)
+	return v
+}
+
+func (a *Args) Bool(name string) bool {
+	v, _ := a.value(name).(bool)
+	return v
+}
+
+func (a *Args) Duration(name string) time.Duration {
+	v, _ := a.value(name).(time.Duration)
+	return v
+}
+
+// values of the variadic argument
+func (a *Args) Rest() []interface{} {
+	return a.rest
+}
+
+func (spec *Spec) subcommand(name string) *Spec {
+	for _, sub := range spec.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (spec *Spec) flag(name string) *Flag {
+	for _, f := range spec.Flags {
+		if f.Name == name || f.Short != "" && f.Short == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// finds the subcommand named by the leading words
+func (spec *Spec) resolve(words []string) (*Spec, []string, []string) {
+	var path []string
+	for len(words) > 0 {
+		sub := spec.subcommand(words[0])
+		if sub == nil {
+			break
+		}
+		spec = sub
+		path = append(path, words[0])
+		words = words[1:]
+	}
+	return spec, path, words
+}
+
+func (spec *Spec) parse(words []string) (*Spec, *Args, error) {
+	spec, path, words := spec.resolve(words)
+	args := &Args{
+		Path:       path,
+		flags:      make(map[string]interface{}),
+		positional: make(map[string]interface{}),
+	}
+	for _, f := range spec.Flags {
+		if f.Default != nil {
+			args.flags[f.Name] = f.Default
+		}
+	}
+
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			positional = append(positional, words[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(word, "-") || len(word) == 1 || isNegative(word) {
+			positional = append(positional, word)
+			continue
+		}
+
+		name := strings.TrimLeft(word, "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		f := spec.flag(name)
+		if f == nil && (name == "help" || name == "h") {
+			return spec, nil, errHelp
+		}
+		if f == nil {
+			return spec, nil, fmt.Errorf("unknown flag %v", word)
+		}
+		if !hasValue {
+			if f.Type == TypeBool {
+				value = "true"
+			} else if i+1 < len(words) {
+				i++
+				value = words[i]
+			} else {
+				return spec, nil, fmt.Errorf("flag --%v needs a %v value", f.Name, f.Type)
+			}
+		}
+		v, err := f.Type.parse(value)
+		if err != nil {
+			return spec, nil, fmt.Errorf("flag --%v: invalid %v %q", f.Name, f.Type, value)
+		}
+		args.flags[f.Name] = v
+	}
+
+	for i, a := range spec.Args {
+		if i >= len(positional) {
+			if !a.Optional && !a.Variadic {
+				return spec, nil, fmt.Errorf("missing argument <%v>", a.Name)
+			}
+			break
+		}
+
+		values := positional[i : i+1]
+		if a.Variadic {
+			values = positional[i:]
+		}
+		for _, s := range values {
+			v, err := a.Type.parse(s)
+			if err != nil {
+				return spec, nil, fmt.Errorf("argument <%v>: invalid %v %q", a.Name, a.Type, s)
+			}
+			if a.Variadic {
+				args.rest = append(args.rest, v)
+			} else {
+				args.positional[a.Name] = v
+			}
+		}
+	}
+	if len(positional) > len(spec.Args) && (len(spec.Args) == 0 || !spec.Args[len(spec.Args)-1].Variadic) {
+		if len(spec.Subcommands) > 0 {
+			return spec, nil, fmt.Errorf("unknown subcommand %v", positional[0])
+		}
+		return spec, nil, fmt.Errorf("too many arguments")
+	}
+
+	return spec, args, nil
+}
+
+// -5, -1.5 or -2s are values, not flags
+func isNegative(word string) bool {
+	if c := word[1]; (c < '0' || c > '9') && c != '.' {
+		return false
+	}
+	if _, err := strconv.ParseFloat(word, 64); err == nil {
+		return true
+	}
+	_, err := time.ParseDuration(word)
+	return err == nil
+}
+
+// generated from the spec, path is the command line up to spec
+func (spec *Spec) usage(path string) string {
+	line := "Usage: " + path
+	if len(spec.Subcommands) > 0 {
+		line += " <subcommand>"
+	}
+	if len(spec.Flags) > 0 {
+		line += " [flags]"
+	}
+	for _, a := range spec.Args {
+		name := a.Name
+		if a.Variadic {
+			name += "..."
+		}
+		if a.Optional || a.Variadic {
+			line += " [" + name + "]"
+		} else {
+			line += " <" + name + ">"
+		}
+	}
+
+	lines := []string{}
+	if spec.Help != "" {
+		lines = append(lines, spec.Help, "")
+	}
+	lines = append(lines, line)
+
+	if len(spec.Subcommands) > 0 {
+		lines = append(lines, "Subcommands:")
+		for _, sub := range spec.Subcommands {
+			lines = append(lines, strings.TrimRight(fmt.Sprintf("  %-16v %v", sub.Name, sub.Help), " "))
+		}
+	}
+	if len(spec.Args) > 0 {
+		lines = append(lines, "Arguments:")
+		for _, a := range spec.Args {
+			lines = append(lines, strings.TrimRight(fmt.Sprintf("  %-16v %-8v %v", a.Name, a.Type, a.Usage), " "))
+		}
+	}
+	if len(spec.Flags) > 0 {
+		lines = append(lines, "Flags:")
+		for _, f := range spec.Flags {
+			name := "--" + f.Name
+			if f.Short != "" {
+				name = "-" + f.Short + ", " + name
+			}
+			usage := f.Usage
+			if f.Default != nil {
+				usage = strings.TrimSpace(usage + fmt.Sprintf(" (default %v)", f.Default))
+			}
+			lines = append(lines, strings.TrimRight(fmt.Sprintf("  %-16v %-8v %v", name, f.Type, usage), " "))
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// candidates for the last word of words
+func (spec *Spec) complete(words []string) []string {
+	spec, _, rest := spec.resolve(words[:len(words)-1])
+	partial := words[len(words)-1]
+
+	var candidates []string
+	if strings.HasPrefix(partial, "-") {
+		for _, f := range spec.Flags {
+			candidates = append(candidates, "--"+f.Name)
+		}
+	} else if len(rest) == 0 {
+		for _, sub := range spec.Subcommands {
+			candidates = append(candidates, sub.Name)
+		}
+	}
+	return filterPrefix(candidates, partial)
+}
+
+func filterPrefix(candidates []string, prefix string) []string {
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+type SpecCommand struct {
+	spec   *Spec
+	server *chanrpc.Server
+}
+
+func (c *SpecCommand) name() string {
+	return c.spec.Name
+}
+
+func (c *SpecCommand) help() string {
+	return c.spec.Help
+}
+
+func (c *SpecCommand) run(words []string) string {
+	spec, args, err := c.spec.parse(words)
+	_, path, _ := c.spec.resolve(words)
+	path = append([]string{c.spec.Name}, path...)
+	if err == errHelp || err == nil && spec.Run == nil {
+		return spec.usage(strings.Join(path, " "))
+	}
+	if err != nil {
+		return "error: " + err.Error() + "\r\n" + spec.usage(strings.Join(path, " "))
+	}
+	if c.server == nil {
+		return spec.Run(args)
+	}
+	ret, err := c.server.Call1(c.spec.Name, spec, args)
+	if err != nil {
+		return err.Error()
+	}
+	output, _ := ret.(string)
+	return output
+}
+
+func (c *SpecCommand) complete(words []string) []string {
+	return c.spec.complete(words)
+}
+
+// spec.Run is called on the goroutine serving server, or on the console
+// goroutine if server is nil
+// goroutine safe
+func (c *Console) RegisterSpec(spec *Spec, server *chanrpc.Server) {
+	if spec.Name == "" {
+		panic("console: spec without name")
+	}
+
+	c.commandsMutex.Lock()
+	defer c.commandsMutex.Unlock()
+
+	for _, _c := range c.commands {
+		if _c.name() == spec.Name {
+			c.Logger.Fatal("command %v is already registered", spec.Name)
+		}
+	}
+
+	if server != nil {
+		server.Register(spec.Name, func(args []interface{}) (interface{}, error) {
+			return args[0].(*Spec).Run(args[1].(*Args)), nil
+		})
+	}
+	c.commands = append(c.commands, &SpecCommand{spec: spec, server: server})
+}
+
+// goroutine safe
+func RegisterSpec(spec *Spec, server *chanrpc.Server) {
+	Default.RegisterSpec(spec, server)
+}
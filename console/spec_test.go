@@ -0,0 +1,152 @@
+package console
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSpec() *Spec {
+	run := func(args *Args) string { return "done" }
+	return &Spec{
+		Name: "player",
+		Help: "manage players",
+		Subcommands: []*Spec{
+			{
+				Name: "kick",
+				Help: "kick a player",
+				Flags: []*Flag{
+					{Name: "reason", Short: "r", Type: TypeString, Default: "none"},
+					{Name: "ban", Type: TypeBool},
+					{Name: "for", Type: TypeDuration},
+				},
+				Args: []*Arg{{Name: "id", Type: TypeInt}},
+				Run:  run,
+			},
+			{
+				Name:  "give",
+				Flags: []*Flag{{Name: "count", Short: "n", Type: TypeInt, Default: 1}},
+				Args: []*Arg{
+					{Name: "item", Type: TypeString},
+					{Name: "amounts", Type: TypeInt, Variadic: true},
+				},
+				Run: run,
+			},
+			{
+				Name: "move",
+				Args: []*Arg{
+					{Name: "x", Type: TypeFloat},
+					{Name: "y", Type: TypeFloat},
+					{Name: "z", Type: TypeFloat, Optional: true},
+				},
+				Run: run,
+			},
+		},
+	}
+}
+
+func TestSpecParse(t *testing.T) {
+	tests := []struct {
+		words  string
+		path   []string
+		values map[string]interface{}
+		rest   []interface{}
+		err    string
+	}{
+		// flags
+		{words: "kick 12", path: []string{"kick"}, values: map[string]interface{}{"id": 12, "reason": "none"}},
+		{
+			words:  "kick -r spam --ban --for=1m 12",
+			path:   []string{"kick"},
+			values: map[string]interface{}{"id": 12, "reason": "spam", "ban": true, "for": time.Minute},
+		},
+		{words: "kick --reason=a=b 12", path: []string{"kick"}, values: map[string]interface{}{"reason": "a=b"}},
+		{words: "kick 12 --ban=false", path: []string{"kick"}, values: map[string]interface{}{"ban": false}},
+		{words: "kick 12 --reason", err: "flag --reason needs a string value"},
+		{words: "kick --for soon 12", err: `flag --for: invalid duration "soon"`},
+		{words: "kick --force 12", err: "unknown flag --force"},
+		{words: "kick", err: "missing argument <id>"},
+		{words: "kick 12 13", err: "too many arguments"},
+
+		// --
+		{words: "kick -- 12", path: []string{"kick"}, values: map[string]interface{}{"id": 12}},
+		{words: "kick -- --ban", err: `argument <id>: invalid int "--ban"`},
+		{words: "give -- -n", path: []string{"give"}, values: map[string]interface{}{"item": "-n", "count": 1}},
+		{words: "give -- -n -r", err: `argument <amounts>: invalid int "-r"`},
+
+		// negative numbers
+		{words: "kick -5", path: []string{"kick"}, values: map[string]interface{}{"id": -5}},
+		{words: "kick --ban -5", path: []string{"kick"}, values: map[string]interface{}{"id": -5, "ban": true}},
+		{words: "kick --for -2s 1", path: []string{"kick"}, values: map[string]interface{}{"for": -2 * time.Second}},
+		{words: "give -n -3 sword", path: []string{"give"}, values: map[string]interface{}{"count": -3, "item": "sword"}},
+		{words: "give --count=-3 sword", path: []string{"give"}, values: map[string]interface{}{"count": -3}},
+		{words: "move 1.5 -2.5", path: []string{"move"}, values: map[string]interface{}{"x": 1.5, "y": -2.5}},
+		{words: "move -1e3 -.5 -7", path: []string{"move"}, values: map[string]interface{}{"x": -1000.0, "y": -0.5, "z": -7.0}},
+
+		// variadic
+		{words: "give sword", path: []string{"give"}, values: map[string]interface{}{"item": "sword", "count": 1}},
+		{words: "give sword 1 2 3", path: []string{"give"}, rest: []interface{}{1, 2, 3}},
+		{words: "give sword -1 -n 2 -2", path: []string{"give"}, values: map[string]interface{}{"count": 2}, rest: []interface{}{-1, -2}},
+		{words: "give sword 1 x", err: `argument <amounts>: invalid int "x"`},
+
+		// subcommands
+		{words: "", path: nil},
+		{words: "fly", err: "unknown subcommand fly"},
+		{words: "move 1", err: "missing argument <y>"},
+
+		// help
+		{words: "kick --help", err: errHelp.Error()},
+		{words: "give -h", err: errHelp.Error()},
+		{words: "-h", err: errHelp.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.words, func(t *testing.T) {
+			_, args, err := newTestSpec().parse(strings.Fields(test.words))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(args.Path, test.path) {
+				t.Fatalf("path %v, want %v", args.Path, test.path)
+			}
+			for name, want := range test.values {
+				if v := args.value(name); v != want {
+					t.Fatalf("%v: %v (%T), want %v (%T)", name, v, v, want, want)
+				}
+			}
+			if !reflect.DeepEqual(args.Rest(), test.rest) {
+				t.Fatalf("rest %v, want %v", args.Rest(), test.rest)
+			}
+		})
+	}
+}
+
+func TestSpecRun(t *testing.T) {
+	tests := []struct {
+		words string
+		want  []string
+	}{
+		{words: "kick 12", want: []string{"done"}},
+		{words: "kick --help", want: []string{"kick a player", "Usage: player kick [flags] <id>", "-r, --reason", "(default none)"}},
+		{words: "", want: []string{"manage players", "Usage: player <subcommand>", "Subcommands:", "kick"}},
+		{words: "give", want: []string{"error: missing argument <item>", "Usage: player give [flags] <item> [amounts...]"}},
+	}
+
+	c := &SpecCommand{spec: newTestSpec()}
+	for _, test := range tests {
+		output := c.run(strings.Fields(test.words))
+		for _, want := range test.want {
+			if !strings.Contains(output, want) {
+				t.Fatalf("%q: %q not in\n%v", test.words, want, output)
+			}
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package gate
 
 import (
+	"fmt"
 	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/console"
 	"github.com/islovingness/leaf/log"
 	"github.com/islovingness/leaf/network"
 	"net"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/islovingness/leaf/module"
 )
@@ -35,17 +41,41 @@ type Gate struct {
 	ChanRPCLen         int
 	OnAgentInit 	   func(Agent)
 	OnAgentDestroy 	   func(Agent)
+
+	// the "conns" command is registered there, nil: console.Default
+	Console *console.Console
+	// nil: the log package
+	Logger *log.Logger
+
+	listening   int32
+	agentsMutex sync.Mutex
+	agents      map[*agent]struct{}
 }
 
+// gates sharing a console share its "conns" command
+var (
+	consoleGatesMutex sync.Mutex
+	consoleGates      = make(map[*console.Console][]*Gate)
+)
+
 func (gate *Gate) Run(closeSig chan bool) {
+	gate.agents = make(map[*agent]struct{})
+	gate.registerCommand()
+	defer gate.unregisterCommand()
+
 	newAgent := func(conn network.Conn) network.Agent {
-		a := &agent{conn: conn, gate: gate}
+		a := &agent{conn: conn, gate: gate, connectedAt: time.Now()}
+		gate.agentsMutex.Lock()
+		gate.agents[a] = struct{}{}
+		gate.agentsMutex.Unlock()
 		if gate.ChanRPCLen > 0 {
 			skeleton := &module.Skeleton{
 				GoLen:              gate.GoLen,
 				TimerDispatcherLen: gate.TimerDispatcherLen,
 				AsynCallLen:        gate.AsynCallLen,
 				ChanRPCServer:      chanrpc.NewServer(gate.ChanRPCLen),
+				Console:            gate.Console,
+				Logger:             gate.Logger,
 			}
 			skeleton.Init()
 
@@ -93,7 +123,9 @@ func (gate *Gate) Run(closeSig chan bool) {
 	if tcpServer != nil {
 		tcpServer.Start()
 	}
+	atomic.StoreInt32(&gate.listening, 1)
 	<-closeSig
+	atomic.StoreInt32(&gate.listening, 0)
 	if wsServer != nil {
 		wsServer.Close()
 	}
@@ -104,19 +136,125 @@ func (gate *Gate) Run(closeSig chan bool) {
 
 func (gate *Gate) OnDestroy() {}
 
+// the console and the logger set are kept, see module.AppModule
+func (gate *Gate) SetApp(c *console.Console, logger *log.Logger) {
+	if gate == nil {
+		return
+	}
+	if gate.Console == nil {
+		gate.Console = c
+	}
+	if gate.Logger == nil {
+		gate.Logger = logger
+	}
+}
+
+func (gate *Gate) registerCommand() {
+	if gate.Console == nil {
+		gate.Console = console.Default
+	}
+
+	consoleGatesMutex.Lock()
+	defer consoleGatesMutex.Unlock()
+
+	gates := consoleGates[gate.Console]
+	if len(gates) == 0 {
+		c := gate.Console
+		c.RegisterFunc("conns", "lists the client connections", func(args []string) string {
+			return commandConns(c, args)
+		})
+		c.SetLevel("conns", console.LevelReadOnly)
+	}
+	consoleGates[gate.Console] = append(gates, gate)
+}
+
+func (gate *Gate) unregisterCommand() {
+	consoleGatesMutex.Lock()
+	defer consoleGatesMutex.Unlock()
+
+	gates := consoleGates[gate.Console]
+	for i, g := range gates {
+		if g == gate {
+			gates = append(gates[:i], gates[i+1:]...)
+			break
+		}
+	}
+	if len(gates) > 0 {
+		consoleGates[gate.Console] = gates
+		return
+	}
+	delete(consoleGates, gate.Console)
+	gate.Console.Unregister("conns")
+}
+
+func commandConns(c *console.Console, args []string) string {
+	max := 100
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return "Usage: conns [max]"
+		}
+		max = n
+	}
+
+	consoleGatesMutex.Lock()
+	var agents []*agent
+	for _, gate := range consoleGates[c] {
+		gate.agentsMutex.Lock()
+		for a := range gate.agents {
+			agents = append(agents, a)
+		}
+		gate.agentsMutex.Unlock()
+	}
+	consoleGatesMutex.Unlock()
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].connectedAt.Before(agents[j].connectedAt)
+	})
+
+	output := fmt.Sprintf("conns: %v", len(agents))
+	if len(agents) > max {
+		output += fmt.Sprintf(" (showing %v)", max)
+		agents = agents[:max]
+	}
+	output += fmt.Sprintf("\r\n%-22v %-22v %-12v %-20v %v", "REMOTE", "LOCAL", "CONNECTED", "IN (MSGS/BYTES)", "OUT (MSGS/BYTES)")
+	now := time.Now()
+	for _, a := range agents {
+		output += fmt.Sprintf("\r\n%-22v %-22v %-12v %-20v %v",
+			a.RemoteAddr(), a.LocalAddr(),
+			now.Sub(a.connectedAt).Truncate(time.Second),
+			fmt.Sprintf("%v/%v", atomic.LoadInt64(&a.msgsIn), atomic.LoadInt64(&a.bytesIn)),
+			fmt.Sprintf("%v/%v", atomic.LoadInt64(&a.msgsOut), atomic.LoadInt64(&a.bytesOut)))
+	}
+	return output
+}
+
+// true while the gate is listening, see module.ReadyModule
+func (gate *Gate) Ready() bool {
+	return atomic.LoadInt32(&gate.listening) == 1
+}
+
 type agent struct {
+	// traffic, accessed atomically
+	msgsIn   int64
+	bytesIn  int64
+	msgsOut  int64
+	bytesOut int64
+
 	conn     network.Conn
 	skeleton *module.Skeleton
 	chanRPC  *chanrpc.Server
 	gate     *Gate
 	userData interface{}
+
+	connectedAt time.Time
 }
 
 func (a *agent) Run() {
 	closeSig := make(chan bool, 1)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Recover(r)
+			a.gate.Logger.Recover(r)
 		}
 
 		closeSig <- true
@@ -142,7 +280,7 @@ func (a *agent) Run() {
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Recover(r)
+					a.gate.Logger.Recover(r)
 				}
 
 				if a.gate.OnAgentDestroy != nil {
@@ -163,9 +301,11 @@ func (a *agent) Run() {
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
-			log.Debug("read message: %v", err)
+			a.gate.Logger.Debug("read message: %v", err)
 			break
 		}
+		atomic.AddInt64(&a.msgsIn, 1)
+		atomic.AddInt64(&a.bytesIn, int64(len(data)))
 
 		if a.chanRPC == nil {
 			err = handleMsgData([]interface{}{data})
@@ -173,17 +313,21 @@ func (a *agent) Run() {
 			err = a.chanRPC.Call0("handleMsgData", data)
 		}
 		if err != nil {
-			log.Debug("handle message: %v", err)
+			a.gate.Logger.Debug("handle message: %v", err)
 			break
 		}
 	}
 }
 
 func (a *agent) OnClose() {
+	a.gate.agentsMutex.Lock()
+	delete(a.gate.agents, a)
+	a.gate.agentsMutex.Unlock()
+
 	if a.gate.AgentChanRPC != nil {
 		err := a.gate.AgentChanRPC.Call0("CloseAgent", a)
 		if err != nil {
-			log.Error("chanrpc error: %v", err)
+			a.gate.Logger.Error("chanrpc error: %v", err)
 		}
 	}
 }
@@ -192,12 +336,17 @@ func (a *agent) WriteMsg(msg interface{}) {
 	if a.gate.Processor != nil {
 		data, err := a.gate.Processor.Marshal(msg)
 		if err != nil {
-			log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+			a.gate.Logger.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
 			return
 		}
 		err = a.conn.WriteMsg(data...)
 		if err != nil {
-			log.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+			a.gate.Logger.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+			return
+		}
+		atomic.AddInt64(&a.msgsOut, 1)
+		for _, b := range data {
+			atomic.AddInt64(&a.bytesOut, int64(len(b)))
 		}
 	}
 }
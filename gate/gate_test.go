@@ -0,0 +1,128 @@
+package gate
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/console"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// runs a tcp gate until the returned function is called
+func runGate(t *testing.T, c *console.Console) (*Gate, func()) {
+	gate := &Gate{
+		MaxConnNum:      10,
+		PendingWriteNum: 10,
+		MaxMsgLen:       1024,
+		TCPAddr:         freeAddr(t),
+		LenMsgLen:       2,
+		Console:         c,
+	}
+	closeSig := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		gate.Run(closeSig)
+		close(done)
+	}()
+	for !gate.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	var closed bool
+	stop := func() {
+		if !closed {
+			closed = true
+			closeSig <- true
+			<-done
+		}
+	}
+	t.Cleanup(stop)
+	return gate, stop
+}
+
+// sends one message of n bytes
+func dialGate(t *testing.T, gate *Gate, n int) net.Conn {
+	conn, err := net.Dial("tcp", gate.TCPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	msg := append([]byte{byte(n >> 8), byte(n)}, make([]byte, n)...)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestConns(t *testing.T) {
+	c := console.New()
+	session := &console.Session{Level: console.LevelReadOnly}
+	exec := func(args ...string) string {
+		t.Helper()
+		output, err := c.Exec(session, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	// gates sharing a console share the command
+	gate1, stop1 := runGate(t, c)
+	gate2, stop2 := runGate(t, c)
+	conn1 := dialGate(t, gate1, 5)
+	conn2 := dialGate(t, gate2, 7)
+
+	var output string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		output = exec("conns")
+		if strings.Contains(output, "1/5") && strings.Contains(output, "1/7") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("conns: %q", output)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	lines := strings.Split(output, "\r\n")
+	if len(lines) != 4 || lines[0] != "conns: 2" || !strings.HasPrefix(lines[1], "REMOTE") {
+		t.Fatalf("conns: %q", output)
+	}
+	// the oldest first
+	for i, conn := range []net.Conn{conn1, conn2} {
+		fields := strings.Fields(lines[i+2])
+		if len(fields) != 5 || fields[0] != conn.LocalAddr().String() || fields[1] != conn.RemoteAddr().String() || fields[4] != "0/0" {
+			t.Fatalf("conns: %q", output)
+		}
+	}
+
+	if output := exec("conns", "1"); !strings.HasPrefix(output, "conns: 2 (showing 1)\r\n") || len(strings.Split(output, "\r\n")) != 3 {
+		t.Fatalf("conns 1: %q", output)
+	}
+	for _, arg := range []string{"0", "x"} {
+		if output := exec("conns", arg); output != "Usage: conns [max]" {
+			t.Fatalf("conns %v: %q", arg, output)
+		}
+	}
+
+	// the command goes with the last gate
+	stop1()
+	if output := exec("conns"); !strings.HasPrefix(output, "conns: 1\r\n") {
+		t.Fatalf("conns after a gate closed: %q", output)
+	}
+	stop2()
+	if _, err := c.Exec(session, []string{"conns"}); err == nil {
+		t.Fatal("conns registered after the gates closed")
+	}
+}
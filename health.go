@@ -0,0 +1,63 @@
+package leaf
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serves GET /readyz and /livez on HealthAddr, 200 "ok" or 503 with the reason
+func (app *App) startHealth() (*http.Server, error) {
+	ln, err := net.Listen("tcp", app.HealthAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, app.ready())
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, app.alive())
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return server, nil
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// modules initialized and ready, cluster connected and not closing down
+func (app *App) ready() error {
+	if atomic.LoadInt32(&app.state) != appRunning {
+		return fmt.Errorf("leaf is not running")
+	}
+	if err := app.Modules.Ready(); err != nil {
+		return err
+	}
+	return app.Cluster.Ready()
+}
+
+// no module stalled, the modules are not asked until they run as
+// the manager is locked while they are initialized
+func (app *App) alive() error {
+	if atomic.LoadInt32(&app.state) == appStopped {
+		return nil
+	}
+	stallTimeout := app.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = 60 * time.Second
+	}
+	return app.Modules.Alive(stallTimeout)
+}
@@ -0,0 +1,169 @@
+package leaf
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/cluster"
+	"github.com/islovingness/leaf/log"
+	"github.com/islovingness/leaf/module"
+)
+
+type healthModule struct {
+	*module.Skeleton
+	onInit func()
+}
+
+func (m *healthModule) OnInit() {
+	if m.onInit != nil {
+		m.onInit()
+	}
+}
+
+func (m *healthModule) OnDestroy() {}
+
+func newHealthModule(onInit func()) *healthModule {
+	skeleton := &module.Skeleton{ChanRPCServer: chanrpc.NewServer(10)}
+	skeleton.Init()
+	return &healthModule{Skeleton: skeleton, onInit: onInit}
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// the test app cannot close before f is called, even if the test fails
+func onceFunc(f func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(f)
+	}
+}
+
+// runs app with the health endpoints until the test ends, returns their address
+func runHealthApp(t *testing.T, app *App, mods ...module.Module) string {
+	logger, err := log.New("release", t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Logger = logger
+	app.HealthAddr = freeAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.RunContext(ctx, mods...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		logger.Close()
+	})
+	return app.HealthAddr
+}
+
+// waits until GET path answers status with a body containing text
+func waitHealth(t *testing.T, addr string, path string, status int, text string) {
+	t.Helper()
+	var body string
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get("http://" + addr + path)
+		if err == nil {
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			body = string(data)
+			if resp.StatusCode == status && strings.Contains(body, text) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%v: want %v %q, last body %q", path, status, text, body)
+}
+
+func TestHealthInit(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	unblock := onceFunc(func() { close(release) })
+	defer unblock()
+	addr := runHealthApp(t, NewApp(), newHealthModule(func() {
+		<-release
+	}))
+
+	// alive but not ready while the modules are initialized
+	waitHealth(t, addr, "/readyz", http.StatusServiceUnavailable, "leaf is not running")
+	waitHealth(t, addr, "/livez", http.StatusOK, "ok")
+
+	unblock()
+	waitHealth(t, addr, "/readyz", http.StatusOK, "ok")
+}
+
+func TestHealthClusterPeer(t *testing.T) {
+	t.Parallel()
+	peer := cluster.New(nil)
+	peer.ServerName = "game2"
+	peer.ListenAddr = freeAddr(t)
+	peer.HeartBeatInterval = time.Minute
+	peer.HeartBeatMissTimes = 1
+	// closed after the app, which would reconnect meanwhile
+	peerStarted := false
+	t.Cleanup(func() {
+		if peerStarted {
+			peer.Destroy()
+		}
+	})
+
+	app := NewApp()
+	app.Cluster.ServerName = "game1"
+	app.Cluster.ListenAddr = ""
+	app.Cluster.ConnAddrs = map[string]string{"game2": peer.ListenAddr}
+	addr := runHealthApp(t, app, newHealthModule(nil))
+
+	// a server listed in ConnAddrs is required
+	waitHealth(t, addr, "/readyz", http.StatusServiceUnavailable, "game2 server is offline")
+	waitHealth(t, addr, "/livez", http.StatusOK, "ok")
+
+	peer.Init()
+	peerStarted = true
+
+	// the client reconnects every 3 seconds
+	waitHealth(t, addr, "/readyz", http.StatusOK, "ok")
+}
+
+func TestHealthStall(t *testing.T) {
+	t.Parallel()
+	m := newHealthModule(nil)
+	release := make(chan struct{})
+	unblock := onceFunc(func() { close(release) })
+	defer unblock()
+	m.RegisterChanRPC("block", func(args []interface{}) {
+		<-release
+	})
+	app := NewApp()
+	app.StallTimeout = 100 * time.Millisecond
+	addr := runHealthApp(t, app, m)
+	waitHealth(t, addr, "/readyz", http.StatusOK, "ok")
+	waitHealth(t, addr, "/livez", http.StatusOK, "ok")
+
+	// not alive while a module is busy with one event for StallTimeout
+	m.ChanRPCServer.Go("block")
+	waitHealth(t, addr, "/livez", http.StatusServiceUnavailable, "module *leaf.healthModule is stalled for")
+
+	unblock()
+	waitHealth(t, addr, "/livez", http.StatusOK, "ok")
+}
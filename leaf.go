@@ -1,6 +1,7 @@
 package leaf
 
 import (
+	"context"
 	"github.com/islovingness/leaf/cluster"
 	"github.com/islovingness/leaf/conf"
 	"github.com/islovingness/leaf/console"
@@ -8,47 +9,196 @@ import (
 	"github.com/islovingness/leaf/module"
 	"os"
 	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
 	OnDestroy func()
 )
 
+// App owns the modules, the cluster, the console and the logger of one
+// leaf server, several apps can run in one process
+type App struct {
+	Modules *module.Manager
+	Cluster *cluster.Cluster
+	Console *console.Console
+	// nil: created from conf when LogLevel is set
+	// the modules, the cluster and the console log there
+	Logger    *log.Logger
+	OnDestroy func()
+	// the app exits anyway if closing down takes longer, 0 waits forever
+	ShutdownTimeout time.Duration
+	// "" disables the /readyz and /livez endpoints
+	HealthAddr string
+	// a module busy with one event longer is not alive, 0: 60s
+	StallTimeout time.Duration
+
+	// the default app exports its logger to the log package
+	exportLogger bool
+	state        int32
+}
+
+const (
+	appStopped = iota
+	appRunning
+	appClosing
+)
+
+// an app with its own instances, configured from conf
+// change the fields before calling Run
+func NewApp() *App {
+	app := new(App)
+	app.Console = console.New()
+	app.Console.LoadConf()
+	app.Modules = module.NewManager(app.Console)
+	app.Cluster = cluster.New(app.Console)
+	app.Cluster.LoadConf()
+	app.loadConf()
+	return app
+}
+
+func (app *App) loadConf() {
+	app.ShutdownTimeout = time.Duration(conf.ShutdownTimeout) * time.Second
+	app.HealthAddr = conf.HealthAddr
+	app.StallTimeout = time.Duration(conf.StallTimeout) * time.Second
+}
+
 func Run(mods ...module.Module) {
+	err := RunContext(context.Background(), mods...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// runs the default app, whose instances back the package functions of
+// module, cluster and console, until ctx is done or the process gets SIGINT/SIGTERM
+// leaf can be run again once RunContext returns
+func RunContext(ctx context.Context, mods ...module.Module) error {
+	app := new(App)
+	app.Console = console.Default
+	app.Console.LoadConf()
+	app.Console.Stdin = true
+	app.Modules = module.Default
+	app.Cluster = cluster.Default
+	app.Cluster.LoadConf()
+	app.Cluster.AgentChanRPC = cluster.AgentChanRPC
+	app.Cluster.OnAgentDegraded = cluster.OnAgentDegraded
+	app.Cluster.OnAgentRecovered = cluster.OnAgentRecovered
+	app.OnDestroy = OnDestroy
+	app.loadConf()
+	app.exportLogger = true
+	return app.RunContext(ctx, mods...)
+}
+
+func (app *App) Run(mods ...module.Module) {
+	err := app.RunContext(context.Background(), mods...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// runs the app until ctx is done or the process gets SIGINT/SIGTERM,
+// nothing is started if the leaf conf variables are invalid
+func (app *App) RunContext(ctx context.Context, mods ...module.Module) error {
+	// conf, every error at once
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
 	// logger
-	if conf.LogLevel != "" {
+	if app.Logger == nil && conf.LogLevel != "" {
 		logger, err := log.New(conf.LogLevel, conf.LogPath, conf.LogFlag)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		log.Export(logger)
-		defer logger.Close()
+		app.Logger = logger
+		defer func() {
+			logger.Close()
+			app.Logger = nil
+		}()
+	}
+	if app.exportLogger {
+		log.Export(app.Logger)
 	}
+	app.Modules.Logger = app.Logger
+	app.Cluster.Logger = app.Logger
+	app.Console.Logger = app.Logger
 
-	log.Release("Leaf %v starting up", version)
+	app.Logger.Release("Leaf %v starting up", version)
+
+	// health, not ready until everything is started
+	if app.HealthAddr != "" {
+		server, err := app.startHealth()
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
 
 	// module
 	for i := 0; i < len(mods); i++ {
-		module.Register(mods[i])
+		app.Modules.Register(mods[i])
+	}
+	err := app.Modules.Init()
+	if err != nil {
+		return err
 	}
-	module.Init()
 
 	// cluster
-	cluster.Init()
+	app.Cluster.Init()
 
 	// console
-	console.Init()
+	app.Console.Init()
+
+	// conf reloaded meanwhile
+	stopReload := conf.OnLeafReload(app.confReload)
+	defer stopReload()
+
+	atomic.StoreInt32(&app.state, appRunning)
+	defer atomic.StoreInt32(&app.state, appStopped)
 
 	// close
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	sig := <-c
-	log.Release("Leaf closing down (signal: %v)", sig)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
+	defer signal.Stop(c)
+	select {
+	case sig := <-c:
+		app.Logger.Release("Leaf closing down (signal: %v)", sig)
+	case <-ctx.Done():
+		app.Logger.Release("Leaf closing down (%v)", ctx.Err())
+	}
+	atomic.StoreInt32(&app.state, appClosing)
+
+	if app.ShutdownTimeout > 0 {
+		timeout := time.AfterFunc(app.ShutdownTimeout, func() {
+			app.Logger.Error("Leaf closing down timeout, exit")
+			os.Exit(1)
+		})
+		defer timeout.Stop()
+	}
 
-	if OnDestroy != nil {
-		OnDestroy()
+	if app.OnDestroy != nil {
+		app.OnDestroy()
+	}
+	app.Console.Destroy()
+	app.Cluster.Destroy()
+	app.Modules.Destroy()
+	return nil
+}
+
+// applies the leaf variables reloaded while the app is running
+func (app *App) confReload(changed map[string]interface{}) {
+	if logLevel, ok := changed["LogLevel"].(string); ok && logLevel != "" {
+		if err := app.Logger.SetLevel(logLevel); err != nil {
+			app.Logger.Error("%v", err)
+		}
+	}
+	if interval, ok := changed["HeartBeatInterval"].(int); ok {
+		app.Cluster.SetHeartBeatInterval(time.Duration(interval) * time.Second)
+	}
+	if missTimes, ok := changed["HeartBeatMissTimes"].(int); ok {
+		app.Cluster.SetHeartBeatMissTimes(missTimes)
 	}
-	console.Destroy()
-	cluster.Destroy()
-	module.Destroy()
 }
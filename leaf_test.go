@@ -0,0 +1,184 @@
+package leaf
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/conf"
+	"github.com/islovingness/leaf/console"
+	"github.com/islovingness/leaf/gate"
+	"github.com/islovingness/leaf/log"
+	"github.com/islovingness/leaf/module"
+)
+
+type testModule struct {
+	*module.Skeleton
+	greeting string
+}
+
+func (m *testModule) OnInit() {
+	m.RegisterCommand("hello", "says hello", func(args []interface{}) (interface{}, error) {
+		return m.greeting, nil
+	})
+}
+
+func (m *testModule) OnDestroy() {}
+
+type testGate struct {
+	*gate.Gate
+}
+
+func (g *testGate) OnInit() {}
+
+type testApp struct {
+	*App
+	logDir string
+	gate   *testGate
+	done   chan error
+}
+
+// runs an app with a module registering a command and a gate until ctx is done,
+// the test ends once the app is closed
+func runTestApp(t *testing.T, ctx context.Context, greeting string) *testApp {
+	logDir := t.TempDir()
+	logger, err := log.New("release", logDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &testApp{App: NewApp(), logDir: logDir, done: make(chan error, 1)}
+	a.Logger = logger
+	skeleton := new(module.Skeleton)
+	skeleton.Init()
+	a.gate = &testGate{Gate: new(gate.Gate)}
+
+	go func() {
+		a.done <- a.RunContext(ctx, &testModule{Skeleton: skeleton, greeting: greeting}, a.gate)
+	}()
+	t.Cleanup(func() {
+		if err := <-a.done; err != nil {
+			t.Error(err)
+		}
+		logger.Close()
+	})
+	return a
+}
+
+// runs hello as soon as the module is up
+func (a *testApp) hello(t *testing.T) string {
+	t.Helper()
+	session := &console.Session{Level: console.LevelAdmin, Source: "test"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		output, err := a.Console.Exec(session, []string{"hello"})
+		if err == nil {
+			return output
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hello: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// the content of the log file of the app
+func (a *testApp) log(t *testing.T) string {
+	t.Helper()
+	files, err := ioutil.ReadDir(a.logDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("log files: %v, %v", files, err)
+	}
+	data, err := ioutil.ReadFile(path.Join(a.logDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTwoApps(t *testing.T) {
+	// the apps close down together, the cluster waits for its requests a while
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a1 := runTestApp(t, ctx, "hello from app1")
+	a2 := runTestApp(t, ctx, "hello from app2")
+
+	// the same command is registered on the console of each app
+	if output := a1.hello(t); output != "hello from app1" {
+		t.Fatalf("app1: %v", output)
+	}
+	if output := a2.hello(t); output != "hello from app2" {
+		t.Fatalf("app2: %v", output)
+	}
+	for _, a := range []*testApp{a1, a2} {
+		if a.gate.Console != a.Console || a.gate.Logger != a.Logger {
+			t.Fatal("the gate is not given the console and the logger of its app")
+		}
+	}
+
+	// each app logs to its own logger
+	for _, a := range []*testApp{a1, a2} {
+		if output := a.log(t); !strings.Contains(output, "console audit: test [admin] exec: hello") {
+			t.Fatalf("app log:\n%s", output)
+		}
+	}
+}
+
+func TestConfReload(t *testing.T) {
+	logLevel := conf.LogLevel
+	defer func() {
+		conf.LogLevel = logLevel
+	}()
+	filename := path.Join(t.TempDir(), "leaf.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"LogLevel": "release"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := conf.NewLoader(filename)
+	defer l.Close()
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := runTestApp(t, ctx, "hello")
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&a.state) != appRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("app not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the level of the app logger follows the reloaded LogLevel
+	if err := ioutil.WriteFile(filename, []byte(`{"LogLevel": "error"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	a.Logger.Release("released after the reload")
+	a.Logger.Error("error after the reload")
+	if output := a.log(t); strings.Contains(output, "released after the reload") || !strings.Contains(output, "error after the reload") {
+		t.Fatalf("app log:\n%s", output)
+	}
+}
+
+func TestInvalidConf(t *testing.T) {
+	logLevel, consolePort := conf.LogLevel, conf.ConsolePort
+	defer func() {
+		conf.LogLevel, conf.ConsolePort = logLevel, consolePort
+	}()
+	conf.LogLevel = "loud"
+	conf.ConsolePort = -1
+
+	// every error at once, before anything starts
+	err := NewApp().RunContext(context.Background(), &testModule{Skeleton: new(module.Skeleton)})
+	if err == nil || !strings.Contains(err.Error(), "LogLevel") || !strings.Contains(err.Error(), "ConsolePort") {
+		t.Fatalf("run: %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 	"runtime"
 )
@@ -27,25 +28,31 @@ const (
 )
 
 type Logger struct {
-	level      int
+	level      int32
 	baseLogger *log.Logger
 	baseFile   *os.File
 }
 
-func New(strLevel string, pathname string, flag int) (*Logger, error) {
-	// level
-	var level int
+func parseLevel(strLevel string) (int32, error) {
 	switch strings.ToLower(strLevel) {
 	case "debug":
-		level = debugLevel
+		return debugLevel, nil
 	case "release":
-		level = releaseLevel
+		return releaseLevel, nil
 	case "error":
-		level = errorLevel
+		return errorLevel, nil
 	case "fatal":
-		level = fatalLevel
+		return fatalLevel, nil
 	default:
-		return nil, errors.New("unknown level: " + strLevel)
+		return 0, errors.New("unknown level: " + strLevel)
+	}
+}
+
+func New(strLevel string, pathname string, flag int) (*Logger, error) {
+	// level
+	level, err := parseLevel(strLevel)
+	if err != nil {
+		return nil, err
 	}
 
 	// logger
@@ -82,6 +89,20 @@ func New(strLevel string, pathname string, flag int) (*Logger, error) {
 	return logger, nil
 }
 
+// goroutine safe, a nil logger sets the level of the exported one
+func (logger *Logger) SetLevel(strLevel string) error {
+	level, err := parseLevel(strLevel)
+	if err != nil {
+		return err
+	}
+	if logger == nil {
+		logger = gLogger
+	}
+
+	atomic.StoreInt32(&logger.level, level)
+	return nil
+}
+
 // It's dangerous to call the method on logging
 func (logger *Logger) Close() {
 	if logger.baseFile != nil {
@@ -92,8 +113,12 @@ func (logger *Logger) Close() {
 	logger.baseFile = nil
 }
 
-func (logger *Logger) doPrintf(level int, printLevel string, format string, a ...interface{}) {
-	if level < logger.level {
+// a nil logger prints with the exported one
+func (logger *Logger) doPrintf(level int32, printLevel string, format string, a ...interface{}) {
+	if logger == nil {
+		logger = gLogger
+	}
+	if level < atomic.LoadInt32(&logger.level) {
 		return
 	}
 	if logger.baseLogger == nil {
@@ -124,9 +149,19 @@ func (logger *Logger) Fatal(format string, a ...interface{}) {
 	logger.doPrintf(fatalLevel, printFatalLevel, format, a...)
 }
 
+func (logger *Logger) Recover(r interface{}) {
+	buf := make([]byte, 4096)
+	l := runtime.Stack(buf, false)
+	logger.Error("%v: %s", r, buf[:l])
+}
+
 var gLogger, _ = New("debug", "", log.LstdFlags)
 
 // It's dangerous to call the method on logging
+func SetLevel(strLevel string) error {
+	return gLogger.SetLevel(strLevel)
+}
+
 func Export(logger *Logger) {
 	if logger != nil {
 		gLogger = logger
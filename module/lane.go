@@ -0,0 +1,127 @@
+package module
+
+type Lane int
+
+const (
+	LaneCommand Lane = iota
+	LaneTimer
+	LaneAsynRet
+	LaneGo
+	LaneChanRPC
+)
+
+var defaultLanes = []Lane{LaneCommand, LaneTimer, LaneAsynRet, LaneGo, LaneChanRPC}
+
+// every round serves the lanes by priority without blocking: the ChanRPC lane
+// handles at most ChanRPCBatch calls, the other lanes what is pending when
+// they are polled, at least one event, so a lane refilled by a handler of a
+// later lane is served in the next round; it only blocks when every lane is empty
+func (s *Skeleton) runPriority(closeSig chan bool) {
+	lanes := append([]Lane(nil), s.PriorityLanes...)
+	for _, lane := range defaultLanes {
+		found := false
+		for _, l := range lanes {
+			if l == lane {
+				found = true
+				break
+			}
+		}
+		if !found {
+			lanes = append(lanes, lane)
+		}
+	}
+
+	chanRPCBatch := s.ChanRPCBatch
+	if chanRPCBatch <= 0 {
+		chanRPCBatch = 1
+	}
+
+	for {
+		select {
+		case <-closeSig:
+			s.close()
+			return
+		default:
+		}
+
+		n := 0
+		for _, lane := range lanes {
+			max := chanRPCBatch
+			if lane != LaneChanRPC {
+				// unbuffered channels report nothing pending but may have a sender waiting
+				max = s.pending(lane)
+				if max == 0 {
+					max = 1
+				}
+			}
+			n += s.poll(lane, max)
+		}
+
+		if n == 0 && !s.wait(closeSig) {
+			return
+		}
+	}
+}
+
+func (s *Skeleton) pending(lane Lane) int {
+	switch lane {
+	case LaneCommand:
+		return len(s.commandServer.ChanCall)
+	case LaneTimer:
+		return len(s.dispatcher.ChanTimer)
+	case LaneAsynRet:
+		return len(s.client.ChanAsynRet)
+	case LaneGo:
+		return len(s.g.ChanCb)
+	case LaneChanRPC:
+		return len(s.server.ChanCall)
+	default:
+		return 0
+	}
+}
+
+// handles up to max events of the lane without blocking
+func (s *Skeleton) poll(lane Lane, max int) int {
+	for n := 0; n < max; n++ {
+		switch lane {
+		case LaneCommand:
+			select {
+			case ci := <-s.commandServer.ChanCall:
+				s.handleCommand(ci)
+			default:
+				return n
+			}
+		case LaneTimer:
+			select {
+			case t := <-s.dispatcher.ChanTimer:
+				s.handleTimer(t)
+			default:
+				return n
+			}
+		case LaneAsynRet:
+			select {
+			case ri := <-s.client.ChanAsynRet:
+				s.handleAsynRet(ri)
+			default:
+				return n
+			}
+		case LaneGo:
+			select {
+			case cb := <-s.g.ChanCb:
+				s.handleGo(cb)
+			default:
+				return n
+			}
+		case LaneChanRPC:
+			select {
+			case ci := <-s.server.ChanCall:
+				s.handleChanRPC(ci)
+			default:
+				return n
+			}
+		default:
+			return n
+		}
+	}
+	return max
+}
@@ -0,0 +1,93 @@
+package module
+
+import (
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/console"
+)
+
+func TestPriorityLanes(t *testing.T) {
+	rec := new(recorder)
+	s := &Skeleton{
+		TimerDispatcherLen: 10,
+		ChanRPCServer:      chanrpc.NewServer(200),
+		PriorityLanes:      []Lane{LaneCommand, LaneTimer},
+		ChanRPCBatch:       2,
+		Console:            console.New(),
+	}
+	s.Init()
+
+	waitTimers := func(n int) {
+		for s.pending(LaneTimer) < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first := true
+	s.RegisterChanRPC("rpc", func(args []interface{}) {
+		rec.add("rpc")
+		if first {
+			// a timer due while the calls are flooding in waits for one batch at most
+			first = false
+			s.AfterFunc(0, func() { rec.add("later timer") })
+			waitTimers(1)
+		}
+	})
+	s.RegisterCommand("cmd", "", func(args []interface{}) (interface{}, error) {
+		rec.add("cmd")
+		return "", nil
+	})
+
+	const calls = 100
+	for i := 0; i < calls; i++ {
+		s.ChanRPCServer.Go("rpc")
+	}
+	for i := 0; i < 3; i++ {
+		s.AfterFunc(0, func() { rec.add("timer") })
+	}
+	waitTimers(3)
+	cmdDone := make(chan error, 1)
+	go func() {
+		_, err := s.Console.Exec(&console.Session{Level: console.LevelAdmin}, []string{"cmd"})
+		cmdDone <- err
+	}()
+	// let the command wait on the unbuffered command server
+	time.Sleep(50 * time.Millisecond)
+
+	closeSig := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+	if err := <-cmdDone; err != nil {
+		t.Fatal(err)
+	}
+	for s.pending(LaneChanRPC) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	closeSig <- true
+	<-done
+
+	events := rec.take()
+	if len(events) != calls+5 {
+		t.Fatalf("%v events: %v", len(events), events)
+	}
+	for i, want := range []string{"cmd", "timer", "timer", "timer", "rpc"} {
+		if events[i] != want {
+			t.Fatalf("event %v is %v, want %v: %v", i, events[i], want, events)
+		}
+	}
+	rpcs := 0
+	for _, event := range events[4:] {
+		if event == "later timer" {
+			break
+		}
+		rpcs++
+	}
+	if rpcs > s.ChanRPCBatch {
+		t.Fatalf("later timer handled after %v calls: %v", rpcs, events)
+	}
+}
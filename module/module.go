@@ -1,8 +1,15 @@
 package module
 
 import (
+	"fmt"
+	"github.com/islovingness/leaf/console"
 	"github.com/islovingness/leaf/log"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Module interface {
@@ -11,54 +18,657 @@ type Module interface {
 	Run(closeSig chan bool)
 }
 
+// optional, a module without a name is named after its type
+type NamedModule interface {
+	Name() string
+}
+
+// optional, the named modules must be initialized before this one
+// and are destroyed after it
+type DependentModule interface {
+	Dependencies() []string
+}
+
+// optional, Run is called again when it returns or panics before the module is destroyed
+type SupervisedModule interface {
+	RestartPolicy() RestartPolicy
+}
+
+// optional, the server is not ready while a running module returns false
+type ReadyModule interface {
+	Ready() bool
+}
+
+// optional, how long the module has been handling its current event, 0 if idle
+type BusyModule interface {
+	Busy() time.Duration
+}
+
+// optional, the number of events waiting in each queue of the module
+type QueueModule interface {
+	QueueLen() map[string]int
+}
+
+// optional, implemented by Skeleton and gate.Gate, called before OnInit
+// with the console and the logger of the manager, so that the module
+// registers its commands and logs where its app does
+// a Skeleton or Gate only assigned in OnInit is not reached
+type AppModule interface {
+	SetApp(c *console.Console, logger *log.Logger)
+}
+
+type RestartPolicy struct {
+	// <0: unlimited
+	MaxRestarts int
+	// doubled after each restart, up to MaxBackoff, at least MinBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// the least delay before a restart, so that a module failing at once
+// does not spin
+const MinBackoff = 100 * time.Millisecond
+
+type Health int32
+
+const (
+	Healthy Health = iota
+	// Run exited unexpectedly and is waiting to be restarted
+	Degraded
+	Stopped
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Stopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+type Status struct {
+	Name     string
+	Optional bool
+	Health   Health
+	Restarts int
+	// nil unless the module is a QueueModule
+	Queues map[string]int
+}
+
 type module struct {
-	mi       Module
+	mi Module
+	// nil: the module cannot run again once stopped
+	factory func() Module
+	// mi has been destroyed
+	stale    bool
+	name     string
+	deps     []string
+	optional bool
+	running  bool
+	// Run is being closed, without the mutex of the manager held
+	stopping bool
 	closeSig chan bool
 	wg       sync.WaitGroup
+	closing  int32
+	health   int32
+	restarts int32
+	logger   *log.Logger
 }
 
-var mods []*module
+// Manager owns a set of modules, the package functions use Default
+type Manager struct {
+	// the "module" command is registered there, nil: none
+	// also given to every AppModule
+	Console *console.Console
+	// nil: the log package
+	Logger *log.Logger
 
-func Register(mi Module) {
+	mutex  sync.Mutex
+	inited bool
+	mods   []*module
+	// Destroy is running, nothing may start meanwhile
+	destroying bool
+}
+
+var Default = NewManager(console.Default)
+
+func NewManager(console *console.Console) *Manager {
+	mgr := new(Manager)
+	mgr.Console = console
+	return mgr
+}
+
+func (mgr *Manager) Register(mi Module) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	mgr.mods = append(mgr.mods, newModule(mi, false))
+}
+
+// the module is not started by Init, use Start to run it
+// newModule is called again on every Start after a Stop, a module never
+// runs twice as its Skeleton and ChanRPCServer are closed when it stops
+// goroutine safe
+func (mgr *Manager) RegisterOptional(newModule func() Module) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	m := newOptionalModule(newModule)
+	if !mgr.inited {
+		mgr.mods = append(mgr.mods, m)
+		return nil
+	}
+
+	sorted, err := sortModules(append(mgr.mods[:len(mgr.mods):len(mgr.mods)], m))
+	if err != nil {
+		return err
+	}
+	mgr.mods = sorted
+	return nil
+}
+
+func newModule(mi Module, optional bool) *module {
 	m := new(module)
 	m.mi = mi
-	m.closeSig = make(chan bool, 1)
+	m.name = moduleName(mi)
+	if dm, ok := mi.(DependentModule); ok {
+		m.deps = dm.Dependencies()
+	}
+	m.optional = optional
+	m.health = int32(Stopped)
+	return m
+}
 
-	mods = append(mods, m)
+func newOptionalModule(factory func() Module) *module {
+	m := newModule(factory(), true)
+	m.factory = factory
+	return m
 }
 
-func Init() {
-	for i := 0; i < len(mods); i++ {
-		mods[i].mi.OnInit()
+func moduleName(mi Module) string {
+	if nm, ok := mi.(NamedModule); ok {
+		return nm.Name()
 	}
+	return reflect.TypeOf(mi).String()
+}
 
-	for i := 0; i < len(mods); i++ {
-		m := mods[i]
-		m.wg.Add(1)
-		go run(m)
+// orders the modules so that dependencies come first,
+// independent modules keep their registration order
+func sortModules(mods []*module) ([]*module, error) {
+	byName := make(map[string]*module)
+	for _, m := range mods {
+		if _, ok := byName[m.name]; ok {
+			return nil, fmt.Errorf("module %v is already registered", m.name)
+		}
+		byName[m.name] = m
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*module]int)
+	sorted := make([]*module, 0, len(mods))
+	var path []string
+
+	var visit func(m *module) error
+	visit = func(m *module) error {
+		switch state[m] {
+		case visiting:
+			return fmt.Errorf("module dependency cycle: %v -> %v", strings.Join(path, " -> "), m.name)
+		case visited:
+			return nil
+		}
+
+		state[m] = visiting
+		path = append(path, m.name)
+		for _, dep := range m.deps {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("module %v depends on missing module %v", m.name, dep)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[m] = visited
+
+		sorted = append(sorted, m)
+		return nil
 	}
+
+	for _, m := range mods {
+		if err := visit(m); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
 }
 
-func Destroy() {
+func (mgr *Manager) Init() error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	sorted, err := sortModules(mgr.mods)
+	if err != nil {
+		return err
+	}
+	mgr.mods = sorted
+
+	var inits []*module
+	for _, m := range mgr.mods {
+		if m.optional {
+			continue
+		}
+
+		err := mgr.initModule(m)
+		if err != nil {
+			for i := len(inits) - 1; i >= 0; i-- {
+				destroy(inits[i])
+			}
+			mgr.mods = nil
+			return err
+		}
+		inits = append(inits, m)
+	}
+
+	for _, m := range inits {
+		launch(m)
+	}
+	mgr.inited = true
+
+	if mgr.Console != nil {
+		mgr.Console.RegisterFunc("module", "manage modules", mgr.commandModule)
+		mgr.Console.RegisterFunc("modules", "lists the modules with their queue lengths", mgr.commandModules)
+		mgr.Console.SetLevel("modules", console.LevelReadOnly)
+	}
+	return nil
+}
+
+// starts a registered module after Init, the modules it depends on must be running
+// a module stopped before is created again, see RegisterOptional
+// goroutine safe
+func (mgr *Manager) Start(name string) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	if mgr.destroying {
+		return fmt.Errorf("module %v cannot start, the modules are being destroyed", name)
+	}
+	m := mgr.getModule(name)
+	if m == nil {
+		return fmt.Errorf("module %v is not registered", name)
+	}
+	if m.stopping {
+		return fmt.Errorf("module %v is stopping", name)
+	}
+	if m.running {
+		return fmt.Errorf("module %v is already running", name)
+	}
+
+	return mgr.start(m)
+}
+
+// destroys a running module, no running module may depend on it
+// goroutine safe
+func (mgr *Manager) Stop(name string) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	m := mgr.getModule(name)
+	if m == nil {
+		return fmt.Errorf("module %v is not registered", name)
+	}
+	if m.stopping {
+		return fmt.Errorf("module %v is stopping", name)
+	}
+	if !m.running {
+		return fmt.Errorf("module %v is not running", name)
+	}
+	for _, other := range mgr.mods {
+		if !other.running {
+			continue
+		}
+		for _, dep := range other.deps {
+			if dep == name {
+				return fmt.Errorf("module %v is required by module %v", name, other.name)
+			}
+		}
+	}
+
+	mgr.stop(m)
+	return nil
+}
+
+func (mgr *Manager) getModule(name string) *module {
+	for _, m := range mgr.mods {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (mgr *Manager) start(m *module) error {
+	for _, dep := range m.deps {
+		d := mgr.getModule(dep)
+		if d == nil || !d.running || d.stopping {
+			return fmt.Errorf("module %v depends on module %v which is not running", m.name, dep)
+		}
+	}
+
+	if m.stale {
+		if m.factory == nil {
+			return fmt.Errorf("module %v cannot run again, register it with RegisterOptional", m.name)
+		}
+		mi := m.factory()
+		if name := moduleName(mi); name != m.name {
+			return fmt.Errorf("module %v is created as module %v", m.name, name)
+		}
+		m.mi = mi
+		m.stale = false
+	}
+
+	err := mgr.initModule(m)
+	if err != nil {
+		m.stale = true
+		return err
+	}
+
+	launch(m)
+	return nil
+}
+
+func launch(m *module) {
+	m.closeSig = make(chan bool, 1)
+	m.closing = 0
+	m.health = int32(Healthy)
+	m.restarts = 0
+	m.running = true
+	m.wg.Add(1)
+	go run(m)
+}
+
+func (mgr *Manager) initModule(m *module) (err error) {
+	m.logger = mgr.Logger
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger.Recover(r)
+			err = fmt.Errorf("module %v init failed: %v", m.name, r)
+		}
+	}()
+
+	if am, ok := m.mi.(AppModule); ok {
+		am.SetApp(mgr.Console, mgr.Logger)
+	}
+	m.mi.OnInit()
+	return
+}
+
+// the mutex is released meanwhile, so that the status of the modules
+// can be read while a slow module closes
+// must hold the mutex
+func (mgr *Manager) stop(m *module) {
+	m.stopping = true
+	mgr.mutex.Unlock()
+
+	atomic.StoreInt32(&m.closing, 1)
+	m.closeSig <- true
+	m.wg.Wait()
+	destroy(m)
+
+	mgr.mutex.Lock()
+	m.stopping = false
+	m.running = false
+	m.stale = true
+}
+
+func destroy(m *module) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger.Recover(r)
+		}
+	}()
+
+	m.mi.OnDestroy()
+}
+
+func (mgr *Manager) Destroy() {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	// the mutex is released while a module stops, a module started
+	// meanwhile would be left running
+	mgr.destroying = true
+
+	// mgr.mods may be replaced while a module stops
+	mods := mgr.mods
 	for i := len(mods) - 1; i >= 0; i-- {
 		m := mods[i]
-		m.closeSig <- true
-		m.wg.Wait()
-		destroy(m)
+		if m.running && !m.stopping {
+			mgr.stop(m)
+		}
+	}
+	mgr.mods = nil
+	mgr.inited = false
+	mgr.destroying = false
+
+	if mgr.Console != nil {
+		mgr.Console.Unregister("module")
+		mgr.Console.Unregister("modules")
 	}
 }
 
 func run(m *module) {
-	m.mi.Run(m.closeSig)
-	m.wg.Done()
+	defer func() {
+		atomic.StoreInt32(&m.health, int32(Stopped))
+		m.wg.Done()
+	}()
+
+	var policy RestartPolicy
+	if sm, ok := m.mi.(SupervisedModule); ok {
+		policy = sm.RestartPolicy()
+	}
+	backoff := policy.Backoff
+	if backoff < MinBackoff {
+		backoff = MinBackoff
+	}
+
+	for {
+		runOnce(m)
+		if atomic.LoadInt32(&m.closing) == 1 {
+			return
+		}
+
+		restarts := int(atomic.LoadInt32(&m.restarts))
+		if policy.MaxRestarts >= 0 && restarts >= policy.MaxRestarts {
+			m.logger.Error("module %v stopped unexpectedly", m.name)
+			return
+		}
+
+		atomic.StoreInt32(&m.health, int32(Degraded))
+		m.logger.Error("module %v stopped unexpectedly, restart in %v", m.name, backoff)
+		select {
+		case <-m.closeSig:
+			return
+		case <-time.After(backoff):
+		}
+
+		atomic.AddInt32(&m.restarts, 1)
+		atomic.StoreInt32(&m.health, int32(Healthy))
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+		if backoff < MinBackoff {
+			backoff = MinBackoff
+		}
+	}
 }
 
-func destroy(m *module) {
+func runOnce(m *module) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Recover(r)
+			m.logger.Recover(r)
 		}
 	}()
 
-	m.mi.OnDestroy()
+	m.mi.Run(m.closeSig)
+}
+
+// goroutine safe
+func (mgr *Manager) GetStatus() []*Status {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	status := make([]*Status, len(mgr.mods))
+	for i, m := range mgr.mods {
+		status[i] = &Status{
+			Name:     m.name,
+			Optional: m.optional,
+			Health:   Health(atomic.LoadInt32(&m.health)),
+			Restarts: int(atomic.LoadInt32(&m.restarts)),
+		}
+		if qm, ok := m.mi.(QueueModule); ok && m.running {
+			status[i].Queues = qm.QueueLen()
+		}
+	}
+	return status
+}
+
+func Register(mi Module) {
+	Default.Register(mi)
+}
+
+// goroutine safe
+func RegisterOptional(newModule func() Module) error {
+	return Default.RegisterOptional(newModule)
+}
+
+func Init() error {
+	return Default.Init()
+}
+
+// goroutine safe
+func Start(name string) error {
+	return Default.Start(name)
+}
+
+// goroutine safe
+func Stop(name string) error {
+	return Default.Stop(name)
+}
+
+func Destroy() {
+	Default.Destroy()
+}
+
+// goroutine safe
+func GetStatus() []*Status {
+	return Default.GetStatus()
+}
+
+// nil once Init is done and every running module is healthy and ready
+// goroutine safe
+func (mgr *Manager) Ready() error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	if !mgr.inited {
+		return fmt.Errorf("modules are not initialized")
+	}
+	for _, m := range mgr.mods {
+		if !m.running || m.stopping {
+			continue
+		}
+		if health := Health(atomic.LoadInt32(&m.health)); health != Healthy {
+			return fmt.Errorf("module %v is %v", m.name, health)
+		}
+		if rm, ok := m.mi.(ReadyModule); ok && !rm.Ready() {
+			return fmt.Errorf("module %v is not ready", m.name)
+		}
+	}
+	return nil
+}
+
+// nil unless a running module has been busy with one event for stallTimeout
+// goroutine safe
+func (mgr *Manager) Alive(stallTimeout time.Duration) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	for _, m := range mgr.mods {
+		if !m.running || m.stopping {
+			continue
+		}
+		if bm, ok := m.mi.(BusyModule); ok {
+			if busy := bm.Busy(); busy >= stallTimeout {
+				return fmt.Errorf("module %v is stalled for %v", m.name, busy)
+			}
+		}
+	}
+	return nil
+}
+
+func (mgr *Manager) commandModule(args []string) string {
+	usage := "Usage: module list|start <name>|stop <name>"
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "list":
+		output := fmt.Sprintf("%-24v %-9v %-9v %v", "NAME", "TYPE", "HEALTH", "RESTARTS")
+		for _, s := range mgr.GetStatus() {
+			t := "static"
+			if s.Optional {
+				t = "optional"
+			}
+			output += fmt.Sprintf("\r\n%-24v %-9v %-9v %v", s.Name, t, s.Health, s.Restarts)
+		}
+		return output
+	case "start":
+		if len(args) < 2 {
+			return usage
+		}
+		if err := mgr.Start(args[1]); err != nil {
+			return err.Error()
+		}
+		return "module " + args[1] + " started"
+	case "stop":
+		if len(args) < 2 {
+			return usage
+		}
+		if err := mgr.Stop(args[1]); err != nil {
+			return err.Error()
+		}
+		return "module " + args[1] + " stopped"
+	default:
+		return usage
+	}
+}
+
+func (mgr *Manager) commandModules([]string) string {
+	output := fmt.Sprintf("%-24v %-9v %-9v %v", "NAME", "HEALTH", "RESTARTS", "QUEUES")
+	for _, s := range mgr.GetStatus() {
+		names := make([]string, 0, len(s.Queues))
+		for name := range s.Queues {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		queues := make([]string, len(names))
+		for i, name := range names {
+			queues[i] = fmt.Sprintf("%v=%v", name, s.Queues[name])
+		}
+		output += strings.TrimRight(fmt.Sprintf("\r\n%-24v %-9v %-9v %v", s.Name, s.Health, s.Restarts, strings.Join(queues, " ")), " ")
+	}
+	return output
 }
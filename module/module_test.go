@@ -0,0 +1,497 @@
+package module
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/console"
+)
+
+type recorder struct {
+	sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(event string) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+// returns the events so far and forgets them
+func (r *recorder) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+type testModule struct {
+	name     string
+	deps     []string
+	rec      *recorder
+	failInit bool
+}
+
+func (m *testModule) Name() string           { return m.name }
+func (m *testModule) Dependencies() []string { return m.deps }
+
+func (m *testModule) OnInit() {
+	m.rec.add("init " + m.name)
+	if m.failInit {
+		panic("boom")
+	}
+}
+
+func (m *testModule) OnDestroy() {
+	m.rec.add("destroy " + m.name)
+}
+
+func (m *testModule) Run(closeSig chan bool) {
+	<-closeSig
+}
+
+func newTestModule(name string, deps ...string) *module {
+	return &module{name: name, deps: deps}
+}
+
+func TestSortModules(t *testing.T) {
+	tests := []struct {
+		name string
+		mods []*module
+		want []string
+		err  string
+	}{
+		{
+			name: "registration order",
+			mods: []*module{newTestModule("a"), newTestModule("b"), newTestModule("c")},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "dependencies first",
+			mods: []*module{
+				newTestModule("gate", "game"),
+				newTestModule("login"),
+				newTestModule("game", "db"),
+				newTestModule("db"),
+			},
+			want: []string{"db", "game", "gate", "login"},
+		},
+		{
+			name: "shared dependency",
+			mods: []*module{
+				newTestModule("a", "c"),
+				newTestModule("b", "c"),
+				newTestModule("c"),
+			},
+			want: []string{"c", "a", "b"},
+		},
+		{
+			name: "several dependencies",
+			mods: []*module{
+				newTestModule("a", "c", "b"),
+				newTestModule("b"),
+				newTestModule("c"),
+			},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name: "cycle",
+			mods: []*module{
+				newTestModule("a", "b"),
+				newTestModule("b", "c"),
+				newTestModule("c", "a"),
+			},
+			err: "module dependency cycle: a -> b -> c -> a",
+		},
+		{
+			name: "self dependency",
+			mods: []*module{newTestModule("a", "a")},
+			err:  "module dependency cycle: a -> a",
+		},
+		{
+			name: "cycle behind a dependency",
+			mods: []*module{
+				newTestModule("a", "b"),
+				newTestModule("b", "c"),
+				newTestModule("c", "b"),
+			},
+			err: "module dependency cycle: a -> b -> c -> b",
+		},
+		{
+			name: "missing dependency",
+			mods: []*module{newTestModule("a"), newTestModule("b", "x")},
+			err:  "module b depends on missing module x",
+		},
+		{
+			name: "duplicate name",
+			mods: []*module{newTestModule("a"), newTestModule("a")},
+			err:  "module a is already registered",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sorted, err := sortModules(test.mods)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, len(sorted))
+			for i, m := range sorted {
+				names[i] = m.name
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Fatalf("got %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestManagerInit(t *testing.T) {
+	rec := new(recorder)
+	mgr := NewManager(nil)
+	mgr.Register(&testModule{name: "game", deps: []string{"db"}, rec: rec})
+	mgr.Register(&testModule{name: "db", rec: rec})
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	mgr.Destroy()
+
+	want := []string{"init db", "init game", "destroy game", "destroy db"}
+	if events := rec.take(); !reflect.DeepEqual(events, want) {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+}
+
+func TestManagerInitFailure(t *testing.T) {
+	rec := new(recorder)
+	mgr := NewManager(nil)
+	mgr.Register(&testModule{name: "game", deps: []string{"db"}, rec: rec})
+	mgr.Register(&testModule{name: "db", rec: rec})
+	mgr.Register(&testModule{name: "gate", deps: []string{"game"}, rec: rec, failInit: true})
+
+	err := mgr.Init()
+	if err == nil || err.Error() != "module gate init failed: boom" {
+		t.Fatalf("got error %v", err)
+	}
+	// the modules initialized are destroyed in reverse order
+	want := []string{"init db", "init game", "init gate", "destroy game", "destroy db"}
+	if events := rec.take(); !reflect.DeepEqual(events, want) {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+
+	mgr = NewManager(nil)
+	mgr.Register(&testModule{name: "game", deps: []string{"db"}, rec: rec})
+	if err := mgr.Init(); err == nil {
+		t.Fatal("initialized with a missing dependency")
+	}
+	if events := rec.take(); len(events) != 0 {
+		t.Fatalf("got %v before the dependency check", events)
+	}
+}
+
+type crashModule struct {
+	runs int32
+}
+
+func (m *crashModule) OnInit()    {}
+func (m *crashModule) OnDestroy() {}
+
+func (m *crashModule) RestartPolicy() RestartPolicy {
+	return RestartPolicy{MaxRestarts: -1}
+}
+
+func (m *crashModule) Run(closeSig chan bool) {
+	atomic.AddInt32(&m.runs, 1)
+}
+
+func TestRestartMinBackoff(t *testing.T) {
+	m := new(crashModule)
+	mgr := NewManager(nil)
+	mgr.Register(m)
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * MinBackoff)
+	mgr.Destroy()
+
+	// restarted after MinBackoff then twice as late
+	if runs := atomic.LoadInt32(&m.runs); runs > 3 {
+		t.Fatalf("Run called %v times with no backoff", runs)
+	}
+}
+
+type slowModule struct {
+	testModule
+	closeDelay time.Duration
+}
+
+func (m *slowModule) Run(closeSig chan bool) {
+	<-closeSig
+	time.Sleep(m.closeDelay)
+}
+
+func TestStopSlowModule(t *testing.T) {
+	rec := new(recorder)
+	mgr := NewManager(nil)
+	mgr.Register(&testModule{name: "db", rec: rec})
+	err := mgr.RegisterOptional(func() Module {
+		return &slowModule{
+			testModule: testModule{name: "event", deps: []string{"db"}, rec: rec},
+			closeDelay: 300 * time.Millisecond,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Destroy()
+	if err := mgr.Start("event"); err != nil {
+		t.Fatal(err)
+	}
+
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- mgr.Stop("event")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the status is readable while the module closes
+	start := time.Now()
+	mgr.GetStatus()
+	if err := mgr.Ready(); err != nil {
+		t.Fatalf("not ready while a module stops: %v", err)
+	}
+	if err := mgr.Alive(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("status blocked for %v", d)
+	}
+	if err := mgr.Start("event"); err == nil || err.Error() != "module event is stopping" {
+		t.Fatalf("start while stopping: %v", err)
+	}
+	if err := mgr.Stop("event"); err == nil || err.Error() != "module event is stopping" {
+		t.Fatalf("stop while stopping: %v", err)
+	}
+
+	if err := <-chanErr; err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range mgr.GetStatus() {
+		if s.Name == "event" && s.Health != Stopped {
+			t.Fatalf("event is %v", s.Health)
+		}
+	}
+}
+
+func TestDestroyWhileStarting(t *testing.T) {
+	rec := new(recorder)
+	mgr := NewManager(nil)
+	mgr.Register(&testModule{name: "db", rec: rec})
+	mgr.RegisterOptional(func() Module {
+		return &slowModule{
+			testModule: testModule{name: "event", deps: []string{"db"}, rec: rec},
+			closeDelay: 300 * time.Millisecond,
+		}
+	})
+	mgr.RegisterOptional(func() Module {
+		return &testModule{name: "chat", deps: []string{"db"}, rec: rec}
+	})
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Start("event"); err != nil {
+		t.Fatal(err)
+	}
+	rec.take()
+
+	done := make(chan bool)
+	go func() {
+		mgr.Destroy()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// nothing would stop chat once Destroy returns
+	if err := mgr.Start("chat"); err == nil || !strings.Contains(err.Error(), "being destroyed") {
+		t.Fatalf("start while destroying: %v", err)
+	}
+	<-done
+	if events := rec.take(); !reflect.DeepEqual(events, []string{"destroy event", "destroy db"}) {
+		t.Fatalf("events: %v", events)
+	}
+}
+
+type skeletonModule struct {
+	*Skeleton
+	run int
+}
+
+func (m *skeletonModule) Name() string { return "skeleton" }
+
+func (m *skeletonModule) OnInit() {
+	m.RegisterChanRPC("run", func(args []interface{}) (interface{}, error) {
+		return m.run, nil
+	})
+}
+
+func (m *skeletonModule) OnDestroy() {}
+
+func TestRestartOptional(t *testing.T) {
+	var servers []*chanrpc.Server
+	mgr := NewManager(nil)
+	err := mgr.RegisterOptional(func() Module {
+		server := chanrpc.NewServer(10)
+		servers = append(servers, server)
+		skeleton := &Skeleton{ChanRPCServer: server}
+		skeleton.Init()
+		return &skeletonModule{Skeleton: skeleton, run: len(servers)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Destroy()
+
+	for run := 1; run <= 3; run++ {
+		if err := mgr.Start("skeleton"); err != nil {
+			t.Fatalf("start %v: %v", run, err)
+		}
+		ret, err := servers[len(servers)-1].Call1("run")
+		if ret != run || err != nil {
+			t.Fatalf("run %v: %v, %v", run, ret, err)
+		}
+		if err := mgr.Stop("skeleton"); err != nil {
+			t.Fatalf("stop %v: %v", run, err)
+		}
+	}
+
+	// the server of a stopped module stays closed
+	if _, err := servers[0].Call1("run"); err == nil {
+		t.Fatal("call on a closed server succeeded")
+	}
+	if len(servers) != 3 {
+		t.Fatalf("created %v times", len(servers))
+	}
+}
+
+func TestRestartStatic(t *testing.T) {
+	rec := new(recorder)
+	mgr := NewManager(nil)
+	mgr.Register(&testModule{name: "db", rec: rec})
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Destroy()
+
+	if err := mgr.Stop("db"); err != nil {
+		t.Fatal(err)
+	}
+	err := mgr.Start("db")
+	if err == nil || err.Error() != "module db cannot run again, register it with RegisterOptional" {
+		t.Fatalf("restart: %v", err)
+	}
+	// OnInit is not called on the destroyed module
+	want := []string{"init db", "destroy db"}
+	if events := rec.take(); !reflect.DeepEqual(events, want) {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+}
+
+func TestRestartRenamed(t *testing.T) {
+	rec := new(recorder)
+	n := 0
+	mgr := NewManager(nil)
+	err := mgr.RegisterOptional(func() Module {
+		n++
+		return &testModule{name: "event" + strconv.Itoa(n), rec: rec}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Destroy()
+
+	if err := mgr.Start("event1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Stop("event1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Start("event1"); err == nil || err.Error() != "module event1 is created as module event2" {
+		t.Fatalf("restart: %v", err)
+	}
+}
+
+func TestModulesCommand(t *testing.T) {
+	c := console.New()
+	mgr := NewManager(c)
+	server := chanrpc.NewServer(10)
+	skeleton := &Skeleton{ChanRPCServer: server}
+	skeleton.Init()
+	release := make(chan bool)
+	skeleton.RegisterChanRPC("block", func(args []interface{}) {
+		<-release
+	})
+	skeleton.RegisterChanRPC("noop", func(args []interface{}) {})
+	mgr.Register(&skeletonModule{Skeleton: skeleton})
+	mgr.Register(&testModule{name: "db", rec: new(recorder)})
+	if err := mgr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Destroy()
+	defer close(release)
+
+	// one call running, two waiting
+	server.Go("block")
+	server.Go("noop")
+	server.Go("noop")
+	for len(server.ChanCall) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// read-only users list the modules, not manage them
+	session := &console.Session{Level: console.LevelReadOnly}
+	output, err := c.Exec(session, []string{"modules"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"NAME HEALTH RESTARTS QUEUES",
+		"skeleton healthy 0 asynret=0 chanrpc=2 command=0 go=0 timer=0",
+		"db healthy 0",
+	}
+	lines := strings.Split(output, "\r\n")
+	if len(lines) != len(want) {
+		t.Fatalf("modules: %q", output)
+	}
+	for i, line := range lines {
+		if strings.Join(strings.Fields(line), " ") != want[i] || strings.HasSuffix(line, " ") {
+			t.Fatalf("modules: %q", output)
+		}
+	}
+	if _, err := c.Exec(session, []string{"module", "list"}); err == nil {
+		t.Fatal("module run by a read-only user")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"github.com/islovingness/leaf/chanrpc"
 	"github.com/islovingness/leaf/console"
 	"github.com/islovingness/leaf/go"
+	"github.com/islovingness/leaf/log"
 	"github.com/islovingness/leaf/timer"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,11 +15,35 @@ type Skeleton struct {
 	TimerDispatcherLen int
 	AsynCallLen        int
 	ChanRPCServer      *chanrpc.Server
-	g                  *g.Go
-	dispatcher         *timer.Dispatcher
-	client             *chanrpc.Client
-	server             *chanrpc.Server
-	commandServer      *chanrpc.Server
+
+	// >0: report handlers running longer than this and record their latency
+	SlowHandlerThreshold time.Duration
+
+	// lanes served first, in order, before the others; empty: no priority
+	PriorityLanes []Lane
+	// max ChanRPC calls handled per round when PriorityLanes is set, default 1
+	ChanRPCBatch int
+
+	// where RegisterCommand registers, nil: console.Default
+	Console *console.Console
+	// where the slow handlers are reported, nil: the log package
+	Logger *log.Logger
+
+	// >0: timers are kept in a timing wheel of this resolution instead of
+	// one runtime timer each, for modules with many timers
+	TimerTick time.Duration
+	// where the timers get the time from, nil: timer.RealClock
+	Clock timer.Clock
+
+	g             *g.Go
+	dispatcher    *timer.Dispatcher
+	client        *chanrpc.Client
+	server        *chanrpc.Server
+	commandServer *chanrpc.Server
+	commands      []string
+	watchdog      *watchdog
+	// UnixNano, when the current handler started, 0 if idle
+	busySince int64
 }
 
 func (s *Skeleton) Init() {
@@ -32,7 +58,14 @@ func (s *Skeleton) Init() {
 	}
 
 	s.g = g.New(s.GoLen)
-	s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
+	if s.Clock == nil {
+		s.Clock = timer.RealClock
+	}
+	if s.TimerTick > 0 {
+		s.dispatcher = timer.NewWheelDispatcherClock(s.TimerDispatcherLen, s.TimerTick, s.Clock)
+	} else {
+		s.dispatcher = timer.NewDispatcherClock(s.TimerDispatcherLen, s.Clock)
+	}
 	s.client = chanrpc.NewClient(s.AsynCallLen)
 	s.server = s.ChanRPCServer
 
@@ -40,37 +73,143 @@ func (s *Skeleton) Init() {
 		s.server = chanrpc.NewServer(0)
 	}
 	s.commandServer = chanrpc.NewServer(0)
+
+	if s.SlowHandlerThreshold > 0 {
+		s.watchdog = newWatchdog(s.SlowHandlerThreshold)
+	}
 }
 
 func (s *Skeleton) Run(closeSig chan bool) {
+	// a handler may have panicked in the previous run
+	atomic.StoreInt64(&s.busySince, 0)
+
+	watchdogCloseSig := make(chan bool)
+	defer close(watchdogCloseSig)
+	s.watchdog.run(watchdogCloseSig, s.Logger)
+
+	if len(s.PriorityLanes) > 0 {
+		s.runPriority(closeSig)
+		return
+	}
+
 	for {
-		select {
-		case <-closeSig:
-			s.commandServer.Close()
-			s.server.Close()
-			for !s.g.Idle() || !s.client.Idle() {
-				s.g.Close()
-				s.client.Close()
-			}
+		if !s.wait(closeSig) {
 			return
-		case ri := <-s.client.ChanAsynRet:
-			s.client.Cb(ri)
-		case ci := <-s.server.ChanCall:
-			s.server.Exec(ci)
-		case ci := <-s.commandServer.ChanCall:
-			s.commandServer.Exec(ci)
-		case cb := <-s.g.ChanCb:
-			s.g.Cb(cb)
-		case t := <-s.dispatcher.ChanTimer:
-			t.Cb()
 		}
 	}
 }
 
+// blocks for one event and handles it, false once closed
+func (s *Skeleton) wait(closeSig chan bool) bool {
+	select {
+	case <-closeSig:
+		s.close()
+		return false
+	case ri := <-s.client.ChanAsynRet:
+		s.handleAsynRet(ri)
+	case ci := <-s.server.ChanCall:
+		s.handleChanRPC(ci)
+	case ci := <-s.commandServer.ChanCall:
+		s.handleCommand(ci)
+	case cb := <-s.g.ChanCb:
+		s.handleGo(cb)
+	case t := <-s.dispatcher.ChanTimer:
+		s.handleTimer(t)
+	}
+	return true
+}
+
+func (s *Skeleton) close() {
+	for _, name := range s.commands {
+		s.Console.Unregister(name)
+	}
+	s.commands = nil
+	s.commandServer.Close()
+	s.server.Close()
+	s.dispatcher.Close()
+	for !s.g.Idle() || !s.client.Idle() {
+		s.g.Close()
+		s.client.Close()
+	}
+}
+
+func (s *Skeleton) handleAsynRet(ri *chanrpc.RetInfo) {
+	s.begin("asyncall", ri.Cb)
+	s.client.Cb(ri)
+	s.end()
+}
+
+func (s *Skeleton) handleChanRPC(ci *chanrpc.CallInfo) {
+	s.begin("chanrpc", ci.ID())
+	s.server.Exec(ci)
+	s.end()
+}
+
+func (s *Skeleton) handleCommand(ci *chanrpc.CallInfo) {
+	s.begin("command", ci.ID())
+	s.commandServer.Exec(ci)
+	s.end()
+}
+
+func (s *Skeleton) handleGo(cb func()) {
+	s.begin("go", cb)
+	s.g.Cb(cb)
+	s.end()
+}
+
+func (s *Skeleton) handleTimer(t *timer.Timer) {
+	s.begin("timer", t.Func())
+	t.Cb()
+	s.end()
+}
+
+func (s *Skeleton) begin(kind string, handler interface{}) {
+	atomic.StoreInt64(&s.busySince, time.Now().UnixNano())
+	s.watchdog.begin(kind, handler)
+}
+
+func (s *Skeleton) end() {
+	s.watchdog.end()
+	atomic.StoreInt64(&s.busySince, 0)
+}
+
+// how long the current handler has been running, 0 if idle
+// goroutine safe
+func (s *Skeleton) Busy() time.Duration {
+	busySince := atomic.LoadInt64(&s.busySince)
+	if busySince == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - busySince)
+}
+
+// the number of events waiting in each queue, see QueueModule
+// goroutine safe
+func (s *Skeleton) QueueLen() map[string]int {
+	return map[string]int{
+		"chanrpc": len(s.server.ChanCall),
+		"command": len(s.commandServer.ChanCall),
+		"go":      len(s.g.ChanCb),
+		"timer":   len(s.dispatcher.ChanTimer),
+		"asynret": len(s.client.ChanAsynRet),
+	}
+}
+
+// latency of the handlers run so far, nil unless SlowHandlerThreshold is set
+// goroutine safe
+func (s *Skeleton) HandlerStats() []*HandlerStat {
+	return s.watchdog.handlerStats()
+}
+
 func (s *Skeleton) GetChanAsynRet() chan *chanrpc.RetInfo {
 	return s.client.ChanAsynRet
 }
 
+// the time of the timers, use it instead of time.Now for what the timers schedule
+func (s *Skeleton) Now() time.Time {
+	return s.Clock.Now()
+}
+
 func (s *Skeleton) AfterFunc(d time.Duration, cb func()) *timer.Timer {
 	if s.TimerDispatcherLen == 0 {
 		panic("invalid TimerDispatcherLen")
@@ -79,6 +218,30 @@ func (s *Skeleton) AfterFunc(d time.Duration, cb func()) *timer.Timer {
 	return s.dispatcher.AfterFunc(d, cb)
 }
 
+func (s *Skeleton) AfterFuncJitter(d time.Duration, jitter time.Duration, cb func()) *timer.Timer {
+	if s.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return s.dispatcher.AfterFuncJitter(d, jitter, cb)
+}
+
+func (s *Skeleton) Every(d time.Duration, cb func()) *timer.Timer {
+	if s.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return s.dispatcher.Every(d, cb)
+}
+
+func (s *Skeleton) EveryJitter(d time.Duration, jitter time.Duration, cb func()) *timer.Timer {
+	if s.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return s.dispatcher.EveryJitter(d, jitter, cb)
+}
+
 func (s *Skeleton) CronFunc(cronExpr *timer.CronExpr, cb func()) *timer.Cron {
 	if s.TimerDispatcherLen == 0 {
 		panic("invalid TimerDispatcherLen")
@@ -120,6 +283,33 @@ func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	s.server.Register(id, f)
 }
 
+// the console and the logger set are kept, see AppModule
+func (s *Skeleton) SetApp(c *console.Console, logger *log.Logger) {
+	if s == nil {
+		return
+	}
+	if s.Console == nil {
+		s.Console = c
+	}
+	if s.Logger == nil {
+		s.Logger = logger
+	}
+}
+
+func (s *Skeleton) getConsole() *console.Console {
+	if s.Console == nil {
+		s.Console = console.Default
+	}
+	return s.Console
+}
+
 func (s *Skeleton) RegisterCommand(name string, help string, f interface{}) {
-	console.Register(name, help, f, s.commandServer)
+	s.getConsole().Register(name, help, f, s.commandServer)
+	s.commands = append(s.commands, name)
+}
+
+// spec.Run is called on the module goroutine
+func (s *Skeleton) RegisterCommandSpec(spec *console.Spec) {
+	s.getConsole().RegisterSpec(spec, s.commandServer)
+	s.commands = append(s.commands, spec.Name)
 }
@@ -0,0 +1,199 @@
+package module
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/islovingness/leaf/conf"
+	"github.com/islovingness/leaf/log"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// upper bounds of the latency histogram buckets, the last bucket is unbounded
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type HandlerStat struct {
+	Name    string
+	Count   int64
+	Total   time.Duration
+	Max     time.Duration
+	Buckets []int64
+}
+
+type watchdog struct {
+	threshold time.Duration
+	names     map[uintptr]string
+
+	sync.Mutex
+	logger    *log.Logger
+	goroutine []byte
+	name      string
+	start     time.Time
+	reported  bool
+	stats     map[string]*HandlerStat
+}
+
+func newWatchdog(threshold time.Duration) *watchdog {
+	w := new(watchdog)
+	w.threshold = threshold
+	w.names = make(map[uintptr]string)
+	w.stats = make(map[string]*HandlerStat)
+	return w
+}
+
+// called on the skeleton goroutine, reports handlers which are still running
+// after the threshold with the stack of that goroutine
+func (w *watchdog) run(closeSig chan bool, logger *log.Logger) {
+	if w == nil {
+		return
+	}
+
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	w.Lock()
+	w.logger = logger
+	w.goroutine = buf[:bytes.IndexByte(buf, '[')]
+	w.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(w.threshold)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closeSig:
+				return
+			case <-ticker.C:
+				w.check()
+			}
+		}
+	}()
+}
+
+func (w *watchdog) check() {
+	w.Lock()
+	if w.name == "" || w.reported || time.Since(w.start) < w.threshold {
+		w.Unlock()
+		return
+	}
+	w.reported = true
+	name := w.name
+	elapsed := time.Since(w.start)
+	goroutine := w.goroutine
+	logger := w.logger
+	w.Unlock()
+
+	logger.Error("slow handler %v: running for %v\n%s", name, elapsed, goroutineStack(goroutine))
+}
+
+func goroutineStack(goroutine []byte) []byte {
+	buf := make([]byte, conf.LenStackBuf*16)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	i := bytes.Index(buf, goroutine)
+	if i < 0 {
+		return nil
+	}
+	stack := buf[i:]
+	if j := bytes.Index(stack, []byte("\n\n")); j >= 0 {
+		stack = stack[:j]
+	}
+	return stack
+}
+
+func (w *watchdog) begin(kind string, id interface{}) {
+	if w == nil {
+		return
+	}
+
+	name := kind + " " + w.handlerName(id)
+	w.Lock()
+	w.name = name
+	w.start = time.Now()
+	w.reported = false
+	w.Unlock()
+}
+
+func (w *watchdog) end() {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	elapsed := time.Since(w.start)
+	if elapsed >= w.threshold && !w.reported {
+		w.logger.Error("slow handler %v: took %v", w.name, elapsed)
+	}
+
+	stat, ok := w.stats[w.name]
+	if !ok {
+		stat = &HandlerStat{Name: w.name, Buckets: make([]int64, len(LatencyBuckets)+1)}
+		w.stats[w.name] = stat
+	}
+	stat.Count++
+	stat.Total += elapsed
+	if elapsed > stat.Max {
+		stat.Max = elapsed
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool {
+		return elapsed <= LatencyBuckets[i]
+	})
+	stat.Buckets[i]++
+
+	w.name = ""
+}
+
+func (w *watchdog) handlerName(id interface{}) string {
+	if id == nil {
+		return "<nil>"
+	}
+
+	v := reflect.ValueOf(id)
+	if v.Kind() != reflect.Func {
+		return fmt.Sprint(id)
+	}
+
+	pc := v.Pointer()
+	name, ok := w.names[pc]
+	if !ok {
+		name = "<unknown>"
+		if f := runtime.FuncForPC(pc); f != nil {
+			name = f.Name()
+		}
+		w.names[pc] = name
+	}
+	return name
+}
+
+func (w *watchdog) handlerStats() []*HandlerStat {
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	stats := make([]*HandlerStat, 0, len(w.stats))
+	for _, stat := range w.stats {
+		s := *stat
+		s.Buckets = append([]int64(nil), stat.Buckets...)
+		stats = append(stats, &s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Total > stats[j].Total
+	})
+	return stats
+}
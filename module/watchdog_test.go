@@ -0,0 +1,92 @@
+package module
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/islovingness/leaf/chanrpc"
+	"github.com/islovingness/leaf/log"
+)
+
+func TestWatchdog(t *testing.T) {
+	logDir := t.TempDir()
+	logger, err := log.New("release", logDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	s := &Skeleton{
+		ChanRPCServer:        chanrpc.NewServer(10),
+		SlowHandlerThreshold: 20 * time.Millisecond,
+		Logger:               logger,
+	}
+	s.Init()
+	s.RegisterChanRPC("slow", func(args []interface{}) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	s.RegisterChanRPC("fast", func(args []interface{}) error {
+		return nil
+	})
+
+	closeSig := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+	for _, id := range []string{"fast", "slow", "fast", "fast"} {
+		if err := s.ChanRPCServer.Call0(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeSig <- true
+	<-done
+
+	stats := s.HandlerStats()
+	if len(stats) != 2 || stats[0].Name != "chanrpc slow" || stats[1].Name != "chanrpc fast" {
+		t.Fatalf("stats: %v", stats)
+	}
+	slow, fast := stats[0], stats[1]
+	if slow.Count != 1 || slow.Max < 100*time.Millisecond || slow.Total != slow.Max {
+		t.Fatalf("slow: %+v", slow)
+	}
+	// 100ms falls in (50ms, 100ms] or (100ms, 500ms]
+	if len(slow.Buckets) != len(LatencyBuckets)+1 || slow.Buckets[4]+slow.Buckets[5] != 1 {
+		t.Fatalf("slow buckets: %v", slow.Buckets)
+	}
+	if fast.Count != 3 || fast.Max >= s.SlowHandlerThreshold {
+		t.Fatalf("fast: %+v", fast)
+	}
+	var n int64
+	for i, count := range fast.Buckets {
+		if i > 3 && count != 0 {
+			t.Fatalf("fast buckets: %v", fast.Buckets)
+		}
+		n += count
+	}
+	if n != fast.Count {
+		t.Fatalf("fast buckets: %v", fast.Buckets)
+	}
+
+	files, err := ioutil.ReadDir(logDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("log files: %v, %v", files, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(logDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(data)
+	// reported once while running, with the stack of the module goroutine
+	if strings.Count(output, "slow handler") != 1 ||
+		!strings.Contains(output, "slow handler chanrpc slow: running for") ||
+		!strings.Contains(output, "module.TestWatchdog") ||
+		!strings.Contains(output, "module.(*Skeleton).handleChanRPC") {
+		t.Fatalf("log: %v", output)
+	}
+}
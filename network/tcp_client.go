@@ -13,6 +13,7 @@ type TCPClient struct {
 	ConnNum         int
 	ConnectInterval time.Duration
 	PendingWriteNum int
+	WriteTimeout    time.Duration
 	AutoReconnect   bool
 	NewAgent        func(*TCPConn) Agent
 	conns           ConnSet
@@ -100,7 +101,7 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser)
+	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.WriteTimeout, client.msgParser)
 	agent := client.NewAgent(tcpConn)
 	agent.Run()
 
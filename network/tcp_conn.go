@@ -1,29 +1,51 @@
 package network
 
 import (
+	"errors"
 	"github.com/islovingness/leaf/log"
 	"net"
 	"sync"
+	"time"
 )
 
 type ConnSet map[net.Conn]struct{}
 
+var ErrWriteTimeout = errors.New("write channel full: timeout")
+
 type TCPConn struct {
 	sync.Mutex
 	conn      	net.Conn
 	writeChan 	chan []byte
 	closeFlag 	bool
 	msgParser 	*MsgParser
+
+	// 0: destroy the connection when writeChan is full
+	// >0: wait for room in writeChan and fail the write on timeout
+	writeTimeout time.Duration
+	// closed once nothing is taken from writeChan any more
+	closeSig chan bool
+	// one for each buffer in writeChan or room reserved in it,
+	// so that sending to writeChan never blocks
+	slots chan struct{}
 }
 
-func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
+func newTCPConn(conn net.Conn, pendingWriteNum int, writeTimeout time.Duration, msgParser *MsgParser) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
 	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
+	tcpConn.writeTimeout = writeTimeout
+	tcpConn.closeSig = make(chan bool)
+	tcpConn.slots = make(chan struct{}, pendingWriteNum)
 	tcpConn.msgParser = msgParser
 
 	go func() {
-		for b := range tcpConn.writeChan {
+		for {
+			var b []byte
+			select {
+			case b = <-tcpConn.writeChan:
+				<-tcpConn.slots
+			case <-tcpConn.closeSig:
+			}
 			if b == nil {
 				break
 			}
@@ -37,20 +59,29 @@ func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPCo
 		conn.Close()
 		tcpConn.Lock()
 		tcpConn.closeFlag = true
+		tcpConn.doClose()
 		tcpConn.Unlock()
 	}()
 
 	return tcpConn
 }
 
+// wakes up the writers waiting for room, writeChan is never closed as
+// they send to it without holding the lock
+func (tcpConn *TCPConn) doClose() {
+	select {
+	case <-tcpConn.closeSig:
+	default:
+		close(tcpConn.closeSig)
+	}
+}
+
 func (tcpConn *TCPConn) doDestroy() {
 	tcpConn.conn.(*net.TCPConn).SetLinger(0)
 	tcpConn.conn.Close()
 
-	if !tcpConn.closeFlag {
-		close(tcpConn.writeChan)
-		tcpConn.closeFlag = true
-	}
+	tcpConn.closeFlag = true
+	tcpConn.doClose()
 }
 
 func (tcpConn *TCPConn) Destroy() {
@@ -72,7 +103,9 @@ func (tcpConn *TCPConn) Close() {
 }
 
 func (tcpConn *TCPConn) doWrite(b []byte) {
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
+	select {
+	case tcpConn.slots <- struct{}{}:
+	default:
 		log.Debug("close conn: channel full")
 		tcpConn.doDestroy()
 		return
@@ -83,13 +116,98 @@ func (tcpConn *TCPConn) doWrite(b []byte) {
 
 // b must not be modified by the others goroutines
 func (tcpConn *TCPConn) Write(b []byte) {
+	err := tcpConn.write(b)
+	if err != nil {
+		log.Error("write conn: %v, message dropped", err)
+	}
+}
+
+func (tcpConn *TCPConn) write(b []byte) error {
+	if b == nil {
+		return nil
+	}
+	err := tcpConn.reserve()
+	if err != nil {
+		return err
+	}
+	tcpConn.writeReserved(b)
+	return nil
+}
+
+// takes room in writeChan for the next writeReserved, waits for it as write
+// does, nothing is reserved once the connection is closed
+func (tcpConn *TCPConn) reserve() error {
+	tcpConn.Lock()
+	if tcpConn.closeFlag {
+		tcpConn.Unlock()
+		return nil
+	}
+	select {
+	case tcpConn.slots <- struct{}{}:
+		tcpConn.Unlock()
+		return nil
+	default:
+	}
+	if tcpConn.writeTimeout <= 0 {
+		log.Debug("close conn: channel full")
+		tcpConn.doDestroy()
+		tcpConn.Unlock()
+		return nil
+	}
+	tcpConn.Unlock()
+
+	// Close and Destroy must not wait for a slow peer
+	t := time.NewTimer(tcpConn.writeTimeout)
+	defer t.Stop()
+
+	select {
+	case tcpConn.slots <- struct{}{}:
+		return nil
+	case <-tcpConn.closeSig:
+		return nil
+	case <-t.C:
+		return ErrWriteTimeout
+	}
+}
+
+// b nil gives back the room taken by reserve
+func (tcpConn *TCPConn) writeReserved(b []byte) {
 	tcpConn.Lock()
 	defer tcpConn.Unlock()
-	if tcpConn.closeFlag || b == nil {
+	if tcpConn.closeFlag {
 		return
 	}
 
-	tcpConn.doWrite(b)
+	if b == nil {
+		<-tcpConn.slots
+		return
+	}
+	tcpConn.writeChan <- b
+}
+
+// ReserveWrite waits for room in the write queue as WriteMsg does and keeps
+// it for the next WriteReservedMsg or CancelWrite, which never wait. A writer
+// whose messages depend on the ones before, as with a gob stream, reserves
+// before encoding so that no encoded message is dropped for lack of room
+func (tcpConn *TCPConn) ReserveWrite() error {
+	return tcpConn.reserve()
+}
+
+// CancelWrite gives back the room taken by ReserveWrite
+func (tcpConn *TCPConn) CancelWrite() {
+	tcpConn.writeReserved(nil)
+}
+
+// WriteReservedMsg writes a message in the room taken by ReserveWrite,
+// the room is given back if the message cannot be written
+func (tcpConn *TCPConn) WriteReservedMsg(args ...[]byte) error {
+	msg, err := tcpConn.msgParser.pack(args...)
+	if err != nil {
+		tcpConn.CancelWrite()
+		return err
+	}
+	tcpConn.writeReserved(msg)
+	return nil
 }
 
 func (tcpConn *TCPConn) Read(b []byte) (int, error) {
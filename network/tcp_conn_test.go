@@ -0,0 +1,131 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// a connection whose peer reads nothing
+func newStalledConn(t *testing.T, pendingWriteNum int, writeTimeout time.Duration) (*TCPConn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	chanPeer := make(chan net.Conn, 1)
+	go func() {
+		peer, err := ln.Accept()
+		if err != nil {
+			close(chanPeer)
+			return
+		}
+		chanPeer <- peer
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, ok := <-chanPeer
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	return newTCPConn(conn, pendingWriteNum, writeTimeout, NewMsgParser()), peer
+}
+
+// writes until the socket buffers and writeChan are full
+func fill(t *testing.T, tcpConn *TCPConn, b []byte) {
+	for i := 0; i < 1024; i++ {
+		err := tcpConn.write(b)
+		if err == ErrWriteTimeout {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("write queue never full")
+}
+
+func TestTCPConnWriteTimeout(t *testing.T) {
+	tcpConn, peer := newStalledConn(t, 1, 50*time.Millisecond)
+	defer peer.Close()
+	b := make([]byte, 1<<20)
+	fill(t, tcpConn, b)
+
+	// the link is kept and the writes keep failing while the peer is stalled
+	start := time.Now()
+	if err := tcpConn.write(b); err != ErrWriteTimeout {
+		t.Fatalf("write: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("write failed after %v", d)
+	}
+
+	// Destroy does not wait for the pending write, which gives up at once
+	tcpConn.writeTimeout = time.Hour
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- tcpConn.write(b)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start = time.Now()
+	tcpConn.Destroy()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Destroy took %v", d)
+	}
+	select {
+	case err := <-chanErr:
+		if err != nil {
+			t.Fatalf("write after Destroy: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still pending after Destroy")
+	}
+}
+
+func TestTCPConnClosePendingWrite(t *testing.T) {
+	tcpConn, peer := newStalledConn(t, 1, 50*time.Millisecond)
+	defer peer.Close()
+	b := make([]byte, 1<<20)
+	fill(t, tcpConn, b)
+
+	tcpConn.writeTimeout = time.Hour
+	go tcpConn.write(b)
+	time.Sleep(50 * time.Millisecond)
+
+	// writeChan is full, Close destroys the connection
+	chanDone := make(chan bool)
+	go func() {
+		tcpConn.Close()
+		chanDone <- true
+	}()
+	select {
+	case <-chanDone:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by the pending write")
+	}
+}
+
+func TestTCPConnChannelFull(t *testing.T) {
+	tcpConn, peer := newStalledConn(t, 1, 0)
+	defer peer.Close()
+	b := make([]byte, 1<<20)
+
+	// without a timeout the connection is destroyed when writeChan is full
+	for i := 0; i < 1024; i++ {
+		if err := tcpConn.write(b); err != nil {
+			t.Fatal(err)
+		}
+		tcpConn.Lock()
+		closeFlag := tcpConn.closeFlag
+		tcpConn.Unlock()
+		if closeFlag {
+			return
+		}
+	}
+	t.Fatal("connection never destroyed")
+}
@@ -108,6 +108,15 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 
 // goroutine safe
 func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
+	msg, err := p.pack(args...)
+	if err != nil {
+		return err
+	}
+	return conn.write(msg)
+}
+
+// the message with its length
+func (p *MsgParser) pack(args ...[]byte) ([]byte, error) {
 	// get len
 	var msgLen uint32
 	for i := 0; i < len(args); i++ {
@@ -116,9 +125,9 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 
 	// check len
 	if msgLen > p.maxMsgLen {
-		return errors.New("message too long")
+		return nil, errors.New("message too long")
 	} else if msgLen < p.minMsgLen {
-		return errors.New("message too short")
+		return nil, errors.New("message too short")
 	}
 
 	msg := make([]byte, uint32(p.lenMsgLen)+msgLen)
@@ -148,7 +157,5 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 		l += len(args[i])
 	}
 
-	conn.Write(msg)
-
-	return nil
+	return msg, nil
 }
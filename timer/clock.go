@@ -0,0 +1,146 @@
+package timer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// where timers get the time from, tests use a FakeClock
+type Clock interface {
+	Now() time.Time
+	// f is called on its own goroutine, or on the one advancing a FakeClock
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+type ClockTimer interface {
+	// false if the timer had fired or been stopped
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// the time package
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// FakeClock only moves when told, the due timers fire in order of time
+// on the goroutine calling Advance or Set
+// goroutine safe
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	seq    int64
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	// timers due at the same time fire in the order they were set
+	seq int64
+	f   func()
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := new(FakeClock)
+	c.now = now
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &fakeTimer{clock: c, f: f}
+	c.add(t, d)
+	return t
+}
+
+// must hold the mutex
+func (c *FakeClock) add(t *fakeTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	t.seq = c.seq
+	c.seq++
+	i := sort.Search(len(c.timers), func(i int) bool {
+		u := c.timers[i]
+		return u.when.After(t.when) || u.when.Equal(t.when) && u.seq > t.seq
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+}
+
+// must hold the mutex
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, u := range c.timers {
+		if u == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// moves the clock forward by d, see Set
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// moves the clock to now, firing the timers due meanwhile one by one with
+// the clock set to their time, a timer set by them fires too if it is due
+// a dispatcher using the clock sends its timers to ChanTimer meanwhile,
+// which blocks unless it has room or is drained by another goroutine
+// the clock never moves backwards
+func (c *FakeClock) Set(now time.Time) {
+	for {
+		c.mutex.Lock()
+		if len(c.timers) == 0 || c.timers[0].when.After(now) {
+			if now.After(c.now) {
+				c.now = now
+			}
+			c.mutex.Unlock()
+			return
+		}
+
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.mutex.Unlock()
+
+		t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.clock.remove(t)
+	t.clock.add(t, d)
+	return active
+}
@@ -0,0 +1,89 @@
+package timer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeClockOrder(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	var fired []string
+	add := func(name string, d time.Duration) ClockTimer {
+		return clock.AfterFunc(d, func() {
+			// the clock is at the time of the timer
+			fired = append(fired, name+" "+clock.Now().Sub(start).String())
+		})
+	}
+	add("c", 3*time.Second)
+	add("a", time.Second)
+	// due together, in the order they were set
+	add("b1", 2*time.Second)
+	add("b2", 2*time.Second)
+	clock.AfterFunc(time.Second, func() {
+		// set meanwhile and due before the end of the move
+		add("a2", 500*time.Millisecond)
+	})
+	stopped := add("stopped", 2*time.Second)
+	reset := add("reset", time.Second)
+	add("later", 10*time.Second)
+
+	if !stopped.Stop() {
+		t.Fatal("stop: not active")
+	}
+	if !reset.Reset(4 * time.Second) {
+		t.Fatal("reset: not active")
+	}
+
+	clock.Advance(5 * time.Second)
+	want := []string{"a 1s", "a2 1.5s", "b1 2s", "b2 2s", "c 3s", "reset 4s"}
+	if !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(5 * time.Second)) {
+		t.Fatalf("now: %v", now)
+	}
+	if stopped.Stop() || reset.Stop() {
+		t.Fatal("stop after firing: active")
+	}
+
+	// never backwards
+	clock.Set(start)
+	if now := clock.Now(); !now.Equal(start.Add(5 * time.Second)) {
+		t.Fatalf("set backwards: %v", now)
+	}
+
+	fired = nil
+	clock.Set(start.Add(10 * time.Second))
+	if want := []string{"later 10s"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+}
+
+func TestFakeClockCron(t *testing.T) {
+	start := time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	disp := NewDispatcherClock(10, clock)
+	f := newFirings(disp, clock)
+
+	cronExpr, err := NewCronExpr("0 0 5 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a daily reset, three days pass in no time
+	cron := disp.CronFunc(cronExpr, f.cb("reset"))
+	for h := time.Duration(0); h <= 72; h++ {
+		f.set(h * time.Hour)
+	}
+	cron.Stop()
+	f.set(100 * time.Hour)
+
+	want := map[string][]time.Duration{
+		"reset": {17 * time.Hour, 41 * time.Hour, 65 * time.Hour},
+	}
+	if at := f.take(); !reflect.DeepEqual(at, want) {
+		t.Fatalf("fired at %v, want %v", at, want)
+	}
+}
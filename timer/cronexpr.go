@@ -9,14 +9,27 @@ import (
 	"time"
 )
 
-// Field name   | Mandatory? | Allowed values | Allowed special characters
-// ----------   | ---------- | -------------- | --------------------------
-// Seconds      | No         | 0-59           | * / , -
-// Minutes      | Yes        | 0-59           | * / , -
-// Hours        | Yes        | 0-23           | * / , -
-// Day of month | Yes        | 1-31           | * / , -
-// Month        | Yes        | 1-12           | * / , -
-// Day of week  | Yes        | 0-6            | * / , -
+// Field name   | Mandatory? | Allowed values  | Allowed special characters
+// ----------   | ---------- | --------------  | --------------------------
+// Seconds      | No         | 0-59            | * / , -
+// Minutes      | Yes        | 0-59            | * / , -
+// Hours        | Yes        | 0-23            | * / , -
+// Day of month | Yes        | 1-31            | * / , - L W
+// Month        | Yes        | 1-12 or JAN-DEC | * / , -
+// Day of week  | Yes        | 0-7 or SUN-SAT  | * / , - L #
+//
+// L: the last day of the month, LW: the last weekday (Monday to Friday) of
+// the month, 15W: the weekday nearest to the 15th within the month,
+// 5L: the last Friday of the month, 5#3: the third Friday of the month
+// day of week 7 is Sunday too
+//
+// instead of the fields: @yearly (or @annually), @monthly, @weekly,
+// @daily (or @midnight), @hourly, or @every <duration> such as @every 1h30m
+// which fires every duration counted from the time passed to Next
+//
+// the expression may start with TZ=<zone> (or CRON_TZ=<zone>), e.g.
+// TZ=Asia/Shanghai 0 0 5 * * *, to be evaluated in that time zone instead
+// of the one of the time passed to Next
 type CronExpr struct {
 	sec   uint64
 	min   uint64
@@ -24,11 +37,82 @@ type CronExpr struct {
 	dom   uint64
 	month uint64
 	dow   uint64
+
+	// day of month: L, LW and bits of nW
+	lastDom        bool
+	lastWeekday    bool
+	nearestWeekday uint64
+	// day of week: bits of nL, bits of n#k per weekday
+	lastDow uint64
+	nthDow  [7]uint64
+
+	// @every
+	every time.Duration
+	// nil: the location of the time passed to Next
+	loc *time.Location
 }
 
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+var (
+	cronMonthNames = map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}
+	cronDayNames = map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}
+)
+
 // goroutine safe
 func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 	fields := strings.Fields(expr)
+
+	// time zone
+	var loc *time.Location
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "TZ=") || strings.HasPrefix(fields[0], "CRON_TZ=")) {
+		name := fields[0][strings.Index(fields[0], "=")+1:]
+		loc, err = time.LoadLocation(name)
+		if err != nil {
+			err = fmt.Errorf("invalid expr %v: invalid time zone %v", expr, name)
+			return
+		}
+		fields = fields[1:]
+	}
+
+	// macros
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		if fields[0] == "@every" {
+			if len(fields) != 2 {
+				err = fmt.Errorf("invalid expr %v: expected @every <duration>", expr)
+				return
+			}
+			var every time.Duration
+			every, err = time.ParseDuration(fields[1])
+			if err != nil || every < time.Second {
+				err = fmt.Errorf("invalid expr %v: invalid duration %v", expr, fields[1])
+				return
+			}
+			cronExpr = &CronExpr{every: every.Truncate(time.Second), loc: loc}
+			return
+		}
+
+		macro, ok := cronMacros[fields[0]]
+		if !ok || len(fields) != 1 {
+			err = fmt.Errorf("invalid expr %v: unknown macro %v", expr, strings.Join(fields, " "))
+			return
+		}
+		fields = strings.Fields(macro)
+	}
+
 	if len(fields) != 5 && len(fields) != 6 {
 		err = fmt.Errorf("invalid expr %v: expected 5 or 6 fields, got %v", expr, len(fields))
 		return
@@ -39,33 +123,34 @@ func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 	}
 
 	cronExpr = new(CronExpr)
+	cronExpr.loc = loc
 	// Seconds
-	cronExpr.sec, err = parseCronField(fields[0], 0, 59)
+	cronExpr.sec, err = parseCronField(fields[0], 0, 59, nil)
 	if err != nil {
 		goto onError
 	}
 	// Minutes
-	cronExpr.min, err = parseCronField(fields[1], 0, 59)
+	cronExpr.min, err = parseCronField(fields[1], 0, 59, nil)
 	if err != nil {
 		goto onError
 	}
 	// Hours
-	cronExpr.hour, err = parseCronField(fields[2], 0, 23)
+	cronExpr.hour, err = parseCronField(fields[2], 0, 23, nil)
 	if err != nil {
 		goto onError
 	}
 	// Day of month
-	cronExpr.dom, err = parseCronField(fields[3], 1, 31)
+	err = cronExpr.parseDomField(fields[3])
 	if err != nil {
 		goto onError
 	}
 	// Month
-	cronExpr.month, err = parseCronField(fields[4], 1, 12)
+	cronExpr.month, err = parseCronField(fields[4], 1, 12, cronMonthNames)
 	if err != nil {
 		goto onError
 	}
 	// Day of week
-	cronExpr.dow, err = parseCronField(fields[5], 0, 6)
+	err = cronExpr.parseDowField(fields[5])
 	if err != nil {
 		goto onError
 	}
@@ -76,13 +161,87 @@ onError:
 	return
 }
 
+// L, LW, nW or what parseCronField accepts
+func (e *CronExpr) parseDomField(field string) error {
+	var rest []string
+	for _, item := range strings.Split(field, ",") {
+		switch {
+		case strings.EqualFold(item, "L"):
+			e.lastDom = true
+		case strings.EqualFold(item, "LW"):
+			e.lastWeekday = true
+		case len(item) > 1 && (item[len(item)-1] == 'W' || item[len(item)-1] == 'w'):
+			day, err := strconv.Atoi(item[:len(item)-1])
+			if err != nil || day < 1 || day > 31 {
+				return fmt.Errorf("invalid nearest weekday: %v", item)
+			}
+			e.nearestWeekday |= 1 << uint(day)
+		default:
+			rest = append(rest, item)
+		}
+	}
+
+	if len(rest) > 0 {
+		var err error
+		e.dom, err = parseCronField(strings.Join(rest, ","), 1, 31, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nL, n#k or what parseCronField accepts, 7 is Sunday
+func (e *CronExpr) parseDowField(field string) error {
+	var rest []string
+	for _, item := range strings.Split(field, ",") {
+		if i := strings.Index(item, "#"); i >= 0 {
+			day, err := parseCronValue(item[:i], cronDayNames)
+			nth, err2 := strconv.Atoi(item[i+1:])
+			if err != nil || err2 != nil || day < 0 || day > 7 || nth < 1 || nth > 5 {
+				return fmt.Errorf("invalid nth weekday: %v", item)
+			}
+			e.nthDow[day%7] |= 1 << uint(nth)
+		} else if len(item) > 1 && (item[len(item)-1] == 'L' || item[len(item)-1] == 'l') {
+			day, err := parseCronValue(item[:len(item)-1], cronDayNames)
+			if err != nil || day < 0 || day > 7 {
+				return fmt.Errorf("invalid last weekday: %v", item)
+			}
+			e.lastDow |= 1 << uint(day%7)
+		} else {
+			rest = append(rest, item)
+		}
+	}
+
+	if len(rest) > 0 {
+		var err error
+		e.dow, err = parseCronField(strings.Join(rest, ","), 0, 7, cronDayNames)
+		if err != nil {
+			return err
+		}
+		// 7 is Sunday
+		if e.dow&(1<<7) != 0 {
+			e.dow = e.dow&^(1<<7) | 1
+		}
+	}
+	return nil
+}
+
+// a number or one of names, case insensitive
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	return strconv.Atoi(s)
+}
+
 // 1. *
 // 2. num
 // 3. num-num
 // 4. */num
 // 5. num/num (means num-max/num)
 // 6. num-num/num
-func parseCronField(field string, min int, max int) (cronField uint64, err error) {
+func parseCronField(field string, min int, max int, names map[string]int) (cronField uint64, err error) {
 	fields := strings.Split(field, ",")
 	for _, field := range fields {
 		rangeAndIncr := strings.Split(field, "/")
@@ -108,7 +267,7 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 			end = max
 		} else {
 			// start
-			start, err = strconv.Atoi(startAndEnd[0])
+			start, err = parseCronValue(startAndEnd[0], names)
 			if err != nil {
 				err = fmt.Errorf("invalid range: %v", rangeAndIncr[0])
 				return
@@ -121,7 +280,7 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 					end = start
 				}
 			} else {
-				end, err = strconv.Atoi(startAndEnd[1])
+				end, err = parseCronValue(startAndEnd[1], names)
 				if err != nil {
 					err = fmt.Errorf("invalid range: %v", rangeAndIncr[0])
 					return
@@ -174,20 +333,83 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 func (e *CronExpr) matchDay(t time.Time) bool {
 	// day-of-month blank
 	if e.dom == 0xfffffffe {
-		return 1<<uint(t.Weekday())&e.dow != 0
+		return e.matchDow(t)
 	}
 
 	// day-of-week blank
 	if e.dow == 0x7f {
-		return 1<<uint(t.Day())&e.dom != 0
+		return e.matchDom(t)
+	}
+
+	return e.matchDow(t) || e.matchDom(t)
+}
+
+func (e *CronExpr) matchDom(t time.Time) bool {
+	day := t.Day()
+	if 1<<uint(day)&e.dom != 0 {
+		return true
+	}
+	if !e.lastDom && !e.lastWeekday && e.nearestWeekday == 0 {
+		return false
+	}
+
+	last := daysInMonth(t)
+	if e.lastDom && day == last {
+		return true
+	}
+	if e.lastWeekday && day == nearestWeekday(t, last, last) {
+		return true
 	}
+	for n := 1; n <= last; n++ {
+		if 1<<uint(n)&e.nearestWeekday != 0 && day == nearestWeekday(t, n, last) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *CronExpr) matchDow(t time.Time) bool {
+	weekday := uint(t.Weekday())
+	if 1<<weekday&e.dow != 0 {
+		return true
+	}
+	if 1<<weekday&e.lastDow != 0 && t.Day()+7 > daysInMonth(t) {
+		return true
+	}
+	return 1<<uint((t.Day()-1)/7+1)&e.nthDow[weekday] != 0
+}
 
-	return 1<<uint(t.Weekday())&e.dow != 0 ||
-		1<<uint(t.Day())&e.dom != 0
+func daysInMonth(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
+
+// the Monday to Friday day nearest to day n of the month of t, within the month
+func nearestWeekday(t time.Time, n int, last int) int {
+	switch time.Weekday((int(t.Weekday()) + n - t.Day() + 35) % 7) {
+	case time.Saturday:
+		if n == 1 {
+			return 3
+		}
+		return n - 1
+	case time.Sunday:
+		if n == last {
+			return n - 2
+		}
+		return n + 1
+	default:
+		return n
+	}
 }
 
 // goroutine safe
 func (e *CronExpr) Next(t time.Time) time.Time {
+	if e.loc != nil {
+		t = t.In(e.loc)
+	}
+	if e.every > 0 {
+		return t.Truncate(time.Second).Add(e.every)
+	}
+
 	// the upcoming second
 	t = t.Truncate(time.Second).Add(time.Second)
 
@@ -195,8 +417,8 @@ func (e *CronExpr) Next(t time.Time) time.Time {
 	initFlag := false
 
 retry:
-	// Year
-	if t.Year() > year+1 {
+	// Year, leap days may be 8 years apart
+	if t.Year() > year+8 {
 		return time.Time{}
 	}
 
@@ -230,7 +452,8 @@ retry:
 	for 1<<uint(t.Hour())&e.hour == 0 {
 		if !initFlag {
 			initFlag = true
-			t = t.Truncate(time.Hour)
+			// Truncate rounds absolute time, wrong in zones with a half-hour offset
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
 		}
 
 		t = t.Add(time.Hour)
@@ -243,7 +466,7 @@ retry:
 	for 1<<uint(t.Minute())&e.min == 0 {
 		if !initFlag {
 			initFlag = true
-			t = t.Truncate(time.Minute)
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
 		}
 
 		t = t.Add(time.Minute)
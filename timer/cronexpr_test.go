@@ -0,0 +1,118 @@
+package timer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronExprNext(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	kathmandu, err := time.LoadLocation("Asia/Kathmandu")
+	if err != nil {
+		t.Skip(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(loc *time.Location, year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, loc)
+	}
+	utc := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return date(time.UTC, year, month, day, hour, min, sec)
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		// time zones, the hours of Kolkata and Kathmandu start at half or three quarters past UTC hours
+		{"TZ=Asia/Kolkata 0 0 5 * * *", date(kolkata, 2000, 1, 1, 7, 40, 0), date(kolkata, 2000, 1, 2, 5, 0, 0)},
+		{"TZ=Asia/Kolkata 0 0 5 * * *", utc(2000, 1, 1, 23, 0, 0), date(kolkata, 2000, 1, 2, 5, 0, 0)},
+		{"TZ=Asia/Kathmandu 0 30 5 * * *", date(kathmandu, 2000, 1, 1, 7, 40, 0), date(kathmandu, 2000, 1, 2, 5, 30, 0)},
+		{"TZ=Asia/Kolkata 0 */30 * * * *", date(kolkata, 2000, 1, 1, 7, 40, 10), date(kolkata, 2000, 1, 1, 8, 0, 0)},
+		{"TZ=Asia/Kolkata @hourly", date(kolkata, 2000, 1, 1, 7, 40, 0), date(kolkata, 2000, 1, 1, 8, 0, 0)},
+		{"CRON_TZ=America/New_York 0 0 9 * * *", utc(2000, 1, 1, 12, 0, 0), date(newYork, 2000, 1, 1, 9, 0, 0)},
+		{"0 0 5 * * *", date(kathmandu, 2000, 1, 1, 7, 40, 0), date(kathmandu, 2000, 1, 2, 5, 0, 0)},
+
+		// L, LW and nW
+		{"0 0 0 L * *", utc(2000, 2, 10, 0, 0, 0), utc(2000, 2, 29, 0, 0, 0)},
+		{"0 0 0 L * *", utc(2001, 2, 10, 0, 0, 0), utc(2001, 2, 28, 0, 0, 0)},
+		{"0 0 0 LW * *", utc(2000, 9, 1, 0, 0, 0), utc(2000, 9, 29, 0, 0, 0)},
+		{"0 0 0 15W * *", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 14, 0, 0, 0)},
+		{"0 0 0 1W * *", utc(2000, 3, 31, 12, 0, 0), utc(2000, 4, 3, 0, 0, 0)},
+		{"0 0 0 30W * *", utc(2000, 4, 1, 0, 0, 0), utc(2000, 4, 28, 0, 0, 0)},
+		{"0 0 0 1,L * *", utc(2000, 1, 2, 0, 0, 0), utc(2000, 1, 31, 0, 0, 0)},
+
+		// nL and n#k
+		{"0 0 0 * * 5#3", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 21, 0, 0, 0)},
+		{"0 0 0 * * 1#5", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 31, 0, 0, 0)},
+		{"0 0 0 * * 5L", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 28, 0, 0, 0)},
+		{"0 0 0 * * FRIL", utc(2000, 1, 29, 0, 0, 0), utc(2000, 2, 25, 0, 0, 0)},
+		{"0 0 0 * * sun#1", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 2, 0, 0, 0)},
+
+		// names, 7 is Sunday
+		{"0 0 12 * FEB,mar MON", utc(2000, 1, 1, 0, 0, 0), utc(2000, 2, 7, 12, 0, 0)},
+		{"0 0 0 * * 7", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 2, 0, 0, 0)},
+		{"0 0 0 * * MON-FRI", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 3, 0, 0, 0)},
+		{"0 0 0 1 * SUN", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 2, 0, 0, 0)},
+
+		// macros
+		{"@yearly", utc(2000, 6, 1, 0, 0, 0), utc(2001, 1, 1, 0, 0, 0)},
+		{"@annually", utc(2000, 6, 1, 0, 0, 0), utc(2001, 1, 1, 0, 0, 0)},
+		{"@monthly", utc(2000, 1, 15, 0, 0, 0), utc(2000, 2, 1, 0, 0, 0)},
+		{"@weekly", utc(2000, 1, 1, 0, 0, 0), utc(2000, 1, 2, 0, 0, 0)},
+		{"@daily", utc(2000, 1, 1, 7, 40, 0), utc(2000, 1, 2, 0, 0, 0)},
+		{"@midnight", utc(2000, 1, 1, 7, 40, 0), utc(2000, 1, 2, 0, 0, 0)},
+		{"@hourly", utc(2000, 1, 1, 7, 40, 0), utc(2000, 1, 1, 8, 0, 0)},
+
+		// @every counts from the time passed to Next
+		{"@every 1h30m", utc(2000, 1, 1, 7, 40, 10).Add(500 * time.Millisecond), utc(2000, 1, 1, 9, 10, 10)},
+		{"@every 90s", utc(2000, 1, 1, 7, 40, 10), utc(2000, 1, 1, 7, 41, 40)},
+
+		// never
+		{"0 0 0 30 2 *", utc(2000, 1, 1, 0, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		cronExpr, err := NewCronExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%v: %v", test.expr, err)
+		}
+		if next := cronExpr.Next(test.from); !next.Equal(test.want) {
+			t.Errorf("%v from %v: %v, want %v", test.expr, test.from, next, test.want)
+		}
+	}
+}
+
+func TestCronExprInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * * *",
+		"* * 24 * * *",
+		"* * * 0 * *",
+		"* * * * 13 *",
+		"* * * * * 8",
+		"* * * 32W * *",
+		"* * * * * 5#6",
+		"* * * * * 8L",
+		"* * * * FOO *",
+		"*/0 * * * * *",
+		"5-1 * * * * *",
+		"@fortnightly",
+		"@daily *",
+		"@every",
+		"@every 500ms",
+		"@every soon",
+		"TZ=Nowhere/City * * * * *",
+	} {
+		if _, err := NewCronExpr(expr); err == nil {
+			t.Errorf("%v: no error", expr)
+		}
+	}
+}
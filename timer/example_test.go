@@ -27,6 +27,78 @@ func ExampleTimer() {
 	// My name is Leaf
 }
 
+func ExampleNewWheelDispatcher() {
+	d := timer.NewWheelDispatcher(10, 10*time.Millisecond)
+	defer d.Close()
+
+	// timer 1
+	d.AfterFunc(20*time.Millisecond, func() {
+		fmt.Println("My name is Leaf")
+	})
+
+	// timer 2
+	t := d.AfterFunc(time.Millisecond, func() {
+		fmt.Println("will not print")
+	})
+	t.Stop()
+
+	// dispatch
+	(<-d.ChanTimer).Cb()
+
+	// Output:
+	// My name is Leaf
+}
+
+func ExampleDispatcher_Every() {
+	d := timer.NewDispatcher(10)
+
+	// every
+	n := 0
+	var t *timer.Timer
+	t = d.Every(time.Millisecond, func() {
+		n++
+		fmt.Println("tick", n)
+		if n == 3 {
+			t.Stop()
+		}
+	})
+
+	// dispatch
+	for n < 3 {
+		(<-d.ChanTimer).Cb()
+	}
+
+	// Output:
+	// tick 1
+	// tick 2
+	// tick 3
+}
+
+func ExampleFakeClock() {
+	clock := timer.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := timer.NewDispatcherClock(10, clock)
+
+	// cron expr
+	cronExpr, err := timer.NewCronExpr("0 0 5 * * *")
+	if err != nil {
+		return
+	}
+
+	// daily reset
+	d.CronFunc(cronExpr, func() {
+		fmt.Println("reset at", d.Now())
+	})
+
+	// no waiting
+	clock.Advance(5 * time.Hour)
+
+	// dispatch
+	(<-d.ChanTimer).Cb()
+
+	// Output:
+	// reset at 2000-01-01 05:00:00 +0000 UTC
+}
+
 func ExampleCronExpr() {
 	cronExpr, err := timer.NewCronExpr("0 * * * *")
 	if err != nil {
@@ -43,6 +115,23 @@ func ExampleCronExpr() {
 	// 2000-01-01 21:00:00 +0000 UTC
 }
 
+func ExampleCronExpr_extended() {
+	// 5:00 on the last Friday of every month
+	cronExpr, err := timer.NewCronExpr("0 0 5 * JAN-DEC 5L")
+	if err != nil {
+		return
+	}
+
+	fmt.Println(cronExpr.Next(time.Date(
+		2000, 1, 1,
+		20, 10, 5,
+		0, time.UTC,
+	)))
+
+	// Output:
+	// 2000-01-28 05:00:00 +0000 UTC
+}
+
 func ExampleCron() {
 	d := timer.NewDispatcher(10)
 
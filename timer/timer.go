@@ -2,50 +2,221 @@ package timer
 
 import (
 	"github.com/islovingness/leaf/log"
+	"math/rand"
 	"time"
 )
 
 // one dispatcher per goroutine (goroutine not safe)
 type Dispatcher struct {
 	ChanTimer chan *Timer
+	clock     Clock
+	// nil: one clock timer per Timer
+	wheel *wheel
 }
 
 func NewDispatcher(l int) *Dispatcher {
+	return NewDispatcherClock(l, RealClock)
+}
+
+func NewDispatcherClock(l int, clock Clock) *Dispatcher {
 	disp := new(Dispatcher)
 	disp.ChanTimer = make(chan *Timer, l)
+	disp.clock = clock
 	return disp
 }
 
+// timers are kept in a hierarchical timing wheel driven by a single runtime
+// timer, they fire on the first tick at or after their time
+// cheaper than NewDispatcher for large numbers of timers, call Close when done
+func NewWheelDispatcher(l int, tick time.Duration) *Dispatcher {
+	return NewWheelDispatcherClock(l, tick, RealClock)
+}
+
+func NewWheelDispatcherClock(l int, tick time.Duration, clock Clock) *Dispatcher {
+	if tick <= 0 {
+		panic("invalid tick")
+	}
+
+	disp := NewDispatcherClock(l, clock)
+	disp.wheel = newWheel(tick, clock)
+	disp.wheel.run(disp.ChanTimer)
+	return disp
+}
+
+// the time of the timers
+func (disp *Dispatcher) Now() time.Time {
+	return disp.clock.Now()
+}
+
+// stops the timing wheel, pending timers never fire
+func (disp *Dispatcher) Close() {
+	if disp.wheel != nil {
+		disp.wheel.close()
+	}
+}
+
 // Timer
 type Timer struct {
-	t  *time.Timer
+	disp *Dispatcher
+	t    ClockTimer
+	f    func()
+	// f while the timer is pending, nil once stopped or fired
 	cb func()
+	// >0: fires every period, see Every
+	period time.Duration
+	jitter time.Duration
+	// the unjittered time of the next firing of a repeating timer
+	base time.Time
+	// when the timer fires
+	when time.Time
+	// deliveries of firings canceled by Stop or Reset, still on their way
+	stale int
+
+	// timing wheel
+	expires    int64
+	prev, next *Timer
+}
+
+func (disp *Dispatcher) newTimer(period time.Duration, jitter time.Duration, cb func()) *Timer {
+	t := new(Timer)
+	t.disp = disp
+	t.f = cb
+	t.cb = cb
+	t.period = period
+	t.jitter = jitter
+	return t
+}
+
+// schedules the delivery to ChanTimer after d plus jitter
+func (t *Timer) arm(d time.Duration) {
+	if t.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(t.jitter)))
+	}
+	t.when = t.disp.clock.Now().Add(d)
+
+	if t.disp.wheel != nil {
+		t.disp.wheel.add(t, d)
+	} else if t.t == nil {
+		t.t = t.disp.clock.AfterFunc(d, func() {
+			t.disp.ChanTimer <- t
+		})
+	} else {
+		t.t.Reset(d)
+	}
+}
+
+// false if the delivery is already on its way
+func (t *Timer) cancel() bool {
+	if t.disp.wheel != nil {
+		return t.disp.wheel.remove(t)
+	}
+	return t.t.Stop()
 }
 
 func (t *Timer) Stop() {
-	t.t.Stop()
+	if t.cb != nil && !t.cancel() {
+		t.stale++
+	}
 	t.cb = nil
 }
 
+// makes the timer fire after d, again every period for a repeating timer,
+// even if it has fired or has been stopped, the jitter still applies
+// returns whether the timer was pending
+func (t *Timer) Reset(d time.Duration) bool {
+	pending := t.cb != nil
+	if pending && !t.cancel() {
+		t.stale++
+		pending = false
+	}
+
+	t.cb = t.f
+	t.base = t.disp.clock.Now().Add(d)
+	t.arm(d)
+	return pending
+}
+
+// how long until the timer fires, 0 once stopped or fired
+func (t *Timer) Remaining() time.Duration {
+	if t.cb == nil {
+		return 0
+	}
+	if d := t.when.Sub(t.disp.clock.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// the callback, nil once stopped or fired
+func (t *Timer) Func() func() {
+	return t.cb
+}
+
 func (t *Timer) Cb() {
 	defer func() {
-		t.cb = nil
 		if r := recover(); r != nil {
 			log.Recover(r)
 		}
 	}()
 
-	if t.cb != nil {
-		t.cb()
+	if t.stale > 0 {
+		t.stale--
+		return
+	}
+
+	cb := t.cb
+	if cb == nil {
+		return
 	}
+	if t.period > 0 {
+		t.schedule()
+	} else {
+		t.cb = nil
+	}
+	cb()
+}
+
+// the next firing of a repeating timer, on the grid of base so that delays
+// do not add up, the firings missed meanwhile are skipped
+func (t *Timer) schedule() {
+	now := t.disp.clock.Now()
+	t.base = t.base.Add(t.period)
+	if !t.base.After(now) {
+		missed := now.Sub(t.base)/t.period + 1
+		t.base = t.base.Add(missed * t.period)
+	}
+	t.arm(t.base.Sub(now))
 }
 
 func (disp *Dispatcher) AfterFunc(d time.Duration, cb func()) *Timer {
-	t := new(Timer)
-	t.cb = cb
-	t.t = time.AfterFunc(d, func() {
-		disp.ChanTimer <- t
-	})
+	t := disp.newTimer(0, 0, cb)
+	t.arm(d)
+	return t
+}
+
+// like AfterFunc, delayed by a random duration in [0, jitter) more
+// so that timers created together spread out
+func (disp *Dispatcher) AfterFuncJitter(d time.Duration, jitter time.Duration, cb func()) *Timer {
+	t := disp.newTimer(0, jitter, cb)
+	t.arm(d)
+	return t
+}
+
+// cb is called every d until the timer is stopped, the first time after d
+func (disp *Dispatcher) Every(d time.Duration, cb func()) *Timer {
+	return disp.EveryJitter(d, 0, cb)
+}
+
+// like Every, each firing is delayed by a random duration in [0, jitter),
+// the delays do not add up
+func (disp *Dispatcher) EveryJitter(d time.Duration, jitter time.Duration, cb func()) *Timer {
+	if d <= 0 {
+		panic("invalid period")
+	}
+
+	t := disp.newTimer(d, jitter, cb)
+	t.base = disp.clock.Now().Add(d)
+	t.arm(d)
 	return t
 }
 
@@ -63,7 +234,7 @@ func (c *Cron) Stop() {
 func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	c := new(Cron)
 
-	now := time.Now()
+	now := disp.clock.Now()
 	nextTime := cronExpr.Next(now)
 	if nextTime.IsZero() {
 		return c
@@ -74,7 +245,7 @@ func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	cb = func() {
 		defer _cb()
 
-		now := time.Now()
+		now := disp.clock.Now()
 		nextTime := cronExpr.Next(now)
 		if nextTime.IsZero() {
 			return
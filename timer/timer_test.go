@@ -0,0 +1,154 @@
+package timer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newFakeDispatcher() (*Dispatcher, *firings) {
+	clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	disp := NewDispatcherClock(100, clock)
+	return disp, newFirings(disp, clock)
+}
+
+func TestEvery(t *testing.T) {
+	disp, f := newFakeDispatcher()
+	every := disp.Every(10*time.Second, f.cb("every"))
+
+	for _, d := range []time.Duration{9, 10, 19, 20, 30} {
+		f.set(d * time.Second)
+	}
+	// handled late, the missed firings are skipped and the grid is kept
+	f.set(55 * time.Second)
+	f.set(59 * time.Second)
+	f.set(60 * time.Second)
+	every.Stop()
+	f.set(100 * time.Second)
+
+	want := map[string][]time.Duration{
+		"every": {10 * time.Second, 20 * time.Second, 30 * time.Second, 55 * time.Second, 60 * time.Second},
+	}
+	if at := f.take(); !reflect.DeepEqual(at, want) {
+		t.Fatalf("fired at %v, want %v", at, want)
+	}
+}
+
+func TestReset(t *testing.T) {
+	disp, f := newFakeDispatcher()
+
+	// pending
+	pending := disp.AfterFunc(10*time.Second, f.cb("pending"))
+	f.set(5 * time.Second)
+	if !pending.Reset(10 * time.Second) {
+		t.Fatal("pending: not pending")
+	}
+
+	// delivered but not handled yet, the delivery is dropped
+	delivered := disp.AfterFunc(time.Second, f.cb("delivered"))
+	f.clock.Set(f.start.Add(6 * time.Second))
+	if delivered.Reset(4 * time.Second) {
+		t.Fatal("delivered: pending")
+	}
+
+	// fired
+	fired := disp.AfterFunc(time.Second, f.cb("fired"))
+	f.set(7 * time.Second)
+	if fired.Reset(5 * time.Second) {
+		t.Fatal("fired: pending")
+	}
+
+	// stopped
+	stopped := disp.AfterFunc(time.Second, f.cb("stopped"))
+	stopped.Stop()
+	if stopped.Reset(10 * time.Second) {
+		t.Fatal("stopped: pending")
+	}
+
+	// repeating, on the grid of the reset
+	every := disp.Every(10*time.Second, f.cb("every"))
+	f.set(8 * time.Second)
+	every.Reset(time.Second)
+
+	for d := time.Duration(9); d <= 30; d++ {
+		f.set(d * time.Second)
+	}
+	every.Stop()
+
+	want := map[string][]time.Duration{
+		"pending":   {15 * time.Second},
+		"delivered": {10 * time.Second},
+		"fired":     {7 * time.Second, 12 * time.Second},
+		"stopped":   {17 * time.Second},
+		"every":     {9 * time.Second, 19 * time.Second, 29 * time.Second},
+	}
+	if at := f.take(); !reflect.DeepEqual(at, want) {
+		t.Fatalf("fired at %v, want %v", at, want)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	disp, f := newFakeDispatcher()
+	timer := disp.AfterFunc(10*time.Second, f.cb("timer"))
+	every := disp.Every(10*time.Second, f.cb("every"))
+
+	f.set(3 * time.Second)
+	if remaining := timer.Remaining(); remaining != 7*time.Second {
+		t.Fatalf("pending: %v", remaining)
+	}
+	f.set(14 * time.Second)
+	if remaining := timer.Remaining(); remaining != 0 {
+		t.Fatalf("fired: %v", remaining)
+	}
+	if remaining := every.Remaining(); remaining != 6*time.Second {
+		t.Fatalf("every: %v", remaining)
+	}
+	every.Stop()
+	if remaining := every.Remaining(); remaining != 0 {
+		t.Fatalf("stopped: %v", remaining)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const d, jitter = 10 * time.Second, 5 * time.Second
+	disp, f := newFakeDispatcher()
+
+	var timers []*Timer
+	for i := 0; i < 100; i++ {
+		timers = append(timers, disp.AfterFuncJitter(d, jitter, f.cb("after")))
+	}
+	every := disp.EveryJitter(d, jitter, f.cb("every"))
+	spread := make(map[time.Duration]bool)
+	for _, timer := range timers {
+		remaining := timer.Remaining()
+		if remaining < d || remaining >= d+jitter {
+			t.Fatalf("remaining %v, want [%v, %v)", remaining, d, d+jitter)
+		}
+		spread[remaining] = true
+	}
+	if len(spread) < 2 {
+		t.Fatal("no jitter")
+	}
+
+	for s := time.Duration(0); s <= 105; s++ {
+		f.set(s * time.Second)
+	}
+	every.Stop()
+
+	// handled on the second after the firing
+	at := f.take()
+	for _, a := range at["after"] {
+		if a < d || a > d+jitter {
+			t.Fatalf("after fired at %v", a)
+		}
+	}
+	// the delays do not add up
+	if len(at["after"]) != len(timers) || len(at["every"]) != 10 {
+		t.Fatalf("fired at %v", at)
+	}
+	for i, a := range at["every"] {
+		if k := time.Duration(i + 1); a < k*d || a > k*d+jitter {
+			t.Fatalf("every fired at %v", at["every"])
+		}
+	}
+}
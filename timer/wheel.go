@@ -0,0 +1,186 @@
+package timer
+
+import (
+	"sync"
+	"time"
+)
+
+// hierarchical timing wheel, level i has wheelSlots slots of
+// tick * wheelSlots^i each, timers of later levels cascade down as time goes
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 5
+	// timers further away are parked in the last slot and placed again later
+	wheelMaxTicks = 1<<(wheelBits*wheelLevels) - 1
+)
+
+type wheel struct {
+	clock     Clock
+	tick      time.Duration
+	start     time.Time
+	chanTimer chan *Timer
+
+	mutex sync.Mutex
+	// ticks processed so far
+	current int64
+	slots   [wheelLevels][wheelSlots]Timer
+	ticker  ClockTimer
+	closed  bool
+	// reused by onTick, which never runs concurrently
+	expired []*Timer
+
+	closeSig chan bool
+}
+
+func newWheel(tick time.Duration, clock Clock) *wheel {
+	w := new(wheel)
+	w.clock = clock
+	w.tick = tick
+	w.start = clock.Now()
+	for i := range w.slots {
+		for j := range w.slots[i] {
+			// sentinels of circular lists
+			s := &w.slots[i][j]
+			s.prev, s.next = s, s
+		}
+	}
+	w.closeSig = make(chan bool)
+	return w
+}
+
+func (w *wheel) run(chanTimer chan *Timer) {
+	w.chanTimer = chanTimer
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.ticker = w.clock.AfterFunc(w.tick, w.onTick)
+}
+
+// one clock timer re-armed on every tick drives the wheel
+func (w *wheel) onTick() {
+	// catch up if ticks were missed
+	target := int64(w.clock.Now().Sub(w.start) / w.tick)
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return
+	}
+	expired := w.expired[:0]
+	for w.current < target {
+		w.current++
+		expired = w.advance(expired)
+	}
+	w.mutex.Unlock()
+
+	for i, t := range expired {
+		select {
+		case w.chanTimer <- t:
+		case <-w.closeSig:
+			return
+		}
+		expired[i] = nil
+	}
+	w.expired = expired[:0]
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.closed {
+		// the next tick boundary, so that ticks do not drift
+		w.ticker.Reset(w.start.Add(time.Duration(target+1) * w.tick).Sub(w.clock.Now()))
+	}
+}
+
+func (w *wheel) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.ticker.Stop()
+	close(w.closeSig)
+}
+
+// processes tick w.current, must hold the mutex
+func (w *wheel) advance(expired []*Timer) []*Timer {
+	// the upper levels move one slot every wheelSlots ticks of the level below
+	for level := 1; level < wheelLevels; level++ {
+		if w.current&(1<<(wheelBits*level)-1) != 0 {
+			break
+		}
+		s := &w.slots[level][(w.current>>(wheelBits*level))&wheelMask]
+		for t := s.next; t != s; {
+			next := t.next
+			t.prev, t.next = nil, nil
+			w.place(t)
+			t = next
+		}
+		s.prev, s.next = s, s
+	}
+
+	s := &w.slots[0][w.current&wheelMask]
+	for t := s.next; t != s; {
+		next := t.next
+		t.prev, t.next = nil, nil
+		expired = append(expired, t)
+		t = next
+	}
+	s.prev, s.next = s, s
+	return expired
+}
+
+// goroutine safe
+func (w *wheel) add(t *Timer, d time.Duration) {
+	// never early: fire on the first tick at or after now+d
+	expires := int64((w.clock.Now().Sub(w.start) + d + w.tick - 1) / w.tick)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if expires <= w.current {
+		expires = w.current + 1
+	}
+	t.expires = expires
+	w.place(t)
+}
+
+// must hold the mutex
+func (w *wheel) place(t *Timer) {
+	delta := t.expires - w.current
+	expires := t.expires
+	if delta > wheelMaxTicks {
+		delta = wheelMaxTicks
+		expires = w.current + wheelMaxTicks
+	}
+
+	level := 0
+	for delta >= wheelSlots && level < wheelLevels-1 {
+		delta >>= wheelBits
+		level++
+	}
+	// the slot is cascaded next at the start of the block of expires
+	s := &w.slots[level][(expires>>(wheelBits*level))&wheelMask]
+	t.prev, t.next = s.prev, s
+	s.prev.next = t
+	s.prev = t
+}
+
+// false if the timer is not in the wheel, e.g. it is being delivered
+// goroutine safe
+func (w *wheel) remove(t *Timer) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if t.prev == nil {
+		return false
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+	return true
+}
@@ -0,0 +1,191 @@
+package timer
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// records when the timers of a dispatcher on a FakeClock are handled
+type firings struct {
+	disp  *Dispatcher
+	clock *FakeClock
+	start time.Time
+	at    map[string][]time.Duration
+}
+
+func newFirings(disp *Dispatcher, clock *FakeClock) *firings {
+	f := new(firings)
+	f.disp = disp
+	f.clock = clock
+	f.start = clock.Now()
+	f.at = make(map[string][]time.Duration)
+	return f
+}
+
+func (f *firings) cb(name string) func() {
+	return func() {
+		f.at[name] = append(f.at[name], f.clock.Now().Sub(f.start))
+	}
+}
+
+// moves the clock to d after the start and handles the timers delivered meanwhile
+func (f *firings) set(d time.Duration) {
+	f.clock.Set(f.start.Add(d))
+	for len(f.disp.ChanTimer) > 0 {
+		(<-f.disp.ChanTimer).Cb()
+	}
+}
+
+func (f *firings) take() map[string][]time.Duration {
+	at := f.at
+	f.at = make(map[string][]time.Duration)
+	return at
+}
+
+func TestWheelCascade(t *testing.T) {
+	const tick = 10 * time.Millisecond
+	clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	disp := NewWheelDispatcherClock(100, tick, clock)
+	defer disp.Close()
+	f := newFirings(disp, clock)
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  time.Duration
+	}{
+		// never early, on the first tick at or after the time
+		{"now", 0, tick},
+		{"between ticks", 25 * time.Millisecond, 30 * time.Millisecond},
+		{"last slot of level 0", 63 * tick, 63 * tick},
+		{"level 1", 64 * tick, 64 * tick},
+		{"level 1 next", 65 * tick, 65 * tick},
+		{"level 2", (1<<12 + 1) * tick, (1<<12 + 1) * tick},
+		{"level 3", (1<<18 + 5) * tick, (1<<18 + 5) * tick},
+	}
+	for _, test := range tests {
+		disp.AfterFunc(test.after, f.cb(test.name))
+	}
+	stopped := disp.AfterFunc((1<<12+1)*tick, f.cb("stopped"))
+	stopped.Stop()
+
+	sort.Slice(tests, func(i, j int) bool {
+		return tests[i].want < tests[j].want
+	})
+	for _, test := range tests {
+		// nothing fires a tick early, the timer fires on its tick
+		f.set(test.want - tick)
+		f.set(test.want)
+	}
+	f.set((1<<18 + 100) * tick)
+
+	want := make(map[string][]time.Duration)
+	for _, test := range tests {
+		want[test.name] = []time.Duration{test.want}
+	}
+	if at := f.take(); !reflect.DeepEqual(at, want) {
+		t.Fatalf("fired at %v, want %v", at, want)
+	}
+}
+
+func TestWheelReset(t *testing.T) {
+	const tick = time.Second
+	clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	disp := NewWheelDispatcherClock(100, tick, clock)
+	defer disp.Close()
+	f := newFirings(disp, clock)
+
+	// a pending timer moves from level 1 to level 0
+	timer := disp.AfterFunc(100*tick, f.cb("reset"))
+	f.set(10 * tick)
+	if !timer.Reset(5 * tick) {
+		t.Fatal("reset: not pending")
+	}
+	if remaining := timer.Remaining(); remaining != 5*tick {
+		t.Fatalf("remaining: %v", remaining)
+	}
+
+	// a timer delivered but not handled yet fires once, at the new time
+	late := disp.AfterFunc(2*tick, f.cb("late"))
+	clock.Set(f.start.Add(12 * tick))
+	if late.Reset(3 * tick) {
+		t.Fatal("late: pending")
+	}
+	f.set(14 * tick)
+	f.set(15 * tick)
+	f.set(200 * tick)
+
+	want := map[string][]time.Duration{
+		"reset": {15 * tick},
+		"late":  {15 * tick},
+	}
+	if at := f.take(); !reflect.DeepEqual(at, want) {
+		t.Fatalf("fired at %v, want %v", at, want)
+	}
+}
+
+// where the timer is in the wheel
+func findTimer(w *wheel, timer *Timer) (int, int, bool) {
+	for level := range w.slots {
+		for slot := range w.slots[level] {
+			s := &w.slots[level][slot]
+			for t := s.next; t != s; t = t.next {
+				if t == timer {
+					return level, slot, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// too many ticks to pass one by one, the wheel jumps to the tick before the
+// next cascade of the slot holding the timer, nothing happens meanwhile
+func TestWheelFar(t *testing.T) {
+	w := newWheel(time.Second, NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	tests := []struct {
+		name    string
+		expires int64
+		// the levels the timer goes through
+		levels []int
+	}{
+		{"level 4", 1<<24 + 7, []int{4, 0}},
+		{"level 4 middle", 5<<24 + 3<<18 + 2<<12 + 1<<6 + 9, []int{4, 3, 2, 1, 0}},
+		// parked in the last slot and placed again
+		{"beyond the wheel", 1<<30 + 3, []int{4, 4, 0}},
+	}
+	for _, test := range tests {
+		w.current = 0
+		timer := new(Timer)
+		timer.expires = test.expires
+		w.place(timer)
+
+		var levels []int
+		for {
+			level, slot, ok := findTimer(w, timer)
+			if !ok {
+				t.Fatalf("%v: lost at tick %v", test.name, w.current)
+			}
+			levels = append(levels, level)
+			unit := int64(1) << (wheelBits * level)
+			block := unit * wheelSlots
+			next := w.current/block*block + int64(slot)*unit
+			if next <= w.current {
+				next += block
+			}
+			w.current = next
+			if expired := w.advance(nil); len(expired) > 0 {
+				if len(expired) != 1 || expired[0] != timer || w.current != test.expires {
+					t.Fatalf("%v: expired %v at tick %v", test.name, expired, w.current)
+				}
+				break
+			}
+		}
+		if !reflect.DeepEqual(levels, test.levels) {
+			t.Fatalf("%v: levels %v, want %v", test.name, levels, test.levels)
+		}
+	}
+}